@@ -0,0 +1,63 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"net/http"
+	"net/url"
+	"testing"
+)
+
+func TestAdminKeyRoutes(t *testing.T) {
+	app, standIn := newTestApp(t)
+	adminID := standIn.addAccount("admin@example.com")
+	revokedKey := uuid.New()
+
+	var listed, patched url.Values
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		switch {
+		case r.URL.Path == "/rest/v1/user_roles":
+			writeRows(w, []map[string]interface{}{{"user_id": adminID, "role": "super-admin"}})
+		case r.URL.Path == "/rest/v1/api_keys" && r.Method == http.MethodGet:
+			listed = r.URL.Query()
+			writeRows(w, []map[string]interface{}{})
+		case r.URL.Path == "/rest/v1/api_keys" && r.Method == http.MethodPatch:
+			patched = r.URL.Query()
+			// The key was revoked before, so an unrevoked-only update matches nothing.
+			if patched.Get("revoked_at") == "is.null" {
+				writeRows(w, []map[string]interface{}{})
+			} else {
+				writeRows(w, []map[string]interface{}{{"id": revokedKey, "is_active": false}})
+			}
+		default:
+			return false
+		}
+		return true
+	}
+	auth := map[string]string{"Authorization": "Bearer " + signTestTokenAAL(t, adminID, uuid.NewString(), "aal2")}
+
+	for _, tc := range []struct {
+		query, offset, limit string
+	}{
+		{"?page=0&limit=1000000", "0", "10"},
+		{"?page=-3&limit=-1", "0", "10"},
+		{"?page=3&limit=100", "200", "100"},
+	} {
+		resp := doJSON(t, app, "GET", "/api/admin/keys"+tc.query, "", auth)
+		if resp.status != fiber.StatusOK {
+			t.Fatalf("%s: status %d, body %s", tc.query, resp.status, resp.body)
+		}
+		if listed.Get("offset") != tc.offset || listed.Get("limit") != tc.limit {
+			t.Errorf("%s: offset %s limit %s, want %s and %s",
+				tc.query, listed.Get("offset"), listed.Get("limit"), tc.offset, tc.limit)
+		}
+	}
+
+	resp := doJSON(t, app, "DELETE", "/api/admin/keys/"+revokedKey.String(), "", auth)
+	if resp.status != fiber.StatusNotFound {
+		t.Errorf("revoking again: status %d, body %s", resp.status, resp.body)
+	}
+	if patched.Get("revoked_at") != "is.null" {
+		t.Errorf("revocation didn't skip revoked keys: %v", patched)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAdminUnlockAuditsPriorLock(t *testing.T) {
+	app, standIn := newTestApp(t)
+	adminID := standIn.addAccount("admin@example.com")
+	lockedID := standIn.addAccount("locked@example.com")
+	lockedUntil := time.Now().Add(time.Hour).UTC().Truncate(time.Second)
+
+	events := map[string]map[string]interface{}{}
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		switch {
+		case r.URL.Path == "/rest/v1/user_roles":
+			if strings.TrimPrefix(r.URL.Query().Get("user_id"), "eq.") == adminID.String() {
+				writeRows(w, []map[string]interface{}{{"user_id": adminID, "role": "super-admin"}})
+			} else {
+				writeRows(w, []map[string]interface{}{})
+			}
+		case r.URL.Path == "/rest/v1/users" && strings.TrimPrefix(r.URL.Query().Get("id"), "eq.") == lockedID.String():
+			row := map[string]interface{}{"id": lockedID, "email": "locked@example.com", "is_active": true}
+			if r.Method == http.MethodGet {
+				row["failed_login_attempts"] = 7
+				row["locked_until"] = lockedUntil
+			}
+			writeRows(w, []map[string]interface{}{row})
+		case r.URL.Path == "/rest/v1/rpc/append_audit_event":
+			var params map[string]interface{}
+			json.Unmarshal(body, &params)
+			events[params["p_action"].(string)] = params
+			w.Write([]byte(`{"id":1,"hash":"` + strings.Repeat("0", 64) + `"}`))
+		default:
+			return false
+		}
+		return true
+	}
+	auth := map[string]string{"Authorization": "Bearer " + signTestTokenAAL(t, adminID, uuid.NewString(), "aal2")}
+
+	resp := doJSON(t, app, "POST", "/api/admin/users/"+lockedID.String()+"/unlock", "", auth)
+	if resp.status != fiber.StatusOK {
+		t.Fatalf("status %d, body %s", resp.status, resp.body)
+	}
+
+	event, ok := events["user.unlock"]
+	if !ok {
+		t.Fatal("unlock was not audited")
+	}
+	before, _ := event["p_before"].(map[string]interface{})
+	if before["failed_login_attempts"] != float64(7) {
+		t.Errorf("before failed_login_attempts = %v, want 7", before["failed_login_attempts"])
+	}
+	if until, _ := before["locked_until"].(string); !strings.HasPrefix(until, lockedUntil.Format("2006-01-02T15:04:05")) {
+		t.Errorf("before locked_until = %v, want %s", before["locked_until"], lockedUntil)
+	}
+
+	if resp := doJSON(t, app, "POST", "/api/admin/users/"+uuid.NewString()+"/unlock", "", auth); resp.status != fiber.StatusNotFound {
+		t.Errorf("unknown user: status %d, body %s", resp.status, resp.body)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"api/config"
+	"api/utils"
+	"crypto/rand"
+	"encoding/base64"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestAPIKeyRoutesNeedNoJWT(t *testing.T) {
+	pepper := make([]byte, 32)
+	rand.Read(pepper)
+	t.Setenv("API_KEY_PEPPERS", "1:"+base64.StdEncoding.EncodeToString(pepper))
+	t.Setenv("API_KEY_ENVIRONMENT", "test")
+	if err := config.InitKeyPeppers(); err != nil {
+		t.Fatal(err)
+	}
+
+	app, standIn := newTestApp(t)
+
+	apiKey, err := utils.GenerateAPIKey(config.APIKeyEnvironment())
+	if err != nil {
+		t.Fatal(err)
+	}
+	hash, version := utils.HashAPIKey(apiKey)
+	keyID, accountID := uuid.New(), uuid.New()
+
+	var listed bool
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		switch r.URL.Path {
+		case "/rest/v1/api_keys":
+			if r.Method == http.MethodGet && !strings.Contains(r.URL.Query().Get("key_hash"), hash) {
+				writeRows(w, []map[string]interface{}{})
+				return true
+			}
+			writeRows(w, []map[string]interface{}{{
+				"id": keyID, "service_account_id": accountID, "key_hash": hash, "hash_version": version,
+				"is_active": true, "rate_limit": 60, "scopes": []string{"requests:read"},
+			}})
+		case "/rest/v1/service_accounts":
+			writeRows(w, []map[string]interface{}{{"id": accountID, "name": "ci"}})
+		case "/rest/v1/model_requests":
+			listed = true
+			writeRows(w, []map[string]interface{}{})
+		default:
+			return false
+		}
+		return true
+	}
+
+	resp := doJSON(t, app, "GET", "/api/v1/requests", "", map[string]string{"X-API-Key": apiKey})
+	if resp.status != fiber.StatusOK {
+		t.Fatalf("status %d, body %s", resp.status, resp.body)
+	}
+	if !listed {
+		t.Error("requests were never listed")
+	}
+
+	resp = doJSON(t, app, "GET", "/api/v1/status", "", map[string]string{"X-API-Key": apiKey})
+	if resp.status != fiber.StatusOK {
+		t.Fatalf("status: status %d, body %s", resp.status, resp.body)
+	}
+
+	resp = doJSON(t, app, "GET", "/api/v1/requests", "", nil)
+	if resp.status != fiber.StatusUnauthorized || !strings.Contains(resp.body, "API key required") {
+		t.Errorf("without a key: status %d, body %s", resp.status, resp.body)
+	}
+}
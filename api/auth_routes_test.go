@@ -0,0 +1,165 @@
+package main
+
+import (
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"io"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+type testResponse struct {
+	status int
+	body   string
+}
+
+func postJSON(t *testing.T, app *fiber.App, path, body string) testResponse {
+	t.Helper()
+	return doJSON(t, app, "POST", path, body, nil)
+}
+
+func doJSON(t *testing.T, app *fiber.App, method, path, body string, headers map[string]string) testResponse {
+	t.Helper()
+	req := httptest.NewRequest(method, path, strings.NewReader(body))
+	req.Header.Set("Content-Type", "application/json")
+	for name, value := range headers {
+		req.Header.Set(name, value)
+	}
+	resp, err := app.Test(req, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	data, _ := io.ReadAll(resp.Body)
+	return testResponse{status: resp.StatusCode, body: string(data)}
+}
+
+func TestEmailFlowsAnswerAlikeForUnknownEmails(t *testing.T) {
+	for _, tt := range []struct {
+		path       string
+		gotruePath string
+	}{
+		{"/api/auth/recover", "POST /recover"},
+		{"/api/auth/magic-link", "POST /otp"},
+		{"/api/auth/otp", "POST /otp"},
+	} {
+		t.Run(tt.path, func(t *testing.T) {
+			app, standIn := newTestApp(t)
+			standIn.addAccount("known@example.com")
+
+			known := postJSON(t, app, tt.path, `{"email":"known@example.com"}`)
+			unknown := postJSON(t, app, tt.path, `{"email":"unknown@example.com"}`)
+
+			if known.status != fiber.StatusAccepted {
+				t.Fatalf("known email: status %d, body %s", known.status, known.body)
+			}
+			if known != unknown {
+				t.Fatalf("responses differ:\nknown:   %+v\nunknown: %+v", known, unknown)
+			}
+			if calls := standIn.calls(tt.gotruePath); calls != 2 {
+				t.Fatalf("gotrue %s called %d times, want 2", tt.gotruePath, calls)
+			}
+		})
+	}
+}
+
+func TestVerifyAnswersAlikeForUnknownEmails(t *testing.T) {
+	app, standIn := newTestApp(t)
+	standIn.addAccount("known@example.com")
+	standIn.codes["known@example.com"] = "123456"
+
+	wrongCode := postJSON(t, app, "/api/auth/verify", `{"email":"known@example.com","token":"000000","type":"email"}`)
+	unknown := postJSON(t, app, "/api/auth/verify", `{"email":"unknown@example.com","token":"000000","type":"email"}`)
+	if wrongCode.status != fiber.StatusUnauthorized {
+		t.Fatalf("wrong code: status %d, body %s", wrongCode.status, wrongCode.body)
+	}
+	if wrongCode != unknown {
+		t.Fatalf("responses differ:\nwrong code: %+v\nunknown:    %+v", wrongCode, unknown)
+	}
+
+	ok := postJSON(t, app, "/api/auth/verify", `{"email":"known@example.com","token":"123456","type":"recovery"}`)
+	if ok.status != fiber.StatusOK || !strings.Contains(ok.body, `"access_token"`) {
+		t.Fatalf("valid code: status %d, body %s", ok.status, ok.body)
+	}
+}
+
+func TestEmailFlowsLimitPerEmail(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	for i := 1; i <= 3; i++ {
+		if resp := postJSON(t, app, "/api/auth/recover", `{"email":"target@example.com"}`); resp.status != fiber.StatusAccepted {
+			t.Fatalf("request %d: status %d", i, resp.status)
+		}
+	}
+	if resp := postJSON(t, app, "/api/auth/recover", `{"email":"Target@example.com"}`); resp.status != fiber.StatusTooManyRequests {
+		t.Fatalf("4th request for the same email: status %d, want 429", resp.status)
+	}
+	if resp := postJSON(t, app, "/api/auth/recover", `{"email":"other@example.com"}`); resp.status != fiber.StatusAccepted {
+		t.Fatalf("other email: status %d, want 202", resp.status)
+	}
+	// Each endpoint has its own budget.
+	if resp := postJSON(t, app, "/api/auth/otp", `{"email":"target@example.com"}`); resp.status != fiber.StatusAccepted {
+		t.Fatalf("otp for the same email: status %d, want 202", resp.status)
+	}
+}
+
+func TestEmailFlowsLimitPerIP(t *testing.T) {
+	app, _ := newTestApp(t)
+
+	emails := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"}
+	for _, name := range emails {
+		if resp := postJSON(t, app, "/api/auth/otp", `{"email":"`+name+`@example.com"}`); resp.status != fiber.StatusAccepted {
+			t.Fatalf("%s@example.com: status %d", name, resp.status)
+		}
+	}
+	if resp := postJSON(t, app, "/api/auth/otp", `{"email":"k@example.com"}`); resp.status != fiber.StatusTooManyRequests {
+		t.Fatalf("11th request from the IP: status %d, want 429", resp.status)
+	}
+}
+
+func TestVerifyLimitsPerEmail(t *testing.T) {
+	app, standIn := newTestApp(t)
+	standIn.addAccount("known@example.com")
+	standIn.codes["known@example.com"] = "123456"
+
+	for i := 1; i <= 5; i++ {
+		if resp := postJSON(t, app, "/api/auth/verify", `{"email":"known@example.com","token":"000000","type":"email"}`); resp.status != fiber.StatusUnauthorized {
+			t.Fatalf("guess %d: status %d", i, resp.status)
+		}
+	}
+	// Even the right code is refused once the guesses are used up.
+	if resp := postJSON(t, app, "/api/auth/verify", `{"email":"known@example.com","token":"123456","type":"email"}`); resp.status != fiber.StatusTooManyRequests {
+		t.Fatalf("6th attempt: status %d, want 429", resp.status)
+	}
+}
+
+func TestUpdatePasswordAppliesPolicy(t *testing.T) {
+	app, standIn := newTestApp(t)
+	userID := standIn.addAccount("reset@example.com")
+	auth := map[string]string{"Authorization": "Bearer " + signTestToken(t, userID, uuid.NewString())}
+
+	weak := doJSON(t, app, "PUT", "/api/auth/password", `{"password":"reset@example.com1"}`, auth)
+	if weak.status != fiber.StatusBadRequest || !strings.Contains(weak.body, "weak_password") {
+		t.Fatalf("weak password: status %d, body %s", weak.status, weak.body)
+	}
+	if calls := standIn.calls("PUT /user"); calls != 0 {
+		t.Fatalf("weak password reached gotrue %d times", calls)
+	}
+
+	strong := doJSON(t, app, "PUT", "/api/auth/password", `{"password":"vX9#qLm2$Tz7!pWr"}`, auth)
+	if strong.status != fiber.StatusNoContent {
+		t.Fatalf("strong password: status %d, body %s", strong.status, strong.body)
+	}
+	if calls := standIn.calls("PUT /user"); calls != 1 {
+		t.Fatalf("gotrue PUT /user called %d times, want 1", calls)
+	}
+	if calls := standIn.calls("POST /logout?scope=others"); calls != 1 {
+		t.Fatalf("other sessions signed out %d times, want 1", calls)
+	}
+
+	anonymous := doJSON(t, app, "PUT", "/api/auth/password", `{"password":"vX9#qLm2$Tz7!pWr"}`, nil)
+	if anonymous.status != fiber.StatusUnauthorized {
+		t.Fatalf("without a token: status %d, want 401", anonymous.status)
+	}
+}
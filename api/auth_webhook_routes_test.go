@@ -0,0 +1,111 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testWebhookSecret = "auth-webhook-secret"
+
+// triggerDelivery builds the body and headers notify_auth_user_change sends
+// for a new auth user: the body is jsonb_build_object(...)::text, with
+// Postgres' key order and spacing.
+func triggerDelivery(userID uuid.UUID, email, secret string) (string, map[string]string) {
+	body := `{"type": "INSERT", "table": "users", "record": {"id": "` + userID.String() +
+		`", "email": "` + email + `"}, "schema": "auth", "old_record": null}`
+	id := uuid.NewString()
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(id + "." + timestamp + "." + body))
+	return body, map[string]string{
+		"Content-Type":          "application/json",
+		"X-Signature-ID":        id,
+		"X-Signature-Timestamp": timestamp,
+		"X-Signature":           "sha256=" + hex.EncodeToString(mac.Sum(nil)),
+	}
+}
+
+func TestAuthWebhookAcceptsTriggerDeliveries(t *testing.T) {
+	t.Setenv("AUTH_WEBHOOK_SECRET", testWebhookSecret)
+	app, standIn := newTestApp(t)
+
+	var synced []string
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		if r.URL.Path != "/rest/v1/rpc/sync_auth_user" {
+			return false
+		}
+		var params struct {
+			UserID string `json:"p_user_id"`
+		}
+		json.Unmarshal(body, &params)
+		synced = append(synced, params.UserID)
+		w.Write([]byte(`"created"`))
+		return true
+	}
+
+	userID := uuid.New()
+	body, headers := triggerDelivery(userID, "direct@example.com", testWebhookSecret)
+	resp := doJSON(t, app, "POST", "/api/auth/webhook", body, headers)
+	if resp.status != fiber.StatusOK || !strings.Contains(resp.body, `"created"`) {
+		t.Fatalf("signed delivery: status %d, body %s", resp.status, resp.body)
+	}
+	if len(synced) != 1 || synced[0] != userID.String() {
+		t.Fatalf("synced %v, want [%s]", synced, userID)
+	}
+
+	body, headers = triggerDelivery(userID, "direct@example.com", "another-secret")
+	if resp := doJSON(t, app, "POST", "/api/auth/webhook", body, headers); resp.status != fiber.StatusUnauthorized {
+		t.Errorf("wrong secret: status %d, body %s", resp.status, resp.body)
+	}
+
+	body, headers = triggerDelivery(userID, "direct@example.com", testWebhookSecret)
+	headers["X-Signature-Timestamp"] = strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	if resp := doJSON(t, app, "POST", "/api/auth/webhook", body, headers); resp.status != fiber.StatusUnauthorized {
+		t.Errorf("stale delivery: status %d, body %s", resp.status, resp.body)
+	}
+
+	if len(synced) != 1 {
+		t.Errorf("rejected deliveries were synced: %v", synced)
+	}
+}
+
+func TestVerifyLeavesUnvettedAccountsPending(t *testing.T) {
+	app, standIn := newTestApp(t)
+	standIn.addAccount("direct@example.com")
+	standIn.codes["direct@example.com"] = "123456"
+
+	// gotrue knows the account but public.users doesn't yet, as after a
+	// signup straight at gotrue whose delivery hasn't arrived.
+	var inserted map[string]interface{}
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		if r.URL.Path != "/rest/v1/users" {
+			return false
+		}
+		if r.Method == http.MethodPost {
+			json.Unmarshal(body, &inserted)
+		}
+		writeRows(w, []map[string]interface{}{})
+		return true
+	}
+
+	resp := postJSON(t, app, "/api/auth/verify", `{"email":"direct@example.com","token":"123456","type":"email"}`)
+	if resp.status != fiber.StatusOK {
+		t.Fatalf("status %d, body %s", resp.status, resp.body)
+	}
+	if inserted == nil {
+		t.Fatal("no users row was created")
+	}
+	if inserted["is_active"] != false || inserted["signup_pending"] != true {
+		t.Errorf("row created as %v, want inactive and pending", inserted)
+	}
+}
@@ -0,0 +1,54 @@
+// Command reconcile-users repairs drift between gotrue's users and
+// public.users: it creates missing rows, inactive until the signup policy
+// admits their users, copies changed emails and deactivates rows whose auth
+// user is gone. Run it after outages of the auth webhook, or with -dry-run
+// to see what it would change.
+package main
+
+import (
+	"api/config"
+	"api/handlers"
+	"api/middleware"
+	"flag"
+	"fmt"
+	"log"
+	"sort"
+)
+
+func main() {
+	dryRun := flag.Bool("dry-run", false, "report drift without changing anything")
+	flag.Parse()
+
+	// init supabase client
+	if err := config.InitSupabase(); err != nil {
+		log.Fatalf("Failed to initialized Supabase: %v", err)
+	}
+
+	//init postgres client
+	if err := config.InitPostgres(); err != nil {
+		log.Fatalf("Failed to initialized Postgres Client: %v", err)
+	}
+
+	//init token blacklist; with a shared store deactivated users lose their tokens
+	if err := middleware.InitBlacklist(); err != nil {
+		log.Fatalf("Failed to initialize token blacklist: %v", err)
+	}
+
+	report, err := handlers.ReconcileUsers(*dryRun)
+	if err != nil {
+		log.Fatalf("Failed to reconcile users: %v", err)
+	}
+
+	fmt.Printf("auth users: %d, users rows: %d\n", report.AuthUsers, report.ProfileUsers)
+	results := make([]string, 0, len(report.Results))
+	for result := range report.Results {
+		results = append(results, result)
+	}
+	sort.Strings(results)
+	for _, result := range results {
+		fmt.Printf("%s: %d\n", result, report.Results[result])
+	}
+	if report.Failed > 0 {
+		log.Fatalf("%d users failed to sync", report.Failed)
+	}
+}
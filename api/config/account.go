@@ -0,0 +1,26 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+var accountDeletionGrace = 14 * 24 * time.Hour
+
+// InitAccountDeletion reads ACCOUNT_DELETION_GRACE, how long users have to
+// cancel a deletion request before their data is erased.
+func InitAccountDeletion() error {
+	if value := os.Getenv("ACCOUNT_DELETION_GRACE"); value != "" {
+		d, err := time.ParseDuration(value)
+		if err != nil || d < 0 {
+			return fmt.Errorf("invalid ACCOUNT_DELETION_GRACE %q", value)
+		}
+		accountDeletionGrace = d
+	}
+	return nil
+}
+
+func GetAccountDeletionGrace() time.Duration {
+	return accountDeletionGrace
+}
@@ -0,0 +1,43 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+const maxImpersonationTTL = time.Hour
+
+// ImpersonationConfig controls the short-lived tokens admins use to act as a
+// user while debugging. The API signs them itself, with a secret separate
+// from the Supabase project's.
+type ImpersonationConfig struct {
+	Secret []byte
+	TTL    time.Duration
+}
+
+var impersonationConfig = ImpersonationConfig{TTL: 30 * time.Minute}
+
+// InitImpersonation reads IMPERSONATION_SECRET and IMPERSONATION_TTL.
+// Impersonation is disabled when no secret is set.
+func InitImpersonation() error {
+	if secret := os.Getenv("IMPERSONATION_SECRET"); secret != "" {
+		if len(secret) < 32 {
+			return fmt.Errorf("IMPERSONATION_SECRET must be at least 32 bytes")
+		}
+		impersonationConfig.Secret = []byte(secret)
+	}
+
+	if value := os.Getenv("IMPERSONATION_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 || ttl > maxImpersonationTTL {
+			return fmt.Errorf("invalid IMPERSONATION_TTL %q: must be between 0 and %s", value, maxImpersonationTTL)
+		}
+		impersonationConfig.TTL = ttl
+	}
+	return nil
+}
+
+func GetImpersonationConfig() ImpersonationConfig {
+	return impersonationConfig
+}
@@ -0,0 +1,62 @@
+package config
+
+import (
+	"os"
+	"strings"
+	"time"
+)
+
+// JWTConfig describes how Supabase access tokens are verified locally.
+type JWTConfig struct {
+	// Secret verifies HS256 tokens (the project's legacy JWT secret).
+	Secret []byte
+	// JWKSURL serves the project's asymmetric signing keys (RS256/ES256).
+	JWKSURL  string
+	Issuer   string
+	Audience string
+	// Leeway tolerates small clock differences when checking exp and nbf.
+	Leeway time.Duration
+}
+
+var (
+	jwtConfig JWTConfig
+	authURL   string
+)
+
+// InitJWT reads SUPABASE_JWT_SECRET, SUPABASE_JWT_ISSUER and
+// SUPABASE_JWT_AUDIENCE. Issuer and JWKS URL default to the project's auth
+// endpoint under SUPABASE_URL, and the audience to "authenticated".
+func InitJWT() error {
+	supabaseURL := os.Getenv("SUPABASE_URL")
+	if !strings.HasPrefix(supabaseURL, "https://") && !strings.HasPrefix(supabaseURL, "http://") {
+		supabaseURL = "https://" + supabaseURL
+	}
+	authURL = strings.TrimSuffix(supabaseURL, "/") + "/auth/v1"
+
+	cfg := JWTConfig{
+		Secret:   []byte(os.Getenv("SUPABASE_JWT_SECRET")),
+		JWKSURL:  authURL + "/.well-known/jwks.json",
+		Issuer:   authURL,
+		Audience: "authenticated",
+		Leeway:   30 * time.Second,
+	}
+
+	if issuer := os.Getenv("SUPABASE_JWT_ISSUER"); issuer != "" {
+		cfg.Issuer = issuer
+	}
+	if audience := os.Getenv("SUPABASE_JWT_AUDIENCE"); audience != "" {
+		cfg.Audience = audience
+	}
+
+	jwtConfig = cfg
+	return nil
+}
+
+func GetJWTConfig() JWTConfig {
+	return jwtConfig
+}
+
+// GetAuthURL is the base URL of the project's gotrue API.
+func GetAuthURL() string {
+	return authURL
+}
@@ -0,0 +1,95 @@
+package config
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var (
+	keyPeppers         = make(map[int][]byte)
+	currentKeyPepperID int
+)
+
+// InitKeyPeppers loads the server-side secrets mixed into API key hashes.
+// API_KEY_PEPPERS lists every active version as "version:base64secret"
+// pairs separated by commas. New keys are hashed with API_KEY_PEPPER_VERSION,
+// or the highest listed version when it is unset; older versions stay
+// listed until every key hashed with them has been upgraded.
+func InitKeyPeppers() error {
+	raw := os.Getenv("API_KEY_PEPPERS")
+	if raw == "" {
+		return errors.New("API_KEY_PEPPERS is not set")
+	}
+
+	peppers := make(map[int][]byte)
+	highest := 0
+	for _, entry := range strings.Split(raw, ",") {
+		versionStr, secretStr, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		if !ok {
+			return fmt.Errorf("invalid API key pepper entry %q", entry)
+		}
+
+		version, err := strconv.Atoi(versionStr)
+		if err != nil || version < 1 {
+			return fmt.Errorf("invalid API key pepper version %q", versionStr)
+		}
+
+		secret, err := base64.StdEncoding.DecodeString(secretStr)
+		if err != nil || len(secret) < 32 {
+			return fmt.Errorf("API key pepper %d must be at least 32 base64-encoded bytes", version)
+		}
+
+		peppers[version] = secret
+		if version > highest {
+			highest = version
+		}
+	}
+
+	current := highest
+	if v := os.Getenv("API_KEY_PEPPER_VERSION"); v != "" {
+		var err error
+		if current, err = strconv.Atoi(v); err != nil {
+			return fmt.Errorf("invalid API_KEY_PEPPER_VERSION %q", v)
+		}
+		if _, ok := peppers[current]; !ok {
+			return fmt.Errorf("API_KEY_PEPPER_VERSION %d is not listed in API_KEY_PEPPERS", current)
+		}
+	}
+
+	keyPeppers = peppers
+	currentKeyPepperID = current
+	return nil
+}
+
+// GetKeyPepper returns the pepper for a hash version.
+func GetKeyPepper(version int) ([]byte, bool) {
+	pepper, ok := keyPeppers[version]
+	return pepper, ok
+}
+
+// GetKeyPepperVersions returns every active pepper version.
+func GetKeyPepperVersions() []int {
+	versions := make([]int, 0, len(keyPeppers))
+	for version := range keyPeppers {
+		versions = append(versions, version)
+	}
+	return versions
+}
+
+// CurrentKeyPepperVersion is the version new and upgraded keys are hashed with.
+func CurrentKeyPepperVersion() int {
+	return currentKeyPepperID
+}
+
+// APIKeyEnvironment is the environment this deployment issues and accepts
+// keys for, "live" unless API_KEY_ENVIRONMENT says "test".
+func APIKeyEnvironment() string {
+	if os.Getenv("API_KEY_ENVIRONMENT") == "test" {
+		return "test"
+	}
+	return "live"
+}
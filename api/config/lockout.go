@@ -0,0 +1,69 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"time"
+)
+
+// LoginLockoutConfig controls how failed sign-ins lock accounts and IPs.
+// Every MaxAttempts consecutive failures lock the account; each lockout
+// lasts twice as long as the previous one, from BaseLockout up to MaxLockout.
+type LoginLockoutConfig struct {
+	MaxAttempts   int
+	IPMaxAttempts int
+	BaseLockout   time.Duration
+	MaxLockout    time.Duration
+	// IPWindow is how long an IP's failures are remembered. IP counters are
+	// not reset by a success, which anyone could produce with their own account.
+	IPWindow time.Duration
+}
+
+var loginLockout = LoginLockoutConfig{
+	MaxAttempts:   5,
+	IPMaxAttempts: 20,
+	BaseLockout:   time.Minute,
+	MaxLockout:    24 * time.Hour,
+	IPWindow:      time.Hour,
+}
+
+// InitLoginLockout reads LOGIN_MAX_ATTEMPTS, LOGIN_IP_MAX_ATTEMPTS,
+// LOGIN_LOCKOUT_BASE, LOGIN_LOCKOUT_MAX and LOGIN_IP_WINDOW.
+func InitLoginLockout() error {
+	cfg := loginLockout
+
+	for env, target := range map[string]*int{
+		"LOGIN_MAX_ATTEMPTS":    &cfg.MaxAttempts,
+		"LOGIN_IP_MAX_ATTEMPTS": &cfg.IPMaxAttempts,
+	} {
+		if value := os.Getenv(env); value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil || n < 1 {
+				return fmt.Errorf("invalid %s %q", env, value)
+			}
+			*target = n
+		}
+	}
+
+	for env, target := range map[string]*time.Duration{
+		"LOGIN_LOCKOUT_BASE": &cfg.BaseLockout,
+		"LOGIN_LOCKOUT_MAX":  &cfg.MaxLockout,
+		"LOGIN_IP_WINDOW":    &cfg.IPWindow,
+	} {
+		if value := os.Getenv(env); value != "" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d <= 0 {
+				return fmt.Errorf("invalid %s %q", env, value)
+			}
+			*target = d
+		}
+	}
+
+	loginLockout = cfg
+	return nil
+}
+
+func GetLoginLockoutConfig() LoginLockoutConfig {
+	return loginLockout
+}
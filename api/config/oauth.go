@@ -0,0 +1,84 @@
+package config
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// OAuthConfig lists the identity providers users may sign in with and where
+// the browser may be sent once sign-in completes.
+type OAuthConfig struct {
+	// Providers are gotrue provider names, e.g. "github", "google", or
+	// "keycloak" for a generic OIDC issuer.
+	Providers map[string]bool
+	// CallbackURL is the public URL of /api/auth/oauth/callback. gotrue
+	// redirects there with the authorization code.
+	CallbackURL string
+	// RedirectURLs are the app URLs a completed sign-in may return to. An
+	// empty list means the callback answers with JSON instead.
+	RedirectURLs []string
+}
+
+var oauthConfig OAuthConfig
+
+var providerName = regexp.MustCompile(`^[a-z0-9_\-]+$`)
+
+// InitOAuth reads OAUTH_PROVIDERS, OAUTH_CALLBACK_URL and OAUTH_REDIRECT_URLS.
+// OAuth sign-in is disabled when OAUTH_PROVIDERS is empty.
+func InitOAuth() error {
+	cfg := OAuthConfig{Providers: map[string]bool{}}
+
+	for _, name := range strings.Split(os.Getenv("OAUTH_PROVIDERS"), ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if name == "" {
+			continue
+		}
+		if !providerName.MatchString(name) {
+			return fmt.Errorf("invalid OAUTH_PROVIDERS entry %q", name)
+		}
+		cfg.Providers[name] = true
+	}
+
+	if len(cfg.Providers) == 0 {
+		oauthConfig = cfg
+		return nil
+	}
+
+	cfg.CallbackURL = os.Getenv("OAUTH_CALLBACK_URL")
+	if u, err := url.Parse(cfg.CallbackURL); err != nil || !u.IsAbs() {
+		return fmt.Errorf("OAUTH_CALLBACK_URL must be an absolute URL when OAUTH_PROVIDERS is set")
+	}
+
+	for _, raw := range strings.Split(os.Getenv("OAUTH_REDIRECT_URLS"), ",") {
+		raw = strings.TrimSpace(raw)
+		if raw == "" {
+			continue
+		}
+		if u, err := url.Parse(raw); err != nil || !u.IsAbs() {
+			return fmt.Errorf("invalid OAUTH_REDIRECT_URLS entry %q", raw)
+		}
+		cfg.RedirectURLs = append(cfg.RedirectURLs, raw)
+	}
+
+	oauthConfig = cfg
+	return nil
+}
+
+func GetOAuthConfig() OAuthConfig {
+	return oauthConfig
+}
+
+// OAuthRedirectAllowed reports whether a completed sign-in may be sent to
+// target. Only exact matches count, so query strings can't smuggle tokens
+// to other pages.
+func OAuthRedirectAllowed(target string) bool {
+	for _, allowed := range oauthConfig.RedirectURLs {
+		if target == allowed {
+			return true
+		}
+	}
+	return false
+}
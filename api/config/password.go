@@ -0,0 +1,106 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+)
+
+const (
+	CharClassLower  = "lower"
+	CharClassUpper  = "upper"
+	CharClassDigit  = "digit"
+	CharClassSymbol = "symbol"
+)
+
+// PasswordPolicy is what a new password has to satisfy.
+type PasswordPolicy struct {
+	MinLength int `json:"min_length"`
+	// MaxLength is in bytes; gotrue hashes with bcrypt, which ignores
+	// anything past 72.
+	MaxLength       int      `json:"max_length"`
+	RequiredClasses []string `json:"required_classes"`
+	// MinClasses is how many distinct character classes must appear.
+	MinClasses     int  `json:"min_classes"`
+	ForbidEmail    bool `json:"forbid_email"`
+	MinStrength    int  `json:"min_strength"`
+	RejectBreached bool `json:"reject_breached"`
+}
+
+var passwordPolicy = PasswordPolicy{
+	MinLength:      8,
+	MaxLength:      72,
+	MinClasses:     1,
+	ForbidEmail:    true,
+	MinStrength:    2,
+	RejectBreached: true,
+}
+
+// InitPasswordPolicy reads PASSWORD_MIN_LENGTH, PASSWORD_REQUIRED_CLASSES
+// (comma-separated lower, upper, digit, symbol), PASSWORD_MIN_CLASSES,
+// PASSWORD_FORBID_EMAIL, PASSWORD_MIN_STRENGTH (0-4) and
+// PASSWORD_REJECT_BREACHED.
+func InitPasswordPolicy() error {
+	if err := intEnv("PASSWORD_MIN_LENGTH", &passwordPolicy.MinLength, 1, passwordPolicy.MaxLength); err != nil {
+		return err
+	}
+	if err := intEnv("PASSWORD_MIN_CLASSES", &passwordPolicy.MinClasses, 0, 4); err != nil {
+		return err
+	}
+	if err := intEnv("PASSWORD_MIN_STRENGTH", &passwordPolicy.MinStrength, 0, 4); err != nil {
+		return err
+	}
+	if err := boolEnv("PASSWORD_FORBID_EMAIL", &passwordPolicy.ForbidEmail); err != nil {
+		return err
+	}
+	if err := boolEnv("PASSWORD_REJECT_BREACHED", &passwordPolicy.RejectBreached); err != nil {
+		return err
+	}
+
+	if value := os.Getenv("PASSWORD_REQUIRED_CLASSES"); value != "" {
+		var classes []string
+		for _, class := range strings.Split(value, ",") {
+			class = strings.ToLower(strings.TrimSpace(class))
+			switch class {
+			case CharClassLower, CharClassUpper, CharClassDigit, CharClassSymbol:
+				classes = append(classes, class)
+			case "":
+			default:
+				return fmt.Errorf("unknown character class %q in PASSWORD_REQUIRED_CLASSES", class)
+			}
+		}
+		passwordPolicy.RequiredClasses = classes
+	}
+	return nil
+}
+
+func GetPasswordPolicy() PasswordPolicy {
+	return passwordPolicy
+}
+
+func intEnv(name string, target *int, min, max int) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n < min || n > max {
+		return fmt.Errorf("%s must be a number between %d and %d", name, min, max)
+	}
+	*target = n
+	return nil
+}
+
+func boolEnv(name string, target *bool) error {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	b, err := strconv.ParseBool(value)
+	if err != nil {
+		return fmt.Errorf("%s must be true or false", name)
+	}
+	*target = b
+	return nil
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+var trustedProxies []*net.IPNet
+
+// InitTrustedProxies loads TRUSTED_PROXIES, a comma separated list of IPs or
+// CIDR ranges of the load balancers in front of the API. Forwarded client
+// addresses are only believed when they were added by one of these.
+func InitTrustedProxies() error {
+	raw := os.Getenv("TRUSTED_PROXIES")
+	if raw == "" {
+		trustedProxies = nil
+		return nil
+	}
+
+	var proxies []*net.IPNet
+	for _, entry := range strings.Split(raw, ",") {
+		network, err := ParseCIDROrIP(strings.TrimSpace(entry))
+		if err != nil {
+			return fmt.Errorf("invalid trusted proxy %q: %w", entry, err)
+		}
+		proxies = append(proxies, network)
+	}
+
+	trustedProxies = proxies
+	return nil
+}
+
+// IsTrustedProxy reports whether ip belongs to a configured proxy.
+func IsTrustedProxy(ip net.IP) bool {
+	for _, network := range trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// ParseCIDROrIP parses "10.0.0.0/8" or a single address such as "10.0.0.1",
+// which is treated as a /32 (or /128 for IPv6).
+func ParseCIDROrIP(value string) (*net.IPNet, error) {
+	if strings.Contains(value, "/") {
+		_, network, err := net.ParseCIDR(value)
+		return network, err
+	}
+
+	ip := net.ParseIP(value)
+	if ip == nil {
+		return nil, fmt.Errorf("not an IP address or CIDR range")
+	}
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}, nil
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}, nil
+}
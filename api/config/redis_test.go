@@ -0,0 +1,72 @@
+package config
+
+import (
+	"context"
+	"errors"
+	"github.com/alicebob/miniredis/v2"
+	"testing"
+)
+
+func TestRedisClientAgainstStandIn(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+
+	client, err := NewRedisClient("redis://:secret@" + server.Addr() + "/2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := context.Background()
+
+	if reply, err := client.Do(ctx, "PING"); err != nil || reply != "PONG" {
+		t.Fatalf("PING = %v, %v", reply, err)
+	}
+	if _, err := client.Do(ctx, "SET", "key", "value"); err != nil {
+		t.Fatal(err)
+	}
+	server.Select(2)
+	if got, _ := server.Get("key"); got != "value" {
+		t.Fatalf("SET went to the wrong database, db 2 holds %q", got)
+	}
+
+	if reply, err := client.Do(ctx, "GET", "key"); err != nil || reply != "value" {
+		t.Fatalf("GET = %v, %v", reply, err)
+	}
+	if reply, err := client.Do(ctx, "GET", "missing"); err != nil || reply != nil {
+		t.Fatalf("GET missing = %v, %v", reply, err)
+	}
+	if reply, err := client.Do(ctx, "INCR", "counter"); err != nil || reply != int64(1) {
+		t.Fatalf("INCR = %v, %v", reply, err)
+	}
+
+	reply, err := client.Do(ctx, "EVAL", "return {1, 'two', redis.call('GET', KEYS[1])}", "1", "key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	items, ok := reply.([]interface{})
+	if !ok || len(items) != 3 || items[0] != int64(1) || items[1] != "two" || items[2] != "value" {
+		t.Fatalf("EVAL = %#v", reply)
+	}
+
+	_, err = client.Do(ctx, "INCR", "key")
+	var redisErr RedisError
+	if !errors.As(err, &redisErr) {
+		t.Fatalf("INCR on a string: got %v, want a RedisError", err)
+	}
+	// An error reply leaves the connection usable.
+	if reply, err := client.Do(ctx, "PING"); err != nil || reply != "PONG" {
+		t.Fatalf("PING after error = %v, %v", reply, err)
+	}
+}
+
+func TestRedisClientRejectsWrongPassword(t *testing.T) {
+	server := miniredis.RunT(t)
+	server.RequireAuth("secret")
+
+	client, err := NewRedisClient("redis://:wrong@" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Do(context.Background(), "PING"); err == nil {
+		t.Fatal("PING with a wrong password succeeded")
+	}
+}
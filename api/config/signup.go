@@ -0,0 +1,67 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"time"
+)
+
+const (
+	SignupModeOpen   = "open"
+	SignupModeInvite = "invite"
+	SignupModeClosed = "closed"
+)
+
+// SignupConfig decides who may create an account.
+type SignupConfig struct {
+	Mode string
+	// AllowedDomains, when set, limits signups to these email domains and
+	// their subdomains. BlockedDomains always wins.
+	AllowedDomains []string
+	BlockedDomains []string
+	// InviteTTL is how long an invite is valid unless the admin says
+	// otherwise.
+	InviteTTL time.Duration
+}
+
+var signupConfig = SignupConfig{Mode: SignupModeOpen, InviteTTL: 7 * 24 * time.Hour}
+
+// InitSignup reads SIGNUP_MODE (open, invite or closed),
+// SIGNUP_ALLOWED_DOMAINS, SIGNUP_BLOCKED_DOMAINS and INVITE_TTL.
+func InitSignup() error {
+	switch mode := os.Getenv("SIGNUP_MODE"); mode {
+	case "":
+	case SignupModeOpen, SignupModeInvite, SignupModeClosed:
+		signupConfig.Mode = mode
+	default:
+		return fmt.Errorf("unknown SIGNUP_MODE %q", mode)
+	}
+
+	signupConfig.AllowedDomains = domainList(os.Getenv("SIGNUP_ALLOWED_DOMAINS"))
+	signupConfig.BlockedDomains = domainList(os.Getenv("SIGNUP_BLOCKED_DOMAINS"))
+
+	if value := os.Getenv("INVITE_TTL"); value != "" {
+		ttl, err := time.ParseDuration(value)
+		if err != nil || ttl <= 0 {
+			return fmt.Errorf("invalid INVITE_TTL %q", value)
+		}
+		signupConfig.InviteTTL = ttl
+	}
+	return nil
+}
+
+func GetSignupConfig() SignupConfig {
+	return signupConfig
+}
+
+func domainList(value string) []string {
+	var domains []string
+	for _, domain := range strings.Split(value, ",") {
+		domain = strings.ToLower(strings.TrimPrefix(strings.TrimSpace(domain), "@"))
+		if domain != "" {
+			domains = append(domains, domain)
+		}
+	}
+	return domains
+}
@@ -66,9 +66,37 @@ func InitPostgres() error {
 	}
 
 	dbClient = client
+
+	// Calls that must not be open to the anon role, such as ending gotrue
+	// sessions or spending rate-limit tokens, go through a client holding
+	// the service role key.
+	serviceKey := GetServiceRoleKey()
+	if serviceKey == "" {
+		return fmt.Errorf("SUPABASE_SERVICE_ROLE_KEY is not set")
+	}
+	adminDBClient = postgrest.NewClient(fmt.Sprintf("%s/rest/v1", supabaseUrl), "public", map[string]string{
+		"apikey":        serviceKey,
+		"Authorization": fmt.Sprintf("Bearer %s", serviceKey),
+		"Content-Type":  "application/json",
+		"Prefer":        "return=minimal",
+	})
 	return nil
 }
 
 func GetDBClient() *postgrest.Client {
 	return dbClient
 }
+
+var adminDBClient *postgrest.Client
+
+// GetAdminDBClient returns a client acting as the service role. It is nil
+// until InitPostgres has run.
+func GetAdminDBClient() *postgrest.Client {
+	return adminDBClient
+}
+
+// GetServiceRoleKey returns the key for gotrue admin calls, such as removing
+// a user's MFA factors after they use a recovery code.
+func GetServiceRoleKey() string {
+	return os.Getenv("SUPABASE_SERVICE_ROLE_KEY")
+}
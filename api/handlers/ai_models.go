@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"api/config"
+	"api/middleware"
 	"api/models"
 	"api/utils"
 	"encoding/json"
@@ -21,15 +22,37 @@ func NewModelHandler() *ModelHandler {
 	}
 }
 
+// modelRecord is an ai_models row. A model with an OrganizationID is
+// private to that organization; the rest are public.
+type modelRecord struct {
+	models.AIModel
+	OrganizationID *uuid.UUID `json:"organization_id"`
+}
+
 func (h *ModelHandler) CreateModel(c *fiber.Ctx) error {
-	var model models.AIModel
-	if err := c.BodyParser(&model); err != nil {
+	var record modelRecord
+	if err := c.BodyParser(&record); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Invalid request body",
 		})
 	}
+	model := &record.AIModel
+
+	if record.OrganizationID != nil {
+		org, err := fetchOrganization(*record.OrganizationID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": models.ErrInternalServer.Error(),
+			})
+		}
+		if org == nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Organization not found",
+			})
+		}
+	}
 
-	if err := utils.ValidateModelMetadata(&model); err != nil {
+	if err := utils.ValidateModelMetadata(model); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "Metadata are not valid",
 		})
@@ -47,7 +70,7 @@ func (h *ModelHandler) CreateModel(c *fiber.Ctx) error {
 	model.FunctionURL = utils.GenerateEdgeFunctionURL(model.ModelType, model.HuggingfaceID)
 
 	_, _, err := h.dbClient.From("ai_models").
-		Insert(model, false, "", "representation", "exact").
+		Insert(record, false, "", "representation", "exact").
 		Execute()
 
 	if err != nil {
@@ -56,7 +79,14 @@ func (h *ModelHandler) CreateModel(c *fiber.Ctx) error {
 		})
 	}
 
-	return c.Status(fiber.StatusCreated).JSON(model)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditModelCreate,
+		TargetType: "model",
+		TargetID:   model.ID.String(),
+		After:      record,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(record)
 }
 
 func (h *ModelHandler) GetModel(c *fiber.Ctx) error {
@@ -94,8 +124,25 @@ func (h *ModelHandler) ListModels(c *fiber.Ctx) error {
 	limit := c.QueryInt("limit", 10)
 	offset := (page - 1) * limit
 
-	result, count, err := h.dbClient.From("ai_models").
-		Select("*", "exact", false).
+	query := h.dbClient.From("ai_models").
+		Select("*", "exact", false)
+
+	// organization_id=public lists public models only
+	switch org := c.Query("organization_id"); org {
+	case "":
+	case "public":
+		query = query.Is("organization_id", "null")
+	default:
+		id, err := uuid.Parse(org)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "Invalid organization ID",
+			})
+		}
+		query = query.Eq("organization_id", id.String())
+	}
+
+	result, count, err := query.
 		Range(offset, offset+limit-1, "").
 		Execute()
 
@@ -105,7 +152,7 @@ func (h *ModelHandler) ListModels(c *fiber.Ctx) error {
 		})
 	}
 
-	var resModels []models.AIModel
+	var resModels []modelRecord
 	if err := json.Unmarshal(result, &resModels); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to parse response",
@@ -142,7 +189,7 @@ func (h *ModelHandler) UpdateModel(c *fiber.Ctx) error {
 		})
 	}
 
-	_, count, err := h.dbClient.From("ai_models").
+	existing, count, err := h.dbClient.From("ai_models").
 		Select("*", "exact", false).
 		Eq("id", id.String()).
 		Execute()
@@ -153,6 +200,13 @@ func (h *ModelHandler) UpdateModel(c *fiber.Ctx) error {
 		})
 	}
 
+	var before []models.AIModel
+	if err := json.Unmarshal(existing, &before); err != nil || len(before) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "Failed to parse response",
+		})
+	}
+
 	updateData.FunctionURL = utils.GenerateEdgeFunctionURL(updateData.ModelType, updateData.HuggingfaceID)
 
 	_, _, err = h.dbClient.From("ai_models").
@@ -166,6 +220,14 @@ func (h *ModelHandler) UpdateModel(c *fiber.Ctx) error {
 		})
 	}
 
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditModelUpdate,
+		TargetType: "model",
+		TargetID:   id.String(),
+		Before:     before[0],
+		After:      updateData,
+	})
+
 	return c.SendStatus(fiber.StatusOK)
 }
 
@@ -190,5 +252,12 @@ func (h *ModelHandler) DeleteModel(c *fiber.Ctx) error {
 		})
 	}
 
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditModelDelete,
+		TargetType: "model",
+		TargetID:   id.String(),
+		After:      updateData,
+	})
+
 	return c.SendStatus(fiber.StatusOK)
 }
@@ -2,12 +2,16 @@ package handlers
 
 import (
 	"api/config"
+	"api/middleware"
 	"api/models"
 	"api/utils"
 	"encoding/json"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/supabase-community/postgrest-go"
+	"strconv"
+	"strings"
 	"time"
 )
 
@@ -25,8 +29,11 @@ func (h *APIKeyHandler) CreateKey(c *fiber.Ctx) error {
 	user := c.Locals("user").(*models.User)
 
 	var input struct {
-		Name      string `json:"name"`
-		RateLimit int    `json:"rate_limit"`
+		Name             string   `json:"name"`
+		RateLimit        int      `json:"rate_limit"`
+		AllowedCIDRs     []string `json:"allowed_cidrs"`
+		AllowedReferrers []string `json:"allowed_referrers"`
+		Scopes           []string `json:"scopes"`
 	}
 
 	if err := c.BodyParser(&input); err != nil {
@@ -35,23 +42,57 @@ func (h *APIKeyHandler) CreateKey(c *fiber.Ctx) error {
 		})
 	}
 
-	apiKey, err := utils.GenerateAPIKey()
+	allowedCIDRs, err := utils.NormalizeCIDRs(input.AllowedCIDRs)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	allowedReferrers, err := utils.NormalizeOriginPatterns(input.AllowedReferrers)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	scopes, err := utils.NormalizeScopes(input.Scopes)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	apiKey, err := utils.GenerateAPIKey(config.APIKeyEnvironment())
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "failed to generate new api key",
 		})
 	}
 
-	keyHash := utils.HashAPIKey(apiKey)
+	keyHash, hashVersion := utils.HashAPIKey(apiKey)
+
+	var organizationID *uuid.UUID
+	if member, ok := middleware.Organization(c); ok {
+		organizationID = &member.OrganizationID
+	}
 
 	newKey := models.APIKey{
-		ID:        uuid.New(),
-		UserID:    user.ID,
-		KeyHash:   keyHash,
-		Name:      input.Name,
-		CreatedAt: time.Now(),
-		IsActive:  true,
-		RateLimit: input.RateLimit,
+		ID:             uuid.New(),
+		UserID:         &user.ID,
+		OrganizationID: organizationID,
+		KeyHash:        keyHash,
+		HashVersion:    hashVersion,
+		KeyPrefix:      utils.KeyDisplayPrefix(apiKey),
+		Environment:    config.APIKeyEnvironment(),
+		Name:           input.Name,
+		CreatedAt:      time.Now(),
+		IsActive:       true,
+		RateLimit:      input.RateLimit,
+
+		AllowedCIDRs:     allowedCIDRs,
+		AllowedReferrers: allowedReferrers,
+		Scopes:           scopes,
 	}
 
 	_, _, err = h.dbClient.From("api_keys").
@@ -64,19 +105,28 @@ func (h *APIKeyHandler) CreateKey(c *fiber.Ctx) error {
 		})
 	}
 
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditKeyCreate,
+		TargetType: "api_key",
+		TargetID:   newKey.ID.String(),
+		After:      newKey,
+	})
+
 	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
-		"key": apiKey,
-		"id":  newKey.ID,
+		"key":        apiKey,
+		"id":         newKey.ID,
+		"key_prefix": newKey.KeyPrefix,
 	})
 }
 
+// ListKeys lists the caller's personal keys, or with an active organization
+// their keys in it; organization admins see every key in the organization.
 func (h *APIKeyHandler) ListKeys(c *fiber.Ctx) error {
-	user := c.Locals("users").(*models.User)
+	query := h.dbClient.From("api_keys").
+		Select("id, user_id, organization_id, name, key_prefix, environment, created_at, last_used, is_active, rate_limit, "+
+			"allowed_cidrs, allowed_referrers, scopes, expires_at", "exact", false)
 
-	res, count, err := h.dbClient.From("api_keys").
-		Select("id, name, created_at, last_used, is_active, rate_limit", "exact", false).
-		Eq("user_id", user.ID.String()).
-		Execute()
+	res, count, err := manageableKeys(c, query).Execute()
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
@@ -108,10 +158,9 @@ func (h *APIKeyHandler) DeactivateKey(c *fiber.Ctx) error {
 		})
 	}
 
-	_, count, err := h.dbClient.From("api_keys").
+	_, count, err := manageableKeys(c, h.dbClient.From("api_keys").
 		Select("id", "exact", false).
-		Eq("id", id.String()).
-		Eq("user_id", user.ID.String()).
+		Eq("id", id.String())).
 		Execute()
 
 	if err != nil || count == 0 {
@@ -126,12 +175,8 @@ func (h *APIKeyHandler) DeactivateKey(c *fiber.Ctx) error {
 		})
 	}
 
-	updateData := map[string]interface{}{
-		"is_active": false,
-	}
-
 	_, _, err = h.dbClient.From("api_keys").
-		Update(updateData, "representation", "exact").
+		Update(revocation(&user.ID, "revoked by owner"), "representation", "exact").
 		Eq("id", id.String()).
 		Execute()
 
@@ -141,11 +186,17 @@ func (h *APIKeyHandler) DeactivateKey(c *fiber.Ctx) error {
 		})
 	}
 
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditKeyRevoke,
+		TargetType: "api_key",
+		TargetID:   id.String(),
+		After:      map[string]interface{}{"is_active": false},
+	})
+
 	return c.SendStatus(fiber.StatusOK)
 }
 
 func (h *APIKeyHandler) UpdateKey(c *fiber.Ctx) error {
-	user := c.Locals("user").(*models.User)
 	keyID := c.Params("id")
 
 	id, err := uuid.Parse(keyID)
@@ -155,9 +206,13 @@ func (h *APIKeyHandler) UpdateKey(c *fiber.Ctx) error {
 		})
 	}
 
+	// Restrictions are only changed when present; send [] to clear them
 	var input struct {
-		Name      string `json:"name"`
-		RateLimit int    `json:"rate_limit"`
+		Name             string    `json:"name"`
+		RateLimit        int       `json:"rate_limit"`
+		AllowedCIDRs     *[]string `json:"allowed_cidrs"`
+		AllowedReferrers *[]string `json:"allowed_referrers"`
+		Scopes           *[]string `json:"scopes"`
 	}
 
 	if err := c.BodyParser(&input); err != nil {
@@ -166,10 +221,44 @@ func (h *APIKeyHandler) UpdateKey(c *fiber.Ctx) error {
 		})
 	}
 
-	_, count, err := h.dbClient.From("api_keys").
-		Select("id", "exact", false).
-		Eq("id", id.String()).
-		Eq("user_id", user.ID.String()).
+	updateData := map[string]interface{}{
+		"name":       input.Name,
+		"rate_limit": input.RateLimit,
+	}
+
+	if input.AllowedCIDRs != nil {
+		allowedCIDRs, err := utils.NormalizeCIDRs(*input.AllowedCIDRs)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		updateData["allowed_cidrs"] = allowedCIDRs
+	}
+
+	if input.AllowedReferrers != nil {
+		allowedReferrers, err := utils.NormalizeOriginPatterns(*input.AllowedReferrers)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		updateData["allowed_referrers"] = allowedReferrers
+	}
+
+	if input.Scopes != nil {
+		scopes, err := utils.NormalizeScopes(*input.Scopes)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		updateData["scopes"] = scopes
+	}
+
+	existing, count, err := manageableKeys(c, h.dbClient.From("api_keys").
+		Select("name, rate_limit, allowed_cidrs, allowed_referrers, scopes", "exact", false).
+		Eq("id", id.String())).
 		Execute()
 
 	if err != nil || count == 0 {
@@ -177,9 +266,12 @@ func (h *APIKeyHandler) UpdateKey(c *fiber.Ctx) error {
 			"error": "API key not found",
 		})
 	}
-	updateData := map[string]interface{}{
-		"name":       input.Name,
-		"rate_limit": input.RateLimit,
+
+	var before []map[string]interface{}
+	if err := json.Unmarshal(existing, &before); err != nil || len(before) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
 	}
 
 	_, _, err = h.dbClient.From("api_keys").
@@ -193,5 +285,276 @@ func (h *APIKeyHandler) UpdateKey(c *fiber.Ctx) error {
 		})
 	}
 
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditKeyUpdate,
+		TargetType: "api_key",
+		TargetID:   id.String(),
+		Before:     before[0],
+		After:      updateData,
+	})
+
+	return c.SendStatus(fiber.StatusOK)
+}
+
+// manageableKeys limits query to the keys the caller can see and change:
+// their personal keys, or with an active organization their keys in it, or
+// all of its keys for organization admins.
+func manageableKeys(c *fiber.Ctx, query *postgrest.FilterBuilder) *postgrest.FilterBuilder {
+	user := c.Locals("user").(*models.User)
+
+	member, ok := middleware.Organization(c)
+	if !ok {
+		return query.Eq("user_id", user.ID.String()).Is("organization_id", "null")
+	}
+
+	query = query.Eq("organization_id", member.OrganizationID.String())
+	if !member.CanManage() {
+		query = query.Eq("user_id", user.ID.String())
+	}
+	return query
+}
+
+// revocation is the update recorded whenever a key is deactivated, so the
+// api_keys row itself keeps the trail of who revoked it, when and why.
+// actorID is nil when the key was revoked automatically.
+func revocation(actorID *uuid.UUID, reason string) map[string]interface{} {
+	return map[string]interface{}{
+		"is_active":         false,
+		"revoked_at":        time.Now(),
+		"revoked_by":        actorID,
+		"revocation_reason": reason,
+	}
+}
+
+const adminKeyColumns = "id, user_id, service_account_id, name, key_prefix, environment, created_at, last_used, is_active, " +
+	"rate_limit, allowed_cidrs, allowed_referrers, scopes, expires_at, revoked_at, revoked_by, revocation_reason"
+
+// AdminListKeys lists keys across all users and service accounts. Filters:
+// user_id, service_account_id, active, name (substring), last_used_before
+// and last_used_after (RFC 3339).
+func (h *APIKeyHandler) AdminListKeys(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 10)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
+	offset := (page - 1) * limit
+
+	query := h.dbClient.From("api_keys").
+		Select(adminKeyColumns, "exact", false)
+
+	if userID := c.Query("user_id"); userID != "" {
+		id, err := uuid.Parse(userID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid user ID",
+			})
+		}
+		query = query.Eq("user_id", id.String())
+	}
+
+	if accountID := c.Query("service_account_id"); accountID != "" {
+		id, err := uuid.Parse(accountID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid service account ID",
+			})
+		}
+		query = query.Eq("service_account_id", id.String())
+	}
+
+	if active := c.Query("active"); active != "" {
+		isActive, err := strconv.ParseBool(active)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "active must be true or false",
+			})
+		}
+		query = query.Eq("is_active", strconv.FormatBool(isActive))
+	}
+
+	if name := c.Query("name"); name != "" {
+		query = query.Ilike("name", "*"+name+"*")
+	}
+
+	lastUsedBefore, err := timeQuery(c, "last_used_before")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	lastUsedAfter, err := timeQuery(c, "last_used_after")
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	query = timeRange(query, "last_used", "gt", lastUsedAfter, lastUsedBefore)
+
+	res, count, err := query.
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).
+		Range(offset, offset+limit-1, "").
+		Execute()
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch API keys",
+		})
+	}
+
+	var keys []models.APIKey
+	if err := json.Unmarshal(res, &keys); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"keys":  keys,
+		"total": count,
+		"page":  page,
+		"limit": limit,
+	})
+}
+
+// AdminRevokeKey deactivates any user's key. An optional {"reason": "..."}
+// body is stored with the revocation.
+func (h *APIKeyHandler) AdminRevokeKey(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*models.User)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid key ID",
+		})
+	}
+
+	reason := revocationReason(c, "revoked by admin")
+
+	// An earlier revocation's time, admin and reason stand
+	res, _, err := h.dbClient.From("api_keys").
+		Update(revocation(&admin.ID, reason), "representation", "exact").
+		Eq("id", id.String()).
+		Is("revoked_at", "null").
+		Execute()
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke API key",
+		})
+	}
+
+	var revoked []models.APIKey
+	if err := json.Unmarshal(res, &revoked); err != nil || len(revoked) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "no unrevoked API key with this ID",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditKeyRevoke,
+		TargetType: "api_key",
+		TargetID:   id.String(),
+		After:      map[string]interface{}{"is_active": false, "revocation_reason": reason},
+	})
+
 	return c.SendStatus(fiber.StatusOK)
 }
+
+// AdminRevokeUserKeys deactivates every active key a user owns in one call.
+func (h *APIKeyHandler) AdminRevokeUserKeys(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*models.User)
+
+	userID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
+		})
+	}
+
+	reason := revocationReason(c, "all keys revoked by admin")
+
+	res, _, err := h.dbClient.From("api_keys").
+		Update(revocation(&admin.ID, reason), "representation", "exact").
+		Eq("user_id", userID.String()).
+		Eq("is_active", "true").
+		Execute()
+
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke API keys",
+		})
+	}
+
+	var revoked []models.APIKey
+	if err := json.Unmarshal(res, &revoked); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	ids := make([]uuid.UUID, len(revoked))
+	for i, key := range revoked {
+		ids[i] = key.ID
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditKeyRevokeAll,
+		TargetType: "user",
+		TargetID:   userID.String(),
+		After:      map[string]interface{}{"key_ids": ids, "revocation_reason": reason},
+	})
+
+	return c.JSON(fiber.Map{
+		"revoked": len(revoked),
+		"key_ids": ids,
+	})
+}
+
+func revocationReason(c *fiber.Ctx, fallback string) string {
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err == nil && input.Reason != "" {
+			return input.Reason
+		}
+	}
+	return fallback
+}
+
+// timeQuery reads an optional RFC 3339 query parameter and returns it in the
+// UTC form used in PostgREST filters.
+func timeQuery(c *fiber.Ctx, param string) (string, error) {
+	value := c.Query(param)
+	if value == "" {
+		return "", nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return "", fmt.Errorf("%s must be an RFC 3339 timestamp", param)
+	}
+	return t.UTC().Format(time.RFC3339), nil
+}
+
+// timeRange filters column to after..before, either of which may be empty.
+// PostgREST-go keys filters by column, so two bounds on one column have to
+// go through a single and=(...) filter.
+func timeRange(query *postgrest.FilterBuilder, column, afterOp, after, before string) *postgrest.FilterBuilder {
+	var bounds []string
+	if after != "" {
+		bounds = append(bounds, fmt.Sprintf(`%s.%s."%s"`, column, afterOp, after))
+	}
+	if before != "" {
+		bounds = append(bounds, fmt.Sprintf(`%s.lt."%s"`, column, before))
+	}
+	if len(bounds) == 0 {
+		return query
+	}
+	return query.And(strings.Join(bounds, ","), "")
+}
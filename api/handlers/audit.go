@@ -0,0 +1,225 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
+	"log"
+	"strconv"
+	"time"
+)
+
+const (
+	defaultAuditLimit = 50
+	maxAuditLimit     = 200
+	auditExportBatch  = 1000
+)
+
+type AuditHandler struct {
+	dbClient *postgrest.Client
+}
+
+func NewAuditHandler() *AuditHandler {
+	return &AuditHandler{
+		dbClient: config.GetDBClient(),
+	}
+}
+
+// auditFilter holds the query filters shared by the list and export
+// endpoints: actor_id, actor_type, action, target_type, target_id, since
+// and until.
+type auditFilter struct {
+	actorID    string
+	actorType  string
+	action     string
+	targetType string
+	targetID   string
+	since      string
+	until      string
+}
+
+func parseAuditFilter(c *fiber.Ctx) (auditFilter, error) {
+	filter := auditFilter{
+		actorID:    c.Query("actor_id"),
+		actorType:  c.Query("actor_type"),
+		action:     c.Query("action"),
+		targetType: c.Query("target_type"),
+		targetID:   c.Query("target_id"),
+	}
+
+	if filter.actorID != "" {
+		if _, err := uuid.Parse(filter.actorID); err != nil {
+			return filter, fmt.Errorf("actor_id must be a UUID")
+		}
+	}
+
+	var err error
+	if filter.since, err = timeQuery(c, "since"); err != nil {
+		return filter, err
+	}
+	if filter.until, err = timeQuery(c, "until"); err != nil {
+		return filter, err
+	}
+	return filter, nil
+}
+
+func (f auditFilter) apply(query *postgrest.FilterBuilder) *postgrest.FilterBuilder {
+	if f.actorID != "" {
+		query = query.Eq("actor_id", f.actorID)
+	}
+	if f.actorType != "" {
+		query = query.Eq("actor_type", f.actorType)
+	}
+	if f.action != "" {
+		query = query.Eq("action", f.action)
+	}
+	if f.targetType != "" {
+		query = query.Eq("target_type", f.targetType)
+	}
+	if f.targetID != "" {
+		query = query.Eq("target_id", f.targetID)
+	}
+	return timeRange(query, "created_at", "gte", f.since, f.until)
+}
+
+// ListEvents returns events newest first. Pass next_cursor from a response
+// as cursor to get the following page.
+func (h *AuditHandler) ListEvents(c *fiber.Ctx) error {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	limit := c.QueryInt("limit", defaultAuditLimit)
+	if limit < 1 || limit > maxAuditLimit {
+		limit = defaultAuditLimit
+	}
+
+	query := filter.apply(h.dbClient.From("audit_events").Select("*", "", false))
+
+	if cursor := c.Query("cursor"); cursor != "" {
+		if _, err := strconv.ParseInt(cursor, 10, 64); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid cursor",
+			})
+		}
+		query = query.Lt("id", cursor)
+	}
+
+	res, _, err := query.
+		Order("id", &postgrest.OrderOpts{Ascending: false}).
+		Limit(limit, "").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch audit events",
+		})
+	}
+
+	var events []models.AuditEvent
+	if err := json.Unmarshal(res, &events); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	var nextCursor *string
+	if len(events) == limit {
+		cursor := strconv.FormatInt(events[len(events)-1].ID, 10)
+		nextCursor = &cursor
+	}
+
+	return c.JSON(fiber.Map{
+		"events":      events,
+		"next_cursor": nextCursor,
+	})
+}
+
+// ExportEvents streams every matching event as JSON lines, oldest first, so
+// the export can be checked against the hash chain.
+func (h *AuditHandler) ExportEvents(c *fiber.Ctx) error {
+	filter, err := parseAuditFilter(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action: models.AuditAuditExport,
+		After:  c.Queries(),
+	})
+
+	c.Set(fiber.HeaderContentType, "application/x-ndjson")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="audit-%s.jsonl"`, time.Now().UTC().Format("20060102T150405Z")))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		encoder := json.NewEncoder(w)
+		var after int64
+
+		for {
+			res, _, err := filter.apply(h.dbClient.From("audit_events").Select("*", "", false)).
+				Gt("id", strconv.FormatInt(after, 10)).
+				Order("id", &postgrest.OrderOpts{Ascending: true}).
+				Limit(auditExportBatch, "").
+				Execute()
+			if err != nil {
+				log.Printf("audit export failed after event %d: %v", after, err)
+				return
+			}
+
+			var events []models.AuditEvent
+			if err := json.Unmarshal(res, &events); err != nil {
+				log.Printf("audit export failed after event %d: %v", after, err)
+				return
+			}
+
+			for _, event := range events {
+				if err := encoder.Encode(event); err != nil {
+					return
+				}
+			}
+			if err := w.Flush(); err != nil {
+				return
+			}
+
+			if len(events) < auditExportBatch {
+				return
+			}
+			after = events[len(events)-1].ID
+		}
+	})
+
+	return nil
+}
+
+// VerifyChain recomputes every event hash and reports the first event that
+// doesn't match, if any.
+func (h *AuditHandler) VerifyChain(c *fiber.Ctx) error {
+	result := h.dbClient.Rpc("verify_audit_chain", "", map[string]interface{}{})
+
+	var rows []struct {
+		Checked        int64  `json:"checked"`
+		FirstInvalidID *int64 `json:"first_invalid_id"`
+	}
+	if err := json.Unmarshal([]byte(result), &rows); err != nil || len(rows) == 0 {
+		log.Printf("verify_audit_chain failed: %s", result)
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to verify audit log",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"valid":            rows[0].FirstInvalidID == nil,
+		"checked":          rows[0].Checked,
+		"first_invalid_id": rows[0].FirstInvalidID,
+	})
+}
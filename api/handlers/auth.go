@@ -2,12 +2,16 @@ package handlers
 
 import (
 	"api/config"
+	"api/middleware"
 	"api/models"
-	"fmt"
+	"api/utils"
+	"errors"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
 	"github.com/supabase-community/gotrue-go/types"
 	"github.com/supabase-community/supabase-go"
+	"log"
+	"strings"
 )
 
 type AuthHandler struct {
@@ -19,18 +23,45 @@ func NewAuthHandler(supabaseClient *supabase.Client) *AuthHandler {
 		supabaseClient: supabaseClient,
 	}
 }
-func (h *AuthHandler) SignUp(c *fiber.Ctx) error {
 
-	var input types.SignupRequest
+// SignUp creates an account, subject to the signup mode, the pre-signup
+// hooks and, in invite mode, a valid invite.
+func (h *AuthHandler) SignUp(c *fiber.Ctx) error {
+	var input struct {
+		Email        string                 `json:"email"`
+		Password     string                 `json:"password"`
+		Data         map[string]interface{} `json:"data"`
+		InviteToken  string                 `json:"invite_token"`
+		CaptchaToken string                 `json:"captcha_token"`
+	}
 
 	if err := c.BodyParser(&input); err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": models.ErrInvalidRequestStatus.Error,
+			"error": "invalid request body",
 		})
 	}
+	email := strings.ToLower(strings.TrimSpace(input.Email))
+
+	invite, err := admitSignup(SignupAttempt{
+		Email:        email,
+		IP:           middleware.ClientIP(c),
+		UserAgent:    c.Get(fiber.HeaderUserAgent),
+		Provider:     "email",
+		CaptchaToken: input.CaptchaToken,
+	}, input.InviteToken)
+	if err != nil {
+		return signupRejected(c, err)
+	}
 
-	authResp, err := h.supabaseClient.Auth.Signup(input)
+	authResp, err := h.supabaseClient.Auth.Signup(types.SignupRequest{
+		Email:    email,
+		Password: input.Password,
+		Data:     input.Data,
+	})
 	if err != nil {
+		if invite != nil {
+			releaseInvite(invite.ID)
+		}
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 			"error": "signup failed",
 		})
@@ -42,18 +73,17 @@ func (h *AuthHandler) SignUp(c *fiber.Ctx) error {
 		IsActive: true,
 	}
 
-	dbClient := config.GetDBClient()
-	_, _, err = dbClient.From("users").
-		Insert(user, false, "", "representation", "exact").
-		Execute()
-
-	fmt.Printf("Insert attempt result: %v\n", err)
+	// The auth webhook may have created the row already. If this fails the
+	// auth user exists regardless, so the signup still succeeds and the
+	// webhook or reconcile-users fills the row in.
+	if err := ensureUserRow(user.ID, user.Email, true); err != nil {
+		log.Printf("failed to create users row for %s: %v", user.ID, err)
+	}
 
-	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "registration failed",
-		})
+	if invite != nil {
+		recordInviteUse(invite.ID, user.ID)
 	}
+
 	return c.JSON(fiber.Map{
 		"message": "Signup successful. Please check your email for verification.",
 		"user": models.UserResponse{
@@ -64,3 +94,317 @@ func (h *AuthHandler) SignUp(c *fiber.Ctx) error {
 		},
 	})
 }
+
+// PasswordPolicy describes the rules new passwords must follow, so clients
+// can check them as the user types.
+func (h *AuthHandler) PasswordPolicy(c *fiber.Ctx) error {
+	return c.JSON(config.GetPasswordPolicy())
+}
+
+// signupRejected answers a failed admitSignup: 403 with the reason when the
+// attempt was turned away, 503 when a check couldn't run.
+func signupRejected(c *fiber.Ctx, err error) error {
+	var rejected *SignupRejectedError
+	if errors.As(err, &rejected) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": rejected.Reason,
+		})
+	}
+	return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+		"error": "signup is temporarily unavailable",
+	})
+}
+
+// Logout ends the session the request was made with. The access token is
+// blacklisted until it expires and the session's refresh tokens are revoked.
+func (h *AuthHandler) Logout(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	claims := c.Locals("claims").(*utils.Claims)
+
+	if err := middleware.RevokeToken(token, claims.Expiry()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "logout failed",
+		})
+	}
+
+	if claims.SessionID != "" {
+		if err := revokeSessionRefreshTokens(claims.SessionID); err != nil {
+			log.Printf("failed to revoke refresh tokens for session %s: %v", claims.SessionID, err)
+		}
+		if userID, err := uuid.Parse(claims.Subject); err == nil {
+			if err := markSessionsRevoked(userID, claims.SessionID); err != nil {
+				log.Printf("failed to mark session %s revoked: %v", claims.SessionID, err)
+			}
+		}
+	}
+
+	if err := utils.GotrueLogout(token, "local"); err != nil {
+		log.Printf("gotrue logout failed for user %s: %v", claims.Subject, err)
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// LogoutAll ends every session of the current user on every device.
+func (h *AuthHandler) LogoutAll(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	user := c.Locals("user").(*models.User)
+
+	if err := middleware.RevokeUserTokens(user.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "logout failed",
+		})
+	}
+
+	if err := revokeUserRefreshTokens(user.ID); err != nil {
+		log.Printf("failed to revoke refresh tokens for user %s: %v", user.ID, err)
+	}
+
+	if err := markSessionsRevoked(user.ID, ""); err != nil {
+		log.Printf("failed to mark sessions revoked for user %s: %v", user.ID, err)
+	}
+
+	if err := utils.GotrueLogout(token, "global"); err != nil {
+		log.Printf("gotrue logout failed for user %s: %v", user.ID, err)
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditLogoutAll,
+		TargetType: "user",
+		TargetID:   user.ID.String(),
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// emailSentMessage is returned by every endpoint that mails the user, whether
+// or not the address belongs to an account, so they can't be used to find out
+// who is registered.
+const emailSentMessage = "If an account exists for this email, a message has been sent."
+
+var verificationTypes = map[string]types.VerificationType{
+	"signup":       types.VerificationTypeSignup,
+	"recovery":     types.VerificationTypeRecovery,
+	"magiclink":    types.VerificationTypeMagiclink,
+	"invite":       types.VerificationTypeInvite,
+	"email_change": types.VerificationTypeEmailChange,
+	"email":        "email",
+}
+
+type emailRequest struct {
+	Email string `json:"email"`
+}
+
+func parseEmailRequest(c *fiber.Ctx) (string, error) {
+	var input emailRequest
+	if err := c.BodyParser(&input); err != nil {
+		return "", err
+	}
+	return strings.ToLower(strings.TrimSpace(input.Email)), nil
+}
+
+func emailSent(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": emailSentMessage,
+	})
+}
+
+// Recover sends a password-reset email.
+func (h *AuthHandler) Recover(c *fiber.Ctx) error {
+	email, err := parseEmailRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.supabaseClient.Auth.Recover(types.RecoverRequest{Email: email}); err != nil {
+		log.Printf("gotrue recover failed: %v", err)
+	}
+
+	return emailSent(c)
+}
+
+// MagicLink sends a one-click sign-in link.
+func (h *AuthHandler) MagicLink(c *fiber.Ctx) error {
+	email, err := parseEmailRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	// gotrue's magiclink endpoint signs up unknown addresses, which would
+	// bypass the signup policy. /otp without CreateUser sends the same link
+	// to existing accounts only.
+	if err := h.supabaseClient.Auth.OTP(types.OTPRequest{Email: email, CreateUser: false}); err != nil {
+		log.Printf("gotrue magic link failed: %v", err)
+	}
+
+	return emailSent(c)
+}
+
+// OTP sends a one-time sign-in code. It never creates accounts; new users
+// go through SignUp.
+func (h *AuthHandler) OTP(c *fiber.Ctx) error {
+	email, err := parseEmailRequest(c)
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if err := h.supabaseClient.Auth.OTP(types.OTPRequest{Email: email, CreateUser: false}); err != nil {
+		log.Printf("gotrue otp failed: %v", err)
+	}
+
+	return emailSent(c)
+}
+
+// Verify exchanges an emailed code for a session. Every failure gets the
+// same response so a code can't be used to probe for accounts.
+func (h *AuthHandler) Verify(c *fiber.Ctx) error {
+	var input struct {
+		Email string `json:"email"`
+		Token string `json:"token"`
+		Type  string `json:"type"`
+	}
+
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	verificationType, ok := verificationTypes[input.Type]
+	if !ok || input.Token == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "type and token are required",
+		})
+	}
+
+	session, err := utils.GotrueVerify(strings.ToLower(strings.TrimSpace(input.Email)), input.Token, verificationType)
+	if errors.Is(err, utils.ErrGotrueRejected) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "invalid or expired code",
+		})
+	}
+	if err != nil {
+		log.Printf("gotrue verify failed: %v", err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "verification failed",
+		})
+	}
+
+	if err := ensureUserRow(session.User.ID, session.User.Email, false); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	if err := recordLoginSuccess(session.User.ID); err != nil {
+		log.Printf("failed to record sign-in for user %s: %v", session.User.ID, err)
+	}
+
+	if err := trackRefreshToken(*session, nil); err != nil {
+		log.Printf("failed to track refresh token for user %s: %v", session.User.ID, err)
+	}
+
+	return c.JSON(sessionResponse(*session))
+}
+
+// UpdatePassword sets a new password for the signed-in user, which is how a
+// password reset finishes: the session from verifying a "recovery" code is
+// used to call it. The password has already passed ValidateNewPassword.
+// Every other session is signed out.
+func (h *AuthHandler) UpdatePassword(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	claims := c.Locals("claims").(*utils.Claims)
+	user := c.Locals("user").(*models.User)
+
+	var input struct {
+		Password string `json:"password"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	_, err := h.supabaseClient.Auth.WithToken(token).UpdateUser(types.UpdateUserRequest{Password: &input.Password})
+	if err != nil {
+		log.Printf("gotrue password update failed for user %s: %v", user.ID, err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "failed to update password",
+		})
+	}
+
+	if err := utils.GotrueLogout(token, "others"); err != nil {
+		log.Printf("gotrue logout of other sessions failed for user %s: %v", user.ID, err)
+	}
+	if err := revokeOtherSessions(user.ID, claims.SessionID); err != nil {
+		log.Printf("failed to revoke other sessions for user %s: %v", user.ID, err)
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditPasswordChange,
+		TargetType: "user",
+		TargetID:   user.ID.String(),
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+var errEmailInUse = errors.New("email belongs to another account")
+
+// ensureUserRow creates the users row for accounts gotrue created outside
+// SignUp, such as through a magic link or OAuth. It fails with errEmailInUse
+// if another account already has the email. admitted says whether the
+// signup policy let the account in: rows for accounts it hasn't vetted wait,
+// inactive, for admission, and an admitted account's waiting row becomes
+// active. Any other existing row is left as it is.
+func ensureUserRow(id uuid.UUID, email string, admitted bool) error {
+	user, err := findUserByEmail(email)
+	if err != nil {
+		return err
+	}
+	if user != nil && user.ID != id {
+		return errEmailInUse
+	}
+	if user == nil {
+		// The email may have changed; sync_auth_user copies it over.
+		if user, err = fetchUser(id); err != nil {
+			return err
+		}
+	}
+	if user != nil {
+		if admitted && user.SignupPending {
+			return admitUserRow(id)
+		}
+		return nil
+	}
+
+	_, _, err = config.GetDBClient().From("users").
+		Insert(map[string]interface{}{
+			"id":             id,
+			"email":          email,
+			"is_active":      admitted,
+			"signup_pending": !admitted,
+		}, true, "id", "minimal", "").
+		Execute()
+	return err
+}
+
+// admitUserRow activates a row waiting for admission. Rows an admin has
+// since activated or deactivated aren't waiting any more and stay as they are.
+func admitUserRow(id uuid.UUID) error {
+	_, _, err := config.GetDBClient().From("users").
+		Update(map[string]interface{}{"is_active": true}, "minimal", "").
+		Eq("id", id.String()).
+		Eq("signup_pending", "true").
+		Execute()
+	if err == nil {
+		middleware.InvalidateUser(id)
+	}
+	return err
+}
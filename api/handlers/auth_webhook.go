@@ -0,0 +1,222 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"log"
+	"strings"
+)
+
+// Results of sync_auth_user.
+const (
+	syncCreated     = "created"
+	syncUpdated     = "updated"
+	syncDeactivated = "deactivated"
+	syncUnchanged   = "unchanged"
+	syncConflict    = "conflict"
+)
+
+// authUserEvent is a notify_auth_user_change delivery for auth.users. Only
+// the user's ID is used: sync_auth_user reads the current auth.users row
+// rather than trusting the delivery, so repeated and out-of-order deliveries
+// are harmless.
+type authUserEvent struct {
+	Type   string `json:"type"`
+	Table  string `json:"table"`
+	Schema string `json:"schema"`
+	Record *struct {
+		ID uuid.UUID `json:"id"`
+	} `json:"record"`
+	OldRecord *struct {
+		ID uuid.UUID `json:"id"`
+	} `json:"old_record"`
+}
+
+// AuthWebhook keeps public.users in step with gotrue for users created,
+// changed or deleted outside SignUp, e.g. from the dashboard or by OAuth.
+// It expects the INSERT, UPDATE and DELETE events the
+// notify_auth_user_change trigger sends, signed with AUTH_WEBHOOK_SECRET.
+// Rows it creates wait, inactive, until the signup policy admits the user
+// through SignUp or OAuth, or an admin activates them, so signing up
+// straight at gotrue doesn't get around the policy.
+func (h *AuthHandler) AuthWebhook(c *fiber.Ctx) error {
+	var event authUserEvent
+	if err := c.BodyParser(&event); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+	if event.Schema != "auth" || event.Table != "users" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "unsupported event",
+		})
+	}
+
+	var id uuid.UUID
+	switch strings.ToUpper(event.Type) {
+	case "INSERT", "UPDATE":
+		if event.Record != nil {
+			id = event.Record.ID
+		}
+	case "DELETE":
+		if event.OldRecord != nil {
+			id = event.OldRecord.ID
+		}
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "unsupported event",
+		})
+	}
+	if id == uuid.Nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "missing user id",
+		})
+	}
+
+	result, err := syncAuthUser(id)
+	if err != nil {
+		log.Printf("auth webhook: syncing user %s: %v", id, err)
+		// pg_net doesn't retry; reconcile-users picks the user up later.
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to sync user",
+		})
+	}
+	if result == syncConflict {
+		log.Printf("auth webhook: email of user %s belongs to another users row", id)
+	}
+
+	return c.JSON(fiber.Map{"result": result})
+}
+
+// syncAuthUser brings one users row in line with auth.users and, when the
+// user is gone, ends their access. It is safe to repeat.
+func syncAuthUser(id uuid.UUID) (string, error) {
+	// Only the service role may sync, so auth users can't be probed with the
+	// anon key
+	raw := config.GetAdminDBClient().Rpc("sync_auth_user", "", map[string]interface{}{"p_user_id": id})
+	var result string
+	if err := json.Unmarshal([]byte(raw), &result); err != nil {
+		return "", fmt.Errorf("sync_auth_user: %s", raw)
+	}
+
+	switch result {
+	case syncDeactivated:
+		if err := middleware.RevokeUserTokens(id); err != nil {
+			log.Printf("revoking tokens for deleted user %s: %v", id, err)
+		}
+		middleware.InvalidateUser(id)
+	case syncUpdated:
+		middleware.InvalidateUser(id)
+	}
+
+	if result == syncCreated || result == syncUpdated || result == syncDeactivated {
+		middleware.AuditSystem(middleware.AuditEntry{
+			Action:     models.AuditUserSync,
+			TargetType: "user",
+			TargetID:   id.String(),
+			After:      map[string]interface{}{"result": result},
+		})
+	}
+	return result, nil
+}
+
+// ReconcileReport counts what ReconcileUsers found, by sync_auth_user
+// result. Unchanged users aren't counted.
+type ReconcileReport struct {
+	AuthUsers    int            `json:"auth_users"`
+	ProfileUsers int            `json:"profile_users"`
+	Results      map[string]int `json:"results"`
+	Failed       int            `json:"failed"`
+}
+
+const reconcilePageSize = 500
+
+// ReconcileUsers repairs drift between gotrue and public.users that the
+// webhook missed: auth users without a users row, changed emails and users
+// rows whose auth user is gone. With dryRun it only reports what it would
+// do; the results are then what sync_auth_user would be expected to return.
+func ReconcileUsers(dryRun bool) (*ReconcileReport, error) {
+	authUsers := make(map[uuid.UUID]utils.GotrueUser)
+	for page := 1; ; page++ {
+		batch, err := utils.GotrueAdminListUsers(page, reconcilePageSize)
+		if err != nil {
+			return nil, fmt.Errorf("listing auth users: %w", err)
+		}
+		for _, user := range batch {
+			if user.DeletedAt == nil {
+				authUsers[user.ID] = user
+			}
+		}
+		if len(batch) < reconcilePageSize {
+			break
+		}
+	}
+
+	profiles := make(map[uuid.UUID]models.User)
+	for from := 0; ; from += reconcilePageSize {
+		res, _, err := config.GetDBClient().From("users").
+			Select("id, email, is_active", "", false).
+			Order("id", nil).
+			Range(from, from+reconcilePageSize-1, "").
+			Execute()
+		if err != nil {
+			return nil, fmt.Errorf("listing users rows: %w", err)
+		}
+		var batch []models.User
+		if err := json.Unmarshal(res, &batch); err != nil {
+			return nil, err
+		}
+		for _, user := range batch {
+			profiles[user.ID] = user
+		}
+		if len(batch) < reconcilePageSize {
+			break
+		}
+	}
+
+	report := &ReconcileReport{
+		AuthUsers:    len(authUsers),
+		ProfileUsers: len(profiles),
+		Results:      make(map[string]int),
+	}
+
+	drift := make(map[uuid.UUID]string)
+	for id, user := range authUsers {
+		profile, ok := profiles[id]
+		switch {
+		case !ok:
+			drift[id] = syncCreated
+		case profile.Email != user.Email:
+			drift[id] = syncUpdated
+		}
+	}
+	for id, profile := range profiles {
+		if _, ok := authUsers[id]; !ok && profile.IsActive {
+			drift[id] = syncDeactivated
+		}
+	}
+
+	for id, expected := range drift {
+		if dryRun {
+			report.Results[expected]++
+			continue
+		}
+		result, err := syncAuthUser(id)
+		if err != nil {
+			log.Printf("reconcile: syncing user %s: %v", id, err)
+			report.Failed++
+			continue
+		}
+		if result != syncUnchanged {
+			report.Results[result]++
+		}
+	}
+
+	return report, nil
+}
@@ -0,0 +1,152 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"strings"
+	"time"
+)
+
+const maxImpersonationReason = 500
+
+// Impersonate issues a short-lived, read-only token for acting as a user
+// while debugging their issue. Admins can only impersonate users whose
+// permissions they hold themselves, so it can't be used to escalate.
+func (h *UserHandler) Impersonate(c *fiber.Ctx) error {
+	actor := c.Locals("user").(*models.User)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
+		})
+	}
+	if id == actor.ID {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "cannot impersonate yourself",
+		})
+	}
+
+	var input struct {
+		Reason string `json:"reason"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+	input.Reason = strings.TrimSpace(input.Reason)
+	if input.Reason == "" || len(input.Reason) > maxImpersonationReason {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "a reason of at most 500 characters is required",
+		})
+	}
+
+	target, err := fetchUser(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if target == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrUserNotFound.Error(),
+		})
+	}
+	if !target.IsActive {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": models.ErrUserInactive.Error(),
+		})
+	}
+
+	target.Roles, err = fetchUserRoleNames(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if permission, ok := missingPermission(actor, target); ok {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error":      "cannot impersonate a user with permissions you lack",
+			"permission": permission,
+		})
+	}
+
+	token, claims, err := utils.SignImpersonationToken(target.ID, target.Email, actor.ID)
+	if errors.Is(err, utils.ErrImpersonationDisabled) {
+		return c.Status(fiber.StatusServiceUnavailable).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	expiresAt := claims.Expiry()
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserImpersonate,
+		TargetType: "user",
+		TargetID:   target.ID.String(),
+		After: map[string]interface{}{
+			"reason":     input.Reason,
+			"session_id": claims.SessionID,
+			"expires_at": expiresAt,
+		},
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"access_token":      token,
+		"token_type":        "bearer",
+		"expires_in":        int(time.Until(expiresAt).Seconds()),
+		"expires_at":        expiresAt,
+		"impersonated_user": target.ID,
+		"read_only":         true,
+	})
+}
+
+func fetchUserRoleNames(id uuid.UUID) ([]string, error) {
+	res, _, err := config.GetDBClient().From("user_roles").
+		Select("role", "", false).
+		Eq("user_id", id.String()).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []models.UserRole
+	if err := json.Unmarshal(res, &rows); err != nil {
+		return nil, err
+	}
+
+	roles := make([]string, len(rows))
+	for i, row := range rows {
+		roles[i] = row.Role
+	}
+	return roles, nil
+}
+
+// missingPermission returns a permission target has that actor doesn't.
+func missingPermission(actor, target *models.User) (string, bool) {
+	roles := target.Roles
+	if target.IsAdmin {
+		roles = append(roles, models.RoleSuperAdmin)
+	}
+
+	for _, role := range roles {
+		for _, permission := range models.RolePermissions[role] {
+			if !actor.HasPermission(permission) {
+				return permission, true
+			}
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,180 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+// CreateInvite issues a single-use signup invite. The token is only ever
+// returned here. An optional email restricts who can redeem it.
+func (h *UserHandler) CreateInvite(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*models.User)
+
+	var input struct {
+		Email     string `json:"email"`
+		ExpiresIn string `json:"expires_in"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+	}
+
+	ttl := config.GetSignupConfig().InviteTTL
+	if input.ExpiresIn != "" {
+		d, err := time.ParseDuration(input.ExpiresIn)
+		if err != nil || d <= 0 || d > 30*24*time.Hour {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "expires_in must be a duration of at most 720h",
+			})
+		}
+		ttl = d
+	}
+
+	var email interface{}
+	if input.Email != "" {
+		address := strings.ToLower(strings.TrimSpace(input.Email))
+		if _, err := mail.ParseAddress(address); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": models.ErrInvalidEmail.Error(),
+			})
+		}
+		email = address
+	}
+
+	token, err := utils.GenerateInviteToken()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	res, _, err := config.GetDBClient().From("signup_invites").
+		Insert(map[string]interface{}{
+			"token_hash": utils.HashInviteToken(token),
+			"email":      email,
+			"created_by": admin.ID,
+			"expires_at": time.Now().Add(ttl),
+		}, false, "", "representation", "").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to create invite",
+		})
+	}
+
+	var invites []signupInvite
+	if err := json.Unmarshal(res, &invites); err != nil || len(invites) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+	invite := invites[0]
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditInviteCreate,
+		TargetType: "invite",
+		TargetID:   invite.ID.String(),
+		After:      invite,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"invite": invite,
+		"token":  token,
+	})
+}
+
+// ListInvites lists invites, newest first. status=pending limits it to ones
+// that can still be redeemed.
+func (h *UserHandler) ListInvites(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	query := config.GetDBClient().From("signup_invites").
+		Select("id, email, created_by, created_at, expires_at, used_at, used_by, revoked_at", "exact", false)
+
+	if c.Query("status") == "pending" {
+		query = query.Is("used_at", "null").
+			Is("revoked_at", "null").
+			Gt("expires_at", time.Now().UTC().Format(time.RFC3339))
+	}
+
+	res, count, err := query.
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).
+		Range(offset, offset+limit-1, "").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch invites",
+		})
+	}
+
+	var invites []signupInvite
+	if err := json.Unmarshal(res, &invites); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"invites": invites,
+		"total":   count,
+		"page":    page,
+		"limit":   limit,
+	})
+}
+
+// RevokeInvite cancels an invite that hasn't been used yet.
+func (h *UserHandler) RevokeInvite(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid invite ID",
+		})
+	}
+
+	res, _, err := config.GetDBClient().From("signup_invites").
+		Update(map[string]interface{}{"revoked_at": time.Now()}, "representation", "").
+		Eq("id", id.String()).
+		Is("used_at", "null").
+		Is("revoked_at", "null").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke invite",
+		})
+	}
+
+	var revoked []signupInvite
+	if err := json.Unmarshal(res, &revoked); err != nil || len(revoked) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "no pending invite with this ID",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditInviteRevoke,
+		TargetType: "invite",
+		TargetID:   id.String(),
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
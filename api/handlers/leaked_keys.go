@@ -0,0 +1,175 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
+	"log"
+	"time"
+)
+
+const maxLeakReportBatch = 100
+
+// Per-key outcomes of a leak report
+const (
+	leakStatusRevoked        = "revoked"
+	leakStatusAlreadyRevoked = "already_revoked"
+	leakStatusNotFound       = "not_found"
+	leakStatusInvalidFormat  = "invalid_format"
+)
+
+type LeakReportHandler struct {
+	dbClient *postgrest.Client
+}
+
+func NewLeakReportHandler() *LeakReportHandler {
+	return &LeakReportHandler{
+		dbClient: config.GetDBClient(),
+	}
+}
+
+// leakedKeyReport is one candidate in the batch a secret-scanning partner
+// sends: the matched string plus where it was found.
+type leakedKeyReport struct {
+	Token  string `json:"token"`
+	Type   string `json:"type"`
+	URL    string `json:"url"`
+	Source string `json:"source"`
+}
+
+type leakedKeyResult struct {
+	Token  string `json:"token"`
+	Status string `json:"status"`
+	// Label follows secret-scanning conventions so partners can tell which
+	// candidates were real keys.
+	Label string `json:"label"`
+}
+
+// ReportLeakedKeys deactivates every active key in the batch, records where
+// it leaked and notifies its owner.
+func (h *LeakReportHandler) ReportLeakedKeys(c *fiber.Ctx) error {
+	var reports []leakedKeyReport
+	if err := json.Unmarshal(c.Body(), &reports); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if len(reports) == 0 || len(reports) > maxLeakReportBatch {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": fmt.Sprintf("batch must contain between 1 and %d keys", maxLeakReportBatch),
+		})
+	}
+
+	results := make([]leakedKeyResult, len(reports))
+	for i, report := range reports {
+		status, err := h.handleReport(c, report)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to process leak report",
+			})
+		}
+
+		label := "false_positive"
+		if status == leakStatusRevoked || status == leakStatusAlreadyRevoked {
+			label = "true_positive"
+		}
+
+		results[i] = leakedKeyResult{Token: report.Token, Status: status, Label: label}
+	}
+
+	return c.JSON(fiber.Map{
+		"results": results,
+	})
+}
+
+func (h *LeakReportHandler) handleReport(c *fiber.Ctx, report leakedKeyReport) (string, error) {
+	if !utils.ValidateKeyFormat(report.Token) {
+		return leakStatusInvalidFormat, nil
+	}
+
+	hashes := utils.APIKeyHashes(report.Token)
+	candidates := make([]string, 0, len(hashes))
+	for _, hash := range hashes {
+		candidates = append(candidates, hash)
+	}
+
+	res, _, err := h.dbClient.From("api_keys").
+		Select("id, user_id, service_account_id, key_hash, hash_version, key_prefix, name, is_active", "exact", false).
+		In("key_hash", candidates).
+		Execute()
+	if err != nil {
+		return "", err
+	}
+
+	var keys []models.APIKey
+	if err := json.Unmarshal(res, &keys); err != nil {
+		return "", err
+	}
+	if len(keys) == 0 || hashes[keys[0].HashVersion] != keys[0].KeyHash {
+		return leakStatusNotFound, nil
+	}
+	key := keys[0]
+
+	leak := map[string]interface{}{
+		"id":          uuid.New(),
+		"api_key_id":  key.ID,
+		"source":      report.Source,
+		"url":         report.URL,
+		"reported_at": time.Now(),
+	}
+	if _, _, err := h.dbClient.From("api_key_leaks").
+		Insert(leak, false, "", "representation", "exact").
+		Execute(); err != nil {
+		return "", err
+	}
+
+	if !key.IsActive {
+		return leakStatusAlreadyRevoked, nil
+	}
+
+	reason := "leaked"
+	if report.Source != "" {
+		reason = "leaked on " + report.Source
+	}
+
+	if _, _, err := h.dbClient.From("api_keys").
+		Update(revocation(nil, reason), "representation", "exact").
+		Eq("id", key.ID.String()).
+		Execute(); err != nil {
+		return "", err
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditKeyLeakRevoke,
+		TargetType: "api_key",
+		TargetID:   key.ID.String(),
+		After:      map[string]interface{}{"is_active": false, "source": report.Source, "url": report.URL},
+		ActorType:  models.ActorPartner,
+	})
+
+	// The key is already dead; a failed notification shouldn't fail the report
+	contact, err := keyContact(key)
+	if err != nil {
+		log.Printf("failed to find who to notify about leaked key %s: %v", key.ID, err)
+	} else if contact != nil {
+		if err := utils.NotifyUser(*contact, utils.NotificationAPIKeyLeaked, map[string]interface{}{
+			"api_key_id":         key.ID,
+			"key_prefix":         key.KeyPrefix,
+			"name":               key.Name,
+			"service_account_id": key.ServiceAccountID,
+			"source":             report.Source,
+			"url":                report.URL,
+		}); err != nil {
+			log.Printf("failed to notify user %s about leaked key %s: %v", *contact, key.ID, err)
+		}
+	}
+
+	return leakStatusRevoked, nil
+}
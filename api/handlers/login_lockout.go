@@ -0,0 +1,182 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"math"
+	"strconv"
+	"time"
+)
+
+type loginFailure struct {
+	FailedAttempts int        `json:"failed_attempts"`
+	LockedUntil    *time.Time `json:"locked_until"`
+}
+
+// findUserByEmail returns nil without an error when no account matches.
+func findUserByEmail(email string) (*models.User, error) {
+	res, _, err := config.GetDBClient().From("users").
+		Select("*", "exact", false).
+		Eq("email", email).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []models.User
+	if err := json.Unmarshal(res, &users); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
+
+// ipLockedUntil returns when the IP's sign-in lockout ends, or nil.
+// login_ip_failures has no policies, so only the service role can read it.
+func ipLockedUntil(ip string) (*time.Time, error) {
+	res, _, err := config.GetAdminDBClient().From("login_ip_failures").
+		Select("failed_attempts, locked_until", "exact", false).
+		Eq("ip", ip).
+		Gt("locked_until", time.Now().UTC().Format(time.RFC3339)).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []loginFailure
+	if err := json.Unmarshal(res, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].LockedUntil, nil
+}
+
+// recordLoginFailure counts a failed sign-in against the IP and, when the
+// email belongs to an account, against that account. Only the service role
+// may count failures, or anyone could lock anyone out.
+func recordLoginFailure(user *models.User, ip string) error {
+	cfg := config.GetLoginLockoutConfig()
+	dbClient := config.GetAdminDBClient()
+
+	result := dbClient.Rpc("record_ip_login_failure", "", map[string]interface{}{
+		"p_ip":        ip,
+		"p_threshold": cfg.IPMaxAttempts,
+		"p_base_ms":   cfg.BaseLockout.Milliseconds(),
+		"p_max_ms":    cfg.MaxLockout.Milliseconds(),
+		"p_window_ms": cfg.IPWindow.Milliseconds(),
+	})
+	var rows []loginFailure
+	if err := json.Unmarshal([]byte(result), &rows); err != nil {
+		return fmt.Errorf("record_ip_login_failure: %s", result)
+	}
+
+	if user == nil {
+		return nil
+	}
+
+	result = dbClient.Rpc("record_login_failure", "", map[string]interface{}{
+		"p_user_id":   user.ID,
+		"p_threshold": cfg.MaxAttempts,
+		"p_base_ms":   cfg.BaseLockout.Milliseconds(),
+		"p_max_ms":    cfg.MaxLockout.Milliseconds(),
+	})
+	if err := json.Unmarshal([]byte(result), &rows); err != nil {
+		return fmt.Errorf("record_login_failure: %s", result)
+	}
+
+	middleware.InvalidateUser(user.ID)
+	return nil
+}
+
+// recordLoginSuccess clears the account's failure count and lockout.
+func recordLoginSuccess(userID uuid.UUID) error {
+	updateData := map[string]interface{}{
+		"failed_login_attempts": 0,
+		"locked_until":          nil,
+		"last_login":            time.Now(),
+	}
+
+	_, _, err := config.GetDBClient().From("users").
+		Update(updateData, "representation", "exact").
+		Eq("id", userID.String()).
+		Execute()
+
+	middleware.InvalidateUser(userID)
+	return err
+}
+
+func lockedResponse(c *fiber.Ctx, until time.Time, message string) error {
+	retryAfter := int(math.Ceil(time.Until(until).Seconds()))
+	c.Set(fiber.HeaderRetryAfter, strconv.Itoa(retryAfter))
+	return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+		"error":        message,
+		"locked_until": until,
+	})
+}
+
+// AdminUnlockUser lifts an account lockout and resets its failure count.
+func (h *UserHandler) AdminUnlockUser(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
+		})
+	}
+
+	before, err := fetchUser(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to unlock user",
+		})
+	}
+	if before == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrUserNotFound.Error(),
+		})
+	}
+
+	updateData := map[string]interface{}{
+		"failed_login_attempts": 0,
+		"locked_until":          nil,
+	}
+
+	res, _, err := config.GetDBClient().From("users").
+		Update(updateData, "representation", "exact").
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to unlock user",
+		})
+	}
+
+	var updated []models.User
+	if err := json.Unmarshal(res, &updated); err != nil || len(updated) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrUserNotFound.Error(),
+		})
+	}
+
+	middleware.InvalidateUser(id)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserUnlock,
+		TargetType: "user",
+		TargetID:   id.String(),
+		Before: map[string]interface{}{
+			"failed_login_attempts": before.FailedLoginAttempts,
+			"locked_until":          before.LockedUntil,
+		},
+		After: updateData,
+	})
+
+	return c.SendStatus(fiber.StatusOK)
+}
@@ -0,0 +1,453 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"archive/zip"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/gotrue-go/types"
+	"github.com/supabase-community/postgrest-go"
+	"log"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	maxDisplayNameLength = 100
+	exportBatchSize      = 1000
+)
+
+// ownKeyColumns are the api_keys columns a user may see about their own keys.
+const ownKeyColumns = "id, name, key_prefix, environment, created_at, last_used, is_active, rate_limit, " +
+	"allowed_cidrs, allowed_referrers, revoked_at, revocation_reason"
+
+type meResponse struct {
+	ID                   uuid.UUID  `json:"id"`
+	Email                string     `json:"email"`
+	DisplayName          string     `json:"display_name"`
+	CreatedAt            time.Time  `json:"created_at"`
+	LastLogin            *time.Time `json:"last_login"`
+	Roles                []string   `json:"roles"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for"`
+	// ImpersonatedBy is the admin behind an impersonation session.
+	ImpersonatedBy *uuid.UUID `json:"impersonated_by,omitempty"`
+}
+
+func newMeResponse(user *models.User) meResponse {
+	roles := user.Roles
+	if roles == nil {
+		roles = []string{}
+	}
+	return meResponse{
+		ID:                   user.ID,
+		Email:                user.Email,
+		DisplayName:          user.DisplayName,
+		CreatedAt:            user.CreatedAt,
+		LastLogin:            user.LastLogin,
+		Roles:                roles,
+		DeletionScheduledFor: user.DeletionScheduledFor,
+	}
+}
+
+// GetMe returns the authenticated user's profile.
+func (h *UserHandler) GetMe(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	response := newMeResponse(user)
+	if impersonator, ok := middleware.Impersonator(c); ok {
+		response.ImpersonatedBy = &impersonator
+	}
+	return c.JSON(response)
+}
+
+// UpdateMe changes the user's display name and starts an email change. A new
+// email only takes effect once confirmed through the link gotrue sends.
+func (h *UserHandler) UpdateMe(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+	token := c.Locals("token").(string)
+
+	var input struct {
+		DisplayName *string `json:"display_name"`
+		Email       *string `json:"email"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	updated := *user
+	emailChangePending := false
+
+	if input.Email != nil {
+		email := strings.ToLower(strings.TrimSpace(*input.Email))
+		if _, err := mail.ParseAddress(email); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": models.ErrInvalidEmail.Error(),
+			})
+		}
+
+		if email != user.Email {
+			_, err := h.supabaseClient.Auth.WithToken(token).UpdateUser(types.UpdateUserRequest{Email: email})
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "failed to change email",
+				})
+			}
+			emailChangePending = true
+		}
+	}
+
+	if input.DisplayName != nil {
+		displayName, err := normalizeDisplayName(*input.DisplayName)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "display_name " + err.Error(),
+			})
+		}
+
+		_, _, err = config.GetDBClient().From("users").
+			Update(map[string]interface{}{"display_name": displayName}, "minimal", "").
+			Eq("id", user.ID.String()).
+			Execute()
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "failed to update profile",
+			})
+		}
+		updated.DisplayName = displayName
+		middleware.InvalidateUser(user.ID)
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserProfile,
+		TargetType: "user",
+		TargetID:   user.ID.String(),
+		Before:     map[string]interface{}{"display_name": user.DisplayName},
+		After:      map[string]interface{}{"display_name": updated.DisplayName, "email_change_pending": emailChangePending},
+	})
+
+	return c.JSON(fiber.Map{
+		"user":                 newMeResponse(&updated),
+		"email_change_pending": emailChangePending,
+	})
+}
+
+// ExportMe streams a zip archive of everything the API stores about the
+// user: profile, API key metadata, requests with their inputs and outputs,
+// and notifications.
+func (h *UserHandler) ExportMe(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+	dbClient := config.GetDBClient()
+
+	keys, _, err := dbClient.From("api_keys").
+		Select(ownKeyColumns, "", false).
+		Eq("user_id", user.ID.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to export data",
+		})
+	}
+
+	notifications, _, err := dbClient.From("notifications").
+		Select("*", "", false).
+		Eq("user_id", user.ID.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to export data",
+		})
+	}
+
+	profile, err := json.MarshalIndent(newMeResponse(user), "", "  ")
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to export data",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserExport,
+		TargetType: "user",
+		TargetID:   user.ID.String(),
+	})
+
+	c.Set(fiber.HeaderContentType, "application/zip")
+	c.Set(fiber.HeaderContentDisposition, fmt.Sprintf(`attachment; filename="account-%s.zip"`, time.Now().UTC().Format("20060102")))
+
+	c.Context().SetBodyStreamWriter(func(w *bufio.Writer) {
+		archive := zip.NewWriter(w)
+		defer func() {
+			if err := archive.Close(); err != nil {
+				log.Printf("export for user %s: %v", user.ID, err)
+			}
+			w.Flush()
+		}()
+
+		files := []struct {
+			name string
+			data []byte
+		}{
+			{"profile.json", profile},
+			{"api_keys.json", keys},
+			{"notifications.json", notifications},
+		}
+		for _, file := range files {
+			f, err := archive.Create(file.name)
+			if err != nil {
+				return
+			}
+			if _, err := f.Write(file.data); err != nil {
+				return
+			}
+		}
+
+		requests, err := archive.Create("model_requests.jsonl")
+		if err != nil {
+			return
+		}
+		if err := exportModelRequests(user.ID, requests); err != nil {
+			log.Printf("export for user %s: %v", user.ID, err)
+		}
+	})
+
+	return nil
+}
+
+// exportModelRequests writes the user's requests as JSON lines, oldest first.
+func exportModelRequests(userID uuid.UUID, w interface{ Write([]byte) (int, error) }) error {
+	for offset := 0; ; offset += exportBatchSize {
+		res, _, err := config.GetDBClient().From("model_requests").
+			Select("*", "", false).
+			Eq("user_id", userID.String()).
+			Order("created_at", &postgrest.OrderOpts{Ascending: true}).
+			Range(offset, offset+exportBatchSize-1, "").
+			Execute()
+		if err != nil {
+			return err
+		}
+
+		var rows []json.RawMessage
+		if err := json.Unmarshal(res, &rows); err != nil {
+			return err
+		}
+
+		for _, row := range rows {
+			if _, err := w.Write(append(row, '\n')); err != nil {
+				return err
+			}
+		}
+
+		if len(rows) < exportBatchSize {
+			return nil
+		}
+	}
+}
+
+// DeleteMe schedules the account for erasure after the cooling-off window.
+// The account keeps working until then so the user can change their mind.
+func (h *UserHandler) DeleteMe(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	if user.DeletionScheduledFor != nil {
+		return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+			"deletion_scheduled_for": user.DeletionScheduledFor,
+		})
+	}
+
+	// Like leaving, erasure must not strand an organization without an owner.
+	// Only the service role may ask, so memberships can't be probed with the
+	// anon key.
+	result := config.GetAdminDBClient().Rpc("sole_owned_organizations", "", map[string]interface{}{"p_user_id": user.ID})
+	var soleOwned []uuid.UUID
+	if err := json.Unmarshal([]byte(result), &soleOwned); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to schedule account deletion",
+		})
+	}
+	if len(soleOwned) > 0 {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error":         "transfer ownership of your organizations before deleting your account",
+			"organizations": soleOwned,
+		})
+	}
+
+	now := time.Now()
+	scheduledFor := now.Add(config.GetAccountDeletionGrace())
+
+	_, _, err := config.GetDBClient().From("users").
+		Update(map[string]interface{}{
+			"deletion_requested_at":  now,
+			"deletion_scheduled_for": scheduledFor,
+		}, "minimal", "").
+		Eq("id", user.ID.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to schedule account deletion",
+		})
+	}
+
+	middleware.InvalidateUser(user.ID)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserDeletion,
+		TargetType: "user",
+		TargetID:   user.ID.String(),
+		After:      map[string]interface{}{"deletion_scheduled_for": scheduledFor},
+	})
+
+	if err := utils.NotifyUser(user.ID, utils.NotificationAccountDeletion, map[string]interface{}{
+		"deletion_scheduled_for": scheduledFor,
+	}); err != nil {
+		log.Printf("failed to notify user %s of scheduled deletion: %v", user.ID, err)
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"deletion_scheduled_for": scheduledFor,
+	})
+}
+
+// CancelDeletion withdraws a pending deletion request.
+func (h *UserHandler) CancelDeletion(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	if user.DeletionScheduledFor == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "no deletion is scheduled",
+		})
+	}
+
+	_, _, err := config.GetDBClient().From("users").
+		Update(map[string]interface{}{
+			"deletion_requested_at":  nil,
+			"deletion_scheduled_for": nil,
+		}, "minimal", "").
+		Eq("id", user.ID.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to cancel account deletion",
+		})
+	}
+
+	middleware.InvalidateUser(user.ID)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserDeletionStop,
+		TargetType: "user",
+		TargetID:   user.ID.String(),
+		Before:     map[string]interface{}{"deletion_scheduled_for": user.DeletionScheduledFor},
+		After:      map[string]interface{}{"deletion_scheduled_for": nil},
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// RunAccountErasure erases accounts whose cooling-off window has passed,
+// checking every interval. It never returns.
+func RunAccountErasure(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := eraseDueAccounts(); err != nil {
+			log.Printf("account erasure: %v", err)
+		}
+		if err := finishAuthDeletions(); err != nil {
+			log.Printf("account erasure: %v", err)
+		}
+	}
+}
+
+func eraseDueAccounts() error {
+	// erase_user is only open to the service role
+	dbClient := config.GetAdminDBClient()
+
+	res, _, err := dbClient.From("users").
+		Select("id", "", false).
+		Lte("deletion_scheduled_for", time.Now().UTC().Format(time.RFC3339)).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	var due []models.User
+	if err := json.Unmarshal(res, &due); err != nil {
+		return err
+	}
+
+	for _, user := range due {
+		// Public rows go first: some still reference auth.users without a
+		// cascade, which would block the gotrue delete. erase_user refuses
+		// while the user is an organization's only owner, so the account
+		// stays due and is retried once ownership has been handed over.
+		// It queues the gotrue delete for finishAuthDeletions.
+		result := dbClient.Rpc("erase_user", "", map[string]interface{}{"p_user_id": user.ID})
+		var erased bool
+		if err := json.Unmarshal([]byte(result), &erased); err != nil {
+			log.Printf("account erasure: erase_user for user %s: %s", user.ID, result)
+			continue
+		}
+		if !erased {
+			// Cancelled since the select, or another instance got there first.
+			continue
+		}
+
+		if err := middleware.RevokeUserTokens(user.ID); err != nil {
+			log.Printf("account erasure: revoking tokens for user %s: %v", user.ID, err)
+		}
+		middleware.InvalidateUser(user.ID)
+		middleware.AuditSystem(middleware.AuditEntry{
+			Action:     models.AuditUserErase,
+			TargetType: "user",
+			TargetID:   user.ID.String(),
+		})
+	}
+
+	return nil
+}
+
+// finishAuthDeletions deletes the gotrue users of erased accounts. Each stays
+// queued in pending_auth_deletions until gotrue confirms it is gone, so an
+// outage only delays the delete.
+func finishAuthDeletions() error {
+	dbClient := config.GetAdminDBClient()
+
+	res, _, err := dbClient.From("pending_auth_deletions").
+		Select("user_id", "", false).
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	var pending []struct {
+		UserID uuid.UUID `json:"user_id"`
+	}
+	if err := json.Unmarshal(res, &pending); err != nil {
+		return err
+	}
+
+	for _, entry := range pending {
+		if err := utils.GotrueAdminDeleteUser(entry.UserID); err != nil {
+			log.Printf("account erasure: gotrue delete for user %s: %v", entry.UserID, err)
+			continue
+		}
+
+		_, _, err := dbClient.From("pending_auth_deletions").
+			Delete("minimal", "").
+			Eq("user_id", entry.UserID.String()).
+			Execute()
+		if err != nil {
+			log.Printf("account erasure: unqueueing gotrue delete for user %s: %v", entry.UserID, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,337 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/gotrue-go/types"
+	"log"
+	"time"
+)
+
+const factorStatusVerified = "verified"
+
+type recoveryCode struct {
+	ID       uuid.UUID `json:"id"`
+	UserID   uuid.UUID `json:"user_id"`
+	CodeHash string    `json:"code_hash"`
+}
+
+// replaceRecoveryCodes discards the user's recovery codes and issues a new
+// set. The plaintext codes are only ever returned here.
+func replaceRecoveryCodes(userID uuid.UUID) ([]string, error) {
+	if err := deleteRecoveryCodes(userID); err != nil {
+		return nil, err
+	}
+
+	codes, err := utils.GenerateRecoveryCodes()
+	if err != nil {
+		return nil, err
+	}
+
+	rows := make([]recoveryCode, len(codes))
+	for i, code := range codes {
+		rows[i] = recoveryCode{ID: uuid.New(), UserID: userID, CodeHash: utils.HashRecoveryCode(code)}
+	}
+
+	_, _, err = config.GetDBClient().From("mfa_recovery_codes").
+		Insert(rows, false, "", "minimal", "").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+func deleteRecoveryCodes(userID uuid.UUID) error {
+	_, _, err := config.GetDBClient().From("mfa_recovery_codes").
+		Delete("minimal", "").
+		Eq("user_id", userID.String()).
+		Execute()
+	return err
+}
+
+func unusedRecoveryCodeCount(userID uuid.UUID) (int64, error) {
+	_, count, err := config.GetDBClient().From("mfa_recovery_codes").
+		Select("id", "exact", false).
+		Eq("user_id", userID.String()).
+		Is("used_at", "null").
+		Execute()
+	return count, err
+}
+
+func verifiedFactors(factors []types.Factor) []types.Factor {
+	var verified []types.Factor
+	for _, factor := range factors {
+		if factor.Status == factorStatusVerified {
+			verified = append(verified, factor)
+		}
+	}
+	return verified
+}
+
+// MFAFactors lists the current user's factors and how many recovery codes
+// are left.
+func (h *AuthHandler) MFAFactors(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	user := c.Locals("user").(*models.User)
+
+	authUser, err := h.supabaseClient.Auth.WithToken(token).GetUser()
+	if err != nil {
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "failed to load factors",
+		})
+	}
+
+	remaining, err := unusedRecoveryCodeCount(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	factors := authUser.Factors
+	if factors == nil {
+		factors = []types.Factor{}
+	}
+
+	return c.JSON(fiber.Map{
+		"factors":                  factors,
+		"recovery_codes_remaining": remaining,
+	})
+}
+
+// MFAEnroll starts TOTP enrollment. The factor stays unverified, and does
+// not count, until MFAVerify succeeds with a code from the authenticator.
+func (h *AuthHandler) MFAEnroll(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+
+	var input struct {
+		FriendlyName string `json:"friendly_name"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+	}
+
+	resp, err := h.supabaseClient.Auth.WithToken(token).EnrollFactor(types.EnrollFactorRequest{
+		FriendlyName: input.FriendlyName,
+		FactorType:   types.FactorTypeTOTP,
+	})
+	if err != nil {
+		log.Printf("mfa enroll failed: %v", err)
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "failed to enroll factor",
+		})
+	}
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"factor_id": resp.ID,
+		"uri":       resp.TOTP.URI,
+		"secret":    resp.TOTP.Secret,
+		"qr_code":   resp.TOTP.QRCode,
+	})
+}
+
+// MFAVerify checks a TOTP code and returns an AAL2 session. It both
+// completes enrollment and steps up an existing session. Recovery codes are
+// issued the first time, when the user has none left.
+func (h *AuthHandler) MFAVerify(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	user := c.Locals("user").(*models.User)
+
+	var input struct {
+		FactorID uuid.UUID `json:"factor_id"`
+		Code     string    `json:"code"`
+	}
+	if err := c.BodyParser(&input); err != nil || input.FactorID == uuid.Nil || input.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "factor_id and code are required",
+		})
+	}
+
+	client := h.supabaseClient.Auth.WithToken(token)
+
+	challenge, err := client.ChallengeFactor(types.ChallengeFactorRequest{FactorID: input.FactorID})
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "unknown factor",
+		})
+	}
+
+	resp, err := client.VerifyFactor(types.VerifyFactorRequest{
+		FactorID:    input.FactorID,
+		ChallengeID: challenge.ID,
+		Code:        input.Code,
+	})
+	if err != nil {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "invalid code",
+		})
+	}
+
+	if err := trackRefreshToken(resp.Session, nil); err != nil {
+		log.Printf("failed to track refresh token for user %s: %v", user.ID, err)
+	}
+
+	response := sessionResponse(resp.Session)
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditMFAVerify,
+		TargetType: "mfa_factor",
+		TargetID:   input.FactorID.String(),
+	})
+
+	remaining, err := unusedRecoveryCodeCount(user.ID)
+	if err != nil {
+		log.Printf("failed to count recovery codes for user %s: %v", user.ID, err)
+	} else if remaining == 0 {
+		codes, err := replaceRecoveryCodes(user.ID)
+		if err != nil {
+			log.Printf("failed to issue recovery codes for user %s: %v", user.ID, err)
+		} else {
+			response["recovery_codes"] = codes
+		}
+	}
+
+	return c.JSON(response)
+}
+
+// MFAUnenroll removes a factor. gotrue only allows this from an AAL2 session.
+// Recovery codes go with the last verified factor.
+func (h *AuthHandler) MFAUnenroll(c *fiber.Ctx) error {
+	token := c.Locals("token").(string)
+	user := c.Locals("user").(*models.User)
+
+	factorID, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid factor ID",
+		})
+	}
+
+	client := h.supabaseClient.Auth.WithToken(token)
+
+	if _, err := client.UnenrollFactor(types.UnenrollFactorRequest{FactorID: factorID}); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "failed to remove factor",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditMFAUnenroll,
+		TargetType: "mfa_factor",
+		TargetID:   factorID.String(),
+	})
+
+	authUser, err := client.GetUser()
+	if err != nil {
+		log.Printf("failed to reload factors for user %s: %v", user.ID, err)
+	} else if len(verifiedFactors(authUser.Factors)) == 0 {
+		if err := deleteRecoveryCodes(user.ID); err != nil {
+			log.Printf("failed to delete recovery codes for user %s: %v", user.ID, err)
+		}
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// MFARegenerateRecoveryCodes replaces the user's recovery codes.
+func (h *AuthHandler) MFARegenerateRecoveryCodes(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	codes, err := replaceRecoveryCodes(user.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to generate recovery codes",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"recovery_codes": codes,
+	})
+}
+
+// MFARecover spends a recovery code to remove every factor from the account,
+// for users who lost their authenticator. They can then enroll a new one.
+func (h *AuthHandler) MFARecover(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	var input struct {
+		Code string `json:"code"`
+	}
+	if err := c.BodyParser(&input); err != nil || input.Code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "code is required",
+		})
+	}
+
+	// Only the request that flips used_at gets rows back, so a code can't be
+	// spent twice by concurrent requests.
+	res, _, err := config.GetDBClient().From("mfa_recovery_codes").
+		Update(map[string]interface{}{"used_at": time.Now()}, "representation", "exact").
+		Eq("user_id", user.ID.String()).
+		Eq("code_hash", utils.HashRecoveryCode(input.Code)).
+		Is("used_at", "null").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	var used []recoveryCode
+	if err := json.Unmarshal(res, &used); err != nil || len(used) == 0 {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "invalid recovery code",
+		})
+	}
+
+	admin := h.supabaseClient.Auth.WithToken(config.GetServiceRoleKey())
+
+	factors, err := admin.AdminListUserFactors(types.AdminListUserFactorsRequest{UserID: user.ID})
+	if err != nil {
+		log.Printf("failed to list factors for user %s: %v", user.ID, err)
+		return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+			"error": "failed to remove factors",
+		})
+	}
+
+	for _, factor := range factors.Factors {
+		err := admin.AdminDeleteUserFactor(types.AdminDeleteUserFactorRequest{UserID: user.ID, FactorID: factor.ID})
+		if err != nil {
+			log.Printf("failed to delete factor %s for user %s: %v", factor.ID, user.ID, err)
+			return c.Status(fiber.StatusBadGateway).JSON(fiber.Map{
+				"error": "failed to remove factors",
+			})
+		}
+	}
+
+	if err := deleteRecoveryCodes(user.ID); err != nil {
+		log.Printf("failed to delete recovery codes for user %s: %v", user.ID, err)
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditMFARecover,
+		TargetType: "user",
+		TargetID:   user.ID.String(),
+		After:      map[string]interface{}{"factors_removed": len(factors.Factors)},
+	})
+
+	if err := utils.NotifyUser(user.ID, utils.NotificationMFARecoveryCodeUsed, map[string]interface{}{
+		"ip": middleware.ClientIP(c),
+	}); err != nil {
+		log.Printf("failed to notify user %s of recovery code use: %v", user.ID, err)
+	}
+
+	return c.JSON(fiber.Map{
+		"message": "All factors were removed. Enroll a new authenticator to use MFA again.",
+	})
+}
@@ -2,6 +2,7 @@ package handlers
 
 import (
 	"api/config"
+	"api/middleware"
 	"api/models"
 	"api/utils"
 	"encoding/json"
@@ -21,6 +22,101 @@ func NewRequestHandler() *RequestHandler {
 	}
 }
 
+// requestRecord is a model request as stored and listed. Requests are made
+// either by a user or by a service account through one of its keys, so
+// exactly one of UserID and ServiceAccountID is set. OrganizationID is set
+// for requests made in an organization.
+type requestRecord struct {
+	models.ModelRequest
+	UserID           *uuid.UUID `json:"user_id"`
+	ServiceAccountID *uuid.UUID `json:"service_account_id"`
+	OrganizationID   *uuid.UUID `json:"organization_id"`
+	PrincipalType    string     `json:"principal_type,omitempty"`
+}
+
+const (
+	principalUser           = "user"
+	principalServiceAccount = "service_account"
+)
+
+func (r *requestRecord) setPrincipalType() {
+	r.PrincipalType = principalUser
+	if r.ServiceAccountID != nil {
+		r.PrincipalType = principalServiceAccount
+	}
+}
+
+// requestCaller is who a request handler is acting for: a signed-in user, or
+// the owner of the API key the call came with.
+type requestCaller struct {
+	UserID           *uuid.UUID
+	ServiceAccountID *uuid.UUID
+	APIKeyID         *uuid.UUID
+	// Organization is the active organization, if any
+	Organization *models.OrganizationMember
+	// ReadAll is set for users whose roles let them read every request
+	ReadAll bool
+}
+
+func callerOf(c *fiber.Ctx) requestCaller {
+	member, _ := middleware.Organization(c)
+
+	if key, ok := c.Locals("api_key").(models.APIKey); ok {
+		return requestCaller{
+			UserID:           key.UserID,
+			ServiceAccountID: key.ServiceAccountID,
+			APIKeyID:         &key.ID,
+			Organization:     member,
+		}
+	}
+
+	user := c.Locals("user").(*models.User)
+	return requestCaller{
+		UserID:       &user.ID,
+		Organization: member,
+		ReadAll:      user.HasPermission(models.PermRequestsReadAll),
+	}
+}
+
+func (rc requestCaller) organizationID() *uuid.UUID {
+	if rc.Organization == nil {
+		return nil
+	}
+	return &rc.Organization.OrganizationID
+}
+
+// canRead reports whether r is the caller's own request, or one in the active
+// organization they administer.
+func (rc requestCaller) canRead(r requestRecord) bool {
+	if rc.Organization != nil && rc.Organization.CanManage() &&
+		r.OrganizationID != nil && *r.OrganizationID == rc.Organization.OrganizationID {
+		return true
+	}
+	if rc.ServiceAccountID != nil {
+		return r.ServiceAccountID != nil && *r.ServiceAccountID == *rc.ServiceAccountID
+	}
+	return rc.UserID != nil && r.UserID != nil && *r.UserID == *rc.UserID
+}
+
+// visibleRequests limits query to the active organization's requests, or to
+// personal ones without an organization. Only organization admins see other
+// members' requests.
+func (rc requestCaller) visibleRequests(query *postgrest.FilterBuilder) *postgrest.FilterBuilder {
+	if rc.Organization != nil {
+		query = query.Eq("organization_id", rc.Organization.OrganizationID.String())
+		if rc.Organization.CanManage() {
+			return query
+		}
+	} else {
+		query = query.Is("organization_id", "null")
+	}
+
+	if rc.ServiceAccountID != nil {
+		return query.Eq("service_account_id", rc.ServiceAccountID.String())
+	}
+	return query.Eq("user_id", rc.UserID.String())
+}
+
 func (h *RequestHandler) CreateRequest(c *fiber.Ctx) error {
 	var request models.ModelRequest
 	if err := c.BodyParser(&request); err != nil {
@@ -29,34 +125,63 @@ func (h *RequestHandler) CreateRequest(c *fiber.Ctx) error {
 		})
 	}
 
-	user := c.Locals("user").(*models.User)
-	request.UserID = user.ID
+	caller := callerOf(c)
+	request.APIKeyID = caller.APIKeyID
 
-	result, count, err := h.dbClient.From("ai_models").
+	// Private models are only visible inside their own organization
+	modelQuery := h.dbClient.From("ai_models").
 		Select("*", "exact", false).
 		Eq("id", request.ModelID.String()).
-		Eq("is_active", "true").
-		Execute()
+		Eq("is_active", "true")
+	if org := caller.organizationID(); org != nil {
+		modelQuery = modelQuery.Or("organization_id.is.null,organization_id.eq."+org.String(), "")
+	} else {
+		modelQuery = modelQuery.Is("organization_id", "null")
+	}
+
+	result, count, err := modelQuery.Execute()
 
 	if err != nil || count == 0 {
 		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": models.ErrModelNotFound.Error,
+			"error": models.ErrModelNotFound.Error(),
 		})
 	}
 
-	var model models.AIModel
-	if err := json.Unmarshal(result, &model); err != nil {
+	var rows []models.AIModel
+	if err := json.Unmarshal(result, &rows); err != nil || len(rows) == 0 {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to parse model data",
 		})
 	}
+	model := rows[0]
+
+	if org := caller.organizationID(); org != nil {
+		exhausted, err := quotaExhausted(*org)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": "Failed to check organization quota",
+			})
+		}
+		if exhausted {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Organization request quota exhausted for this month",
+			})
+		}
+	}
 
 	request.ID = uuid.New()
 	request.CreatedAt = time.Now()
 	request.Status = "PENDING"
 
+	record := requestRecord{
+		ModelRequest:     request,
+		UserID:           caller.UserID,
+		ServiceAccountID: caller.ServiceAccountID,
+		OrganizationID:   caller.organizationID(),
+	}
+
 	_, _, err = h.dbClient.From("model_requests").
-		Insert(request, false, "", "representation", "exact").
+		Insert(record, false, "", "representation", "exact").
 		Execute()
 
 	if err != nil {
@@ -73,6 +198,21 @@ func (h *RequestHandler) CreateRequest(c *fiber.Ctx) error {
 	})
 }
 
+// quotaExhausted reports whether the organization has used up this month's
+// request quota. Requests racing each other can overshoot it slightly.
+func quotaExhausted(organizationID uuid.UUID) (bool, error) {
+	org, err := fetchOrganization(organizationID)
+	if err != nil || org == nil || org.RequestQuota == nil {
+		return false, err
+	}
+
+	used, err := organizationUsage(organizationID)
+	if err != nil {
+		return false, err
+	}
+	return used >= int64(*org.RequestQuota), nil
+}
+
 func (h *RequestHandler) GetRequest(c *fiber.Ctx) error {
 	requestID := c.Params("id")
 	id, err := uuid.Parse(requestID)
@@ -82,7 +222,7 @@ func (h *RequestHandler) GetRequest(c *fiber.Ctx) error {
 		})
 	}
 
-	user := c.Locals("user").(*models.User)
+	caller := callerOf(c)
 
 	result, count, err := h.dbClient.From("model_requests").
 		Select("*", "exact", false).
@@ -95,16 +235,26 @@ func (h *RequestHandler) GetRequest(c *fiber.Ctx) error {
 		})
 	}
 
-	var request models.ModelRequest
-	if err := json.Unmarshal(result, &request); err != nil {
+	var rows []requestRecord
+	if err := json.Unmarshal(result, &rows); err != nil || len(rows) == 0 {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to parse response",
 		})
 	}
+	request := rows[0]
+	request.setPrincipalType()
+
+	if !caller.canRead(request) {
+		if !caller.ReadAll {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "Not authorized to access this request",
+			})
+		}
 
-	if !user.IsAdmin && request.UserID != user.ID {
-		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-			"error": "Not authorized to access this request",
+		middleware.Audit(c, middleware.AuditEntry{
+			Action:     models.AuditRequestReadOther,
+			TargetType: "request",
+			TargetID:   request.ID.String(),
 		})
 	}
 
@@ -116,38 +266,61 @@ func (h *RequestHandler) ListRequests(c *fiber.Ctx) error {
 	limit := c.QueryInt("limit", 10)
 	offset := (page - 1) * limit
 
-	user := c.Locals("user").(*models.User)
+	caller := callerOf(c)
+	query := h.dbClient.From("model_requests").Select("*", "exact", false)
 
-	var result []byte
-	var count int64
-	var err error
+	// Callers see the requests of their active organization, or their own
+	// personal ones, unless a role lets them read everyone's. Those can be
+	// narrowed to users, service accounts or one account.
+	switch {
+	case !caller.ReadAll:
+		query = caller.visibleRequests(query)
+	case caller.Organization != nil:
+		query = query.Eq("organization_id", caller.Organization.OrganizationID.String())
+	}
+	if caller.ReadAll {
+		switch c.Query("principal") {
+		case "":
+		case principalUser:
+			query = query.Is("service_account_id", "null")
+		case principalServiceAccount:
+			query = query.Not("service_account_id", "is", "null")
+		default:
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "principal must be user or service_account",
+			})
+		}
 
-	// Admins can see all requests, users only see their own
-	if user.IsAdmin {
-		result, count, err = h.dbClient.From("model_requests").
-			Select("*", "exact", false).
-			Range(offset, offset+limit-1, "").
-			Execute()
-	} else {
-		result, count, err = h.dbClient.From("model_requests").
-			Select("*", "exact", false).
-			Eq("user_id", user.ID.String()).
-			Range(offset, offset+limit-1, "").
-			Execute()
+		if accountID := c.Query("service_account_id"); accountID != "" {
+			id, err := uuid.Parse(accountID)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": "Invalid service account ID",
+				})
+			}
+			query = query.Eq("service_account_id", id.String())
+		}
 	}
 
+	result, count, err := query.
+		Range(offset, offset+limit-1, "").
+		Execute()
+
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to fetch requests",
 		})
 	}
 
-	var requests []models.ModelRequest
+	var requests []requestRecord
 	if err := json.Unmarshal(result, &requests); err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to parse response",
 		})
 	}
+	for i := range requests {
+		requests[i].setPrincipalType()
+	}
 
 	return c.JSON(fiber.Map{
 		"requests": requests,
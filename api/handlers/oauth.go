@@ -0,0 +1,248 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/supabase-community/gotrue-go/types"
+	"log"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	oauthFlowCookie = "oauth_flow"
+	oauthFlowTTL    = 10 * time.Minute
+)
+
+// oauthFlow is kept in an HttpOnly cookie between the redirect to the
+// provider and the callback. The PKCE verifier ties the authorization code
+// to the browser that started the flow, so a code sent to someone else's
+// callback can't be exchanged.
+type oauthFlow struct {
+	Verifier    string `json:"verifier"`
+	RedirectTo  string `json:"redirect_to,omitempty"`
+	Provider    string `json:"provider"`
+	InviteToken string `json:"invite_token,omitempty"`
+}
+
+func newPKCEVerifier() (verifier, challenge string, err error) {
+	data := make([]byte, 32)
+	if _, err := rand.Read(data); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(data)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
+
+func setOAuthFlowCookie(c *fiber.Ctx, value string, expires time.Time) {
+	c.Cookie(&fiber.Cookie{
+		Name:     oauthFlowCookie,
+		Value:    value,
+		Path:     "/api/auth/oauth",
+		Expires:  expires,
+		Secure:   true,
+		HTTPOnly: true,
+		SameSite: fiber.CookieSameSiteLaxMode,
+	})
+}
+
+func readOAuthFlow(c *fiber.Ctx) (*oauthFlow, bool) {
+	raw, err := base64.RawURLEncoding.DecodeString(c.Cookies(oauthFlowCookie))
+	if err != nil {
+		return nil, false
+	}
+
+	var flow oauthFlow
+	if err := json.Unmarshal(raw, &flow); err != nil || flow.Verifier == "" {
+		return nil, false
+	}
+	return &flow, true
+}
+
+// OAuthStart sends the browser to gotrue, which forwards it to the provider.
+// redirect_to optionally names the app page to return to afterwards, and
+// invite_token carries a signup invite for new accounts in invite mode.
+func (h *AuthHandler) OAuthStart(c *fiber.Ctx) error {
+	cfg := config.GetOAuthConfig()
+
+	provider := strings.ToLower(c.Params("provider"))
+	if !cfg.Providers[provider] {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "unknown sign-in provider",
+		})
+	}
+
+	flow := oauthFlow{
+		RedirectTo:  c.Query("redirect_to"),
+		Provider:    provider,
+		InviteToken: c.Query("invite_token"),
+	}
+	if flow.RedirectTo != "" && !config.OAuthRedirectAllowed(flow.RedirectTo) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "redirect_to is not allowed",
+		})
+	}
+
+	verifier, challenge, err := newPKCEVerifier()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to start sign-in",
+		})
+	}
+	flow.Verifier = verifier
+
+	cookie, err := json.Marshal(flow)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to start sign-in",
+		})
+	}
+	setOAuthFlowCookie(c, base64.RawURLEncoding.EncodeToString(cookie), time.Now().Add(oauthFlowTTL))
+
+	query := url.Values{
+		"provider":              {provider},
+		"redirect_to":           {cfg.CallbackURL},
+		"code_challenge":        {challenge},
+		"code_challenge_method": {"s256"},
+	}
+	if scopes := c.Query("scopes"); scopes != "" {
+		query.Set("scopes", scopes)
+	}
+
+	return c.Redirect(config.GetAuthURL()+"/authorize?"+query.Encode(), fiber.StatusFound)
+}
+
+// OAuthCallback exchanges the authorization code for a session. gotrue links
+// the provider identity to an existing account when the provider reports the
+// same email as verified; otherwise a new account is created, unless the
+// email already belongs to someone, in which case sign-in is refused.
+func (h *AuthHandler) OAuthCallback(c *fiber.Ctx) error {
+	flow, ok := readOAuthFlow(c)
+	setOAuthFlowCookie(c, "", time.Unix(0, 0))
+	if !ok {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "sign-in session expired, please start again",
+		})
+	}
+
+	if providerErr := c.Query("error"); providerErr != "" {
+		log.Printf("oauth sign-in failed: %s: %s", providerErr, c.Query("error_description"))
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "sign-in was cancelled or denied",
+		})
+	}
+
+	code := c.Query("code")
+	if code == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "missing authorization code",
+		})
+	}
+
+	resp, err := h.supabaseClient.Auth.Token(types.TokenRequest{
+		GrantType:    "pkce",
+		Code:         code,
+		CodeVerifier: flow.Verifier,
+	})
+	if err != nil {
+		log.Printf("oauth code exchange failed: %v", err)
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "sign-in failed",
+		})
+	}
+	session := resp.Session
+
+	if session.User.Email == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "the provider did not share an email address",
+		})
+	}
+
+	existing, err := findUserByEmail(session.User.Email)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	// gotrue has already created the account by now, so a new user the
+	// signup policy turns away has to be removed again. The auth webhook may
+	// have beaten us to the users row, which then waits for admission.
+	var invite *signupInvite
+	if existing == nil || existing.SignupPending {
+		invite, err = admitSignup(SignupAttempt{
+			Email:     strings.ToLower(session.User.Email),
+			IP:        middleware.ClientIP(c),
+			UserAgent: c.Get(fiber.HeaderUserAgent),
+			Provider:  flow.Provider,
+		}, flow.InviteToken)
+		if err != nil {
+			h.discardOAuthUser(session.User)
+			return signupRejected(c, err)
+		}
+	}
+
+	err = ensureUserRow(session.User.ID, session.User.Email, true)
+	if err != nil && invite != nil {
+		releaseInvite(invite.ID)
+	}
+	if errors.Is(err, errEmailInUse) {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "an account with this email already exists; sign in with it first",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "registration failed",
+		})
+	}
+
+	if invite != nil {
+		recordInviteUse(invite.ID, session.User.ID)
+	}
+
+	if err := recordLoginSuccess(session.User.ID); err != nil {
+		log.Printf("failed to record sign-in for user %s: %v", session.User.ID, err)
+	}
+
+	if err := trackRefreshToken(session, nil); err != nil {
+		log.Printf("failed to track refresh token for user %s: %v", session.User.ID, err)
+	}
+
+	if flow.RedirectTo != "" && config.OAuthRedirectAllowed(flow.RedirectTo) {
+		// Tokens go in the fragment so they never reach the app's server logs.
+		fragment := url.Values{
+			"access_token":  {session.AccessToken},
+			"token_type":    {"Bearer"},
+			"refresh_token": {session.RefreshToken},
+			"expires_in":    {strconv.Itoa(session.ExpiresIn)},
+			"expires_at":    {strconv.FormatInt(session.ExpiresAt, 10)},
+		}
+		return c.Redirect(flow.RedirectTo+"#"+fragment.Encode(), fiber.StatusFound)
+	}
+
+	return c.JSON(sessionResponse(session))
+}
+
+// discardOAuthUser deletes a gotrue user created by a rejected OAuth signup.
+// Users older than the flow predate it and are left alone.
+func (h *AuthHandler) discardOAuthUser(user types.User) {
+	if time.Since(user.CreatedAt) > oauthFlowTTL {
+		return
+	}
+
+	admin := h.supabaseClient.Auth.WithToken(config.GetServiceRoleKey())
+	if err := admin.AdminDeleteUser(types.AdminDeleteUserRequest{UserID: user.ID}); err != nil {
+		log.Printf("failed to delete rejected oauth user %s: %v", user.ID, err)
+	}
+}
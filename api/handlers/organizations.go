@@ -0,0 +1,767 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
+	"log"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var orgSlugPattern = regexp.MustCompile(`^[a-z0-9][a-z0-9-]{1,62}$`)
+
+// orgInvitationTTL is how long an invitation to join an organization stays
+// open.
+const orgInvitationTTL = 7 * 24 * time.Hour
+
+type OrganizationHandler struct {
+	dbClient *postgrest.Client
+}
+
+func NewOrganizationHandler() *OrganizationHandler {
+	return &OrganizationHandler{
+		dbClient: config.GetDBClient(),
+	}
+}
+
+// CreateOrganization creates an organization with the caller as its owner.
+func (h *OrganizationHandler) CreateOrganization(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	var input struct {
+		Name string `json:"name"`
+		Slug string `json:"slug"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	name := strings.TrimSpace(input.Name)
+	slug := strings.ToLower(strings.TrimSpace(input.Slug))
+	if name == "" || !orgSlugPattern.MatchString(slug) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "name is required and slug must be 2-63 lowercase letters, digits or dashes",
+		})
+	}
+
+	org := models.Organization{
+		ID:        uuid.New(),
+		Name:      name,
+		Slug:      slug,
+		CreatedBy: &user.ID,
+		CreatedAt: time.Now(),
+	}
+
+	if _, _, err := h.dbClient.From("organizations").
+		Insert(org, false, "", "", "").
+		Execute(); err != nil {
+		if isUniqueViolation(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "an organization with this slug already exists",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to create organization",
+		})
+	}
+
+	owner := models.OrganizationMember{
+		OrganizationID: org.ID,
+		UserID:         user.ID,
+		Role:           models.OrgRoleOwner,
+		AddedBy:        &user.ID,
+		CreatedAt:      org.CreatedAt,
+	}
+	if _, _, err := h.dbClient.From("organization_members").
+		Insert(owner, false, "", "", "").
+		Execute(); err != nil {
+		// An organization nobody belongs to can't be reached; drop it
+		h.dbClient.From("organizations").Delete("minimal", "").Eq("id", org.ID.String()).Execute()
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to create organization",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditOrgCreate,
+		TargetType: "organization",
+		TargetID:   org.ID.String(),
+		After:      org,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"organization": org,
+		"role":         owner.Role,
+	})
+}
+
+// ListOrganizations lists the organizations the caller belongs to.
+func (h *OrganizationHandler) ListOrganizations(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	res, _, err := h.dbClient.From("organization_members").
+		Select("role, organization:organizations(*)", "", false).
+		Eq("user_id", user.ID.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch organizations",
+		})
+	}
+
+	var memberships []struct {
+		Role         string              `json:"role"`
+		Organization models.Organization `json:"organization"`
+	}
+	if err := json.Unmarshal(res, &memberships); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"organizations": memberships,
+	})
+}
+
+// GetOrganization returns the active organization, the caller's role in it
+// and its request usage this month.
+func (h *OrganizationHandler) GetOrganization(c *fiber.Ctx) error {
+	member, _ := middleware.Organization(c)
+
+	org, err := fetchOrganization(member.OrganizationID)
+	if err != nil || org == nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	used, err := organizationUsage(org.ID)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to count requests",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"organization": org,
+		"role":         member.Role,
+		"usage": fiber.Map{
+			"requests_this_month": used,
+			"request_quota":       org.RequestQuota,
+		},
+	})
+}
+
+// UpdateOrganization renames the active organization. Quotas are set by
+// platform admins through SetQuota.
+func (h *OrganizationHandler) UpdateOrganization(c *fiber.Ctx) error {
+	member, ok := requireOrgAdmin(c)
+	if !ok {
+		return nil
+	}
+
+	var input struct {
+		Name string `json:"name"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "name is required",
+		})
+	}
+
+	return h.updateOrganization(c, member.OrganizationID, map[string]interface{}{"name": name})
+}
+
+// SetQuota sets an organization's monthly request quota. null removes it.
+func (h *OrganizationHandler) SetQuota(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid organization ID",
+		})
+	}
+
+	var input struct {
+		RequestQuota *int `json:"request_quota"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+	if input.RequestQuota != nil && *input.RequestQuota < 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "request_quota must not be negative",
+		})
+	}
+
+	return h.updateOrganization(c, id, map[string]interface{}{"request_quota": input.RequestQuota})
+}
+
+func (h *OrganizationHandler) updateOrganization(c *fiber.Ctx, id uuid.UUID, update map[string]interface{}) error {
+	before, err := fetchOrganization(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if before == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "organization not found",
+		})
+	}
+
+	res, _, err := h.dbClient.From("organizations").
+		Update(update, "representation", "").
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to update organization",
+		})
+	}
+
+	var after []models.Organization
+	if err := json.Unmarshal(res, &after); err != nil || len(after) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditOrgUpdate,
+		TargetType: "organization",
+		TargetID:   id.String(),
+		Before:     before,
+		After:      after[0],
+	})
+
+	return c.JSON(after[0])
+}
+
+func (h *OrganizationHandler) ListMembers(c *fiber.Ctx) error {
+	member, _ := middleware.Organization(c)
+
+	res, _, err := h.dbClient.From("organization_members").
+		Select("*, user:users(email, display_name)", "", false).
+		Eq("organization_id", member.OrganizationID.String()).
+		Order("created_at", &postgrest.OrderOpts{Ascending: true}).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch members",
+		})
+	}
+
+	var members []struct {
+		models.OrganizationMember
+		User struct {
+			Email       string `json:"email"`
+			DisplayName string `json:"display_name,omitempty"`
+		} `json:"user"`
+	}
+	if err := json.Unmarshal(res, &members); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"members": members,
+	})
+}
+
+// AddMember invites a user, by user_id or email, to the active organization.
+// They only join once they accept. The response is the same whether or not
+// the account exists, so it can't be used to find out who has one. Only
+// owners can invite owners.
+func (h *OrganizationHandler) AddMember(c *fiber.Ctx) error {
+	admin, ok := requireOrgAdmin(c)
+	if !ok {
+		return nil
+	}
+
+	var input struct {
+		UserID *uuid.UUID `json:"user_id"`
+		Email  string     `json:"email"`
+		Role   string     `json:"role"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	if input.Role == "" {
+		input.Role = models.OrgRoleMember
+	}
+	if status, message := checkRoleChange(admin, input.Role); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+
+	var user *models.User
+	var err error
+	switch {
+	case input.UserID != nil:
+		user, err = fetchUser(*input.UserID)
+	case input.Email != "":
+		user, err = findUserByEmail(strings.ToLower(strings.TrimSpace(input.Email)))
+	default:
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "user_id or email is required",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	if user != nil && user.IsActive {
+		if err := h.invite(c, admin, user, input.Role); err != nil {
+			log.Printf("inviting user %s to organization %s: %v", user.ID, admin.OrganizationID, err)
+		}
+	}
+
+	return c.Status(fiber.StatusAccepted).JSON(fiber.Map{
+		"message": "if the account exists, it has been invited",
+	})
+}
+
+// invite offers user membership with role, replacing any earlier invitation.
+// Members are left alone.
+func (h *OrganizationHandler) invite(c *fiber.Ctx, admin *models.OrganizationMember, user *models.User, role string) error {
+	existing, err := middleware.OrganizationMembership(admin.OrganizationID, user.ID)
+	if err != nil || existing != nil {
+		return err
+	}
+
+	now := time.Now()
+	invitation := models.OrganizationInvitation{
+		ID:             uuid.New(),
+		OrganizationID: admin.OrganizationID,
+		UserID:         user.ID,
+		Role:           role,
+		InvitedBy:      &admin.UserID,
+		CreatedAt:      now,
+		ExpiresAt:      now.Add(orgInvitationTTL),
+	}
+	if _, _, err := h.dbClient.From("organization_invitations").
+		Insert(invitation, true, "organization_id,user_id", "", "").
+		Execute(); err != nil {
+		return err
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditOrgMemberInvite,
+		TargetType: "organization",
+		TargetID:   admin.OrganizationID.String(),
+		After:      invitation,
+	})
+
+	return utils.NotifyUser(user.ID, utils.NotificationOrgInvitation, map[string]interface{}{
+		"invitation_id":   invitation.ID,
+		"organization_id": invitation.OrganizationID,
+		"role":            invitation.Role,
+	})
+}
+
+// ListInvitations lists the caller's pending organization invitations.
+func (h *OrganizationHandler) ListInvitations(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	res, _, err := h.dbClient.From("organization_invitations").
+		Select("*, organization:organizations(id, name, slug)", "", false).
+		Eq("user_id", user.ID.String()).
+		Gt("expires_at", time.Now().UTC().Format(time.RFC3339)).
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch invitations",
+		})
+	}
+
+	var invitations []struct {
+		models.OrganizationInvitation
+		Organization struct {
+			ID   uuid.UUID `json:"id"`
+			Name string    `json:"name"`
+			Slug string    `json:"slug"`
+		} `json:"organization"`
+	}
+	if err := json.Unmarshal(res, &invitations); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"invitations": invitations,
+	})
+}
+
+// AcceptInvitation makes the caller a member with the invited role. The
+// invitation lapses if whoever sent it can no longer grant that role.
+func (h *OrganizationHandler) AcceptInvitation(c *fiber.Ctx) error {
+	invitation, ok := h.ownInvitation(c)
+	if !ok {
+		return nil
+	}
+
+	var inviter *models.OrganizationMember
+	if invitation.InvitedBy != nil {
+		var err error
+		inviter, err = middleware.OrganizationMembership(invitation.OrganizationID, *invitation.InvitedBy)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": models.ErrInternalServer.Error(),
+			})
+		}
+	}
+	if inviter == nil || !inviter.CanManage() {
+		h.deleteInvitation(invitation.ID)
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "invitation is no longer valid",
+		})
+	}
+	if status, _ := checkRoleChange(inviter, invitation.Role); status != 0 {
+		h.deleteInvitation(invitation.ID)
+		return c.Status(fiber.StatusGone).JSON(fiber.Map{
+			"error": "invitation is no longer valid",
+		})
+	}
+
+	member := models.OrganizationMember{
+		OrganizationID: invitation.OrganizationID,
+		UserID:         invitation.UserID,
+		Role:           invitation.Role,
+		AddedBy:        invitation.InvitedBy,
+		CreatedAt:      time.Now(),
+	}
+	if _, _, err := h.dbClient.From("organization_members").
+		Insert(member, false, "", "", "").
+		Execute(); err != nil {
+		if isUniqueViolation(err) {
+			h.deleteInvitation(invitation.ID)
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "already a member",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to accept invitation",
+		})
+	}
+	h.deleteInvitation(invitation.ID)
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditOrgMemberAdd,
+		TargetType: "organization",
+		TargetID:   invitation.OrganizationID.String(),
+		After:      member,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(member)
+}
+
+// DeclineInvitation turns down one of the caller's invitations.
+func (h *OrganizationHandler) DeclineInvitation(c *fiber.Ctx) error {
+	invitation, ok := h.ownInvitation(c)
+	if !ok {
+		return nil
+	}
+
+	if err := h.deleteInvitation(invitation.ID); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to decline invitation",
+		})
+	}
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// ownInvitation loads the caller's unexpired invitation named by :id,
+// writing the error response when it can't.
+func (h *OrganizationHandler) ownInvitation(c *fiber.Ctx) (*models.OrganizationInvitation, bool) {
+	user := c.Locals("user").(*models.User)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid invitation ID",
+		})
+		return nil, false
+	}
+
+	res, _, err := h.dbClient.From("organization_invitations").
+		Select("*", "", false).
+		Eq("id", id.String()).
+		Eq("user_id", user.ID.String()).
+		Gt("expires_at", time.Now().UTC().Format(time.RFC3339)).
+		Execute()
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+		return nil, false
+	}
+
+	var invitations []models.OrganizationInvitation
+	if err := json.Unmarshal(res, &invitations); err != nil {
+		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+		return nil, false
+	}
+	if len(invitations) == 0 {
+		c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "invitation not found",
+		})
+		return nil, false
+	}
+	return &invitations[0], true
+}
+
+func (h *OrganizationHandler) deleteInvitation(id uuid.UUID) error {
+	_, _, err := h.dbClient.From("organization_invitations").
+		Delete("minimal", "").
+		Eq("id", id.String()).
+		Execute()
+	return err
+}
+
+// UpdateMember changes a member's role. Only owners can grant or take away
+// ownership, and the last owner can't step down.
+func (h *OrganizationHandler) UpdateMember(c *fiber.Ctx) error {
+	admin, ok := requireOrgAdmin(c)
+	if !ok {
+		return nil
+	}
+
+	target, ok := h.targetMember(c, admin)
+	if !ok {
+		return nil
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+	if status, message := checkRoleChange(admin, input.Role); status != 0 {
+		return c.Status(status).JSON(fiber.Map{
+			"error": message,
+		})
+	}
+	if target.Role == models.OrgRoleOwner && admin.Role != models.OrgRoleOwner {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "only owners can change an owner's role",
+		})
+	}
+	if target.Role == input.Role {
+		return c.JSON(target)
+	}
+	if target.Role == models.OrgRoleOwner && !h.hasOtherOwner(c, target) {
+		return nil
+	}
+
+	if _, _, err := h.dbClient.From("organization_members").
+		Update(map[string]interface{}{"role": input.Role}, "", "").
+		Eq("organization_id", target.OrganizationID.String()).
+		Eq("user_id", target.UserID.String()).
+		Execute(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to update member",
+		})
+	}
+
+	after := *target
+	after.Role = input.Role
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditOrgMemberUpdate,
+		TargetType: "organization",
+		TargetID:   target.OrganizationID.String(),
+		Before:     map[string]interface{}{"user_id": target.UserID, "role": target.Role},
+		After:      map[string]interface{}{"user_id": target.UserID, "role": after.Role},
+	})
+
+	return c.JSON(after)
+}
+
+// RemoveMember takes a user out of the active organization. Admins can
+// remove members, owners anyone, and everyone can leave; the last owner has
+// to hand over ownership first. Their organization keys stop working.
+func (h *OrganizationHandler) RemoveMember(c *fiber.Ctx) error {
+	actor, _ := middleware.Organization(c)
+
+	target, ok := h.targetMember(c, actor)
+	if !ok {
+		return nil
+	}
+
+	if target.UserID != actor.UserID {
+		if !actor.CanManage() {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": models.ErrOrgAdminRequired.Error(),
+			})
+		}
+		if target.Role == models.OrgRoleOwner && actor.Role != models.OrgRoleOwner {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "only owners can remove an owner",
+			})
+		}
+	}
+	if target.Role == models.OrgRoleOwner && !h.hasOtherOwner(c, target) {
+		return nil
+	}
+
+	if _, _, err := h.dbClient.From("organization_members").
+		Delete("minimal", "").
+		Eq("organization_id", target.OrganizationID.String()).
+		Eq("user_id", target.UserID.String()).
+		Execute(); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to remove member",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditOrgMemberRemove,
+		TargetType: "organization",
+		TargetID:   target.OrganizationID.String(),
+		Before:     map[string]interface{}{"user_id": target.UserID, "role": target.Role},
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// targetMember loads the member named by :user_id in the actor's
+// organization, writing the error response when it can't.
+func (h *OrganizationHandler) targetMember(c *fiber.Ctx, actor *models.OrganizationMember) (*models.OrganizationMember, bool) {
+	userID, err := uuid.Parse(c.Params("user_id"))
+	if err != nil {
+		c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
+		})
+		return nil, false
+	}
+
+	target, err := middleware.OrganizationMembership(actor.OrganizationID, userID)
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+		return nil, false
+	}
+	if target == nil {
+		c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "member not found",
+		})
+		return nil, false
+	}
+	return target, true
+}
+
+// hasOtherOwner checks that the organization keeps an owner once target
+// stops being one, writing a 409 when it wouldn't.
+func (h *OrganizationHandler) hasOtherOwner(c *fiber.Ctx, target *models.OrganizationMember) bool {
+	_, count, err := h.dbClient.From("organization_members").
+		Select("user_id", "exact", true).
+		Eq("organization_id", target.OrganizationID.String()).
+		Eq("role", models.OrgRoleOwner).
+		Execute()
+	if err != nil {
+		c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+		return false
+	}
+	if count <= 1 {
+		c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "an organization needs at least one owner",
+		})
+		return false
+	}
+	return true
+}
+
+// requireOrgAdmin returns the caller's membership if they administer the
+// active organization, and writes a 403 otherwise.
+func requireOrgAdmin(c *fiber.Ctx) (*models.OrganizationMember, bool) {
+	member, ok := middleware.Organization(c)
+	if !ok || !member.CanManage() {
+		c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": models.ErrOrgAdminRequired.Error(),
+		})
+		return nil, false
+	}
+	return member, true
+}
+
+// checkRoleChange returns a status and message when actor may not give
+// someone role, or 0.
+func checkRoleChange(actor *models.OrganizationMember, role string) (int, string) {
+	if !models.IsValidOrgRole(role) {
+		return fiber.StatusBadRequest, "role must be owner, admin or member"
+	}
+	if role == models.OrgRoleOwner && actor.Role != models.OrgRoleOwner {
+		return fiber.StatusForbidden, "only owners can make someone an owner"
+	}
+	return 0, ""
+}
+
+func fetchOrganization(id uuid.UUID) (*models.Organization, error) {
+	res, _, err := config.GetDBClient().From("organizations").
+		Select("*", "", false).
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var orgs []models.Organization
+	if err := json.Unmarshal(res, &orgs); err != nil {
+		return nil, err
+	}
+	if len(orgs) == 0 {
+		return nil, nil
+	}
+	return &orgs[0], nil
+}
+
+// organizationUsage counts the organization's model requests this calendar
+// month, which is what request_quota limits.
+func organizationUsage(id uuid.UUID) (int64, error) {
+	now := time.Now().UTC()
+	monthStart := time.Date(now.Year(), now.Month(), 1, 0, 0, 0, 0, time.UTC)
+
+	_, count, err := config.GetDBClient().From("model_requests").
+		Select("id", "exact", true).
+		Eq("organization_id", id.String()).
+		Gte("created_at", monthStart.Format(time.RFC3339)).
+		Execute()
+	return count, err
+}
@@ -0,0 +1,250 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/gotrue-go/types"
+	"log"
+	"time"
+)
+
+var errRefreshTokenReused = errors.New("refresh token reuse detected")
+
+// refreshTokenRecord tracks every refresh token handed out by the API. All
+// tokens descending from one sign-in share a chain ID, so presenting a token
+// that was already exchanged revokes the whole chain: whoever holds the
+// stolen copy and the legitimate client both have to sign in again.
+type refreshTokenRecord struct {
+	TokenHash  string     `json:"token_hash"`
+	ChainID    uuid.UUID  `json:"chain_id"`
+	ParentHash *string    `json:"parent_hash,omitempty"`
+	UserID     uuid.UUID  `json:"user_id"`
+	SessionID  *uuid.UUID `json:"session_id,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	UsedAt     *time.Time `json:"used_at,omitempty"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+func hashRefreshToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// sessionResponse is what sign-in and refresh return to clients.
+func sessionResponse(session types.Session) fiber.Map {
+	return fiber.Map{
+		"access_token":  session.AccessToken,
+		"token_type":    "Bearer",
+		"refresh_token": session.RefreshToken,
+		"expires_in":    session.ExpiresIn,
+		"expires_at":    session.ExpiresAt,
+	}
+}
+
+// trackRefreshToken records a newly issued refresh token. parent is nil for
+// the first token of a sign-in.
+func trackRefreshToken(session types.Session, parent *refreshTokenRecord) error {
+	record := refreshTokenRecord{
+		TokenHash: hashRefreshToken(session.RefreshToken),
+		UserID:    session.User.ID,
+		CreatedAt: time.Now(),
+	}
+
+	if claims, err := utils.VerifyToken(session.AccessToken); err == nil {
+		if sessionID, err := uuid.Parse(claims.SessionID); err == nil {
+			record.SessionID = &sessionID
+		}
+	}
+
+	switch {
+	case parent != nil:
+		record.ChainID = parent.ChainID
+		record.ParentHash = &parent.TokenHash
+	case record.SessionID != nil:
+		record.ChainID = *record.SessionID
+	default:
+		record.ChainID = uuid.New()
+	}
+
+	_, _, err := config.GetDBClient().From("refresh_tokens").
+		Insert(record, false, "", "representation", "exact").
+		Execute()
+	return err
+}
+
+// consumeRefreshToken marks a token as exchanged. Tokens the API never issued
+// (older sessions, other clients) are adopted as the root of a new chain.
+// A token that was already used or revoked revokes its chain.
+func consumeRefreshToken(token string) (*refreshTokenRecord, error) {
+	dbClient := config.GetDBClient()
+	tokenHash := hashRefreshToken(token)
+
+	res, _, err := dbClient.From("refresh_tokens").
+		Select("*", "exact", false).
+		Eq("token_hash", tokenHash).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var records []refreshTokenRecord
+	if err := json.Unmarshal(res, &records); err != nil {
+		return nil, err
+	}
+	if len(records) == 0 {
+		return nil, nil
+	}
+	record := records[0]
+
+	if record.UsedAt != nil || record.RevokedAt != nil {
+		revokeRefreshChain(record)
+		return nil, errRefreshTokenReused
+	}
+
+	// Only one of two concurrent exchanges of the same token can win
+	res, _, err = dbClient.From("refresh_tokens").
+		Update(map[string]interface{}{"used_at": time.Now()}, "representation", "exact").
+		Eq("token_hash", tokenHash).
+		Is("used_at", "null").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var updated []refreshTokenRecord
+	if err := json.Unmarshal(res, &updated); err != nil || len(updated) == 0 {
+		revokeRefreshChain(record)
+		return nil, errRefreshTokenReused
+	}
+
+	return &record, nil
+}
+
+func releaseRefreshToken(tokenHash string) error {
+	_, _, err := config.GetDBClient().From("refresh_tokens").
+		Update(map[string]interface{}{"used_at": nil}, "representation", "exact").
+		Eq("token_hash", tokenHash).
+		Is("revoked_at", "null").
+		Execute()
+	return err
+}
+
+// revokeRefreshChain ends the session a reused token belongs to: the API's
+// refresh tokens for the chain are revoked, the session's access tokens are
+// blacklisted and gotrue's session is deleted so its own refresh tokens stop
+// working too. Failures are logged; the caller rejects the request anyway.
+func revokeRefreshChain(record refreshTokenRecord) {
+	_, _, err := config.GetDBClient().From("refresh_tokens").
+		Update(map[string]interface{}{"revoked_at": time.Now()}, "representation", "exact").
+		Eq("chain_id", record.ChainID.String()).
+		Is("revoked_at", "null").
+		Execute()
+	if err != nil {
+		log.Printf("failed to revoke refresh chain %s: %v", record.ChainID, err)
+	}
+
+	if record.SessionID == nil {
+		return
+	}
+	if err := middleware.RevokeSession(*record.SessionID); err != nil {
+		log.Printf("failed to blacklist session %s: %v", record.SessionID, err)
+	}
+	if err := endAuthSession(*record.SessionID); err != nil {
+		log.Printf("failed to end gotrue session %s: %v", record.SessionID, err)
+	}
+	if err := markSessionsRevoked(record.UserID, record.SessionID.String()); err != nil {
+		log.Printf("failed to mark session %s revoked: %v", record.SessionID, err)
+	}
+}
+
+// endAuthSession deletes a gotrue session and, with it, the refresh tokens
+// gotrue would otherwise still exchange. gotrue's own logout needs a token
+// of that session, so this goes through end_auth_session as the service
+// role.
+func endAuthSession(sessionID uuid.UUID) error {
+	client := config.GetAdminDBClient()
+	if client == nil {
+		return errors.New("SUPABASE_SERVICE_ROLE_KEY is not set")
+	}
+
+	result := client.Rpc("end_auth_session", "", map[string]interface{}{"p_session_id": sessionID})
+	// The result only says whether the session still existed.
+	if err := json.Unmarshal([]byte(result), new(bool)); err != nil {
+		return fmt.Errorf("end_auth_session: %s", result)
+	}
+	return nil
+}
+
+// RefreshToken exchanges a refresh token for a new session through gotrue.
+func (h *UserHandler) RefreshToken(c *fiber.Ctx) error {
+	var input struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+
+	if err := c.BodyParser(&input); err != nil || input.RefreshToken == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "refresh_token is required",
+		})
+	}
+
+	parent, err := consumeRefreshToken(input.RefreshToken)
+	if errors.Is(err, errRefreshTokenReused) {
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "refresh token already used; session revoked, please sign in again",
+		})
+	}
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+
+	authResponse, err := h.supabaseClient.Auth.RefreshToken(input.RefreshToken)
+	if err != nil {
+		// Let the client retry after a failure on gotrue's side without
+		// the retry being mistaken for reuse
+		if parent != nil {
+			releaseRefreshToken(parent.TokenHash)
+		}
+		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+			"error": "invalid refresh token",
+		})
+	}
+
+	// An untracked token is adopted as a new chain on its next exchange,
+	// so failing to record it only weakens reuse detection
+	if err := trackRefreshToken(authResponse.Session, parent); err != nil {
+		log.Printf("failed to track refresh token for user %s: %v", authResponse.User.ID, err)
+	}
+
+	return c.JSON(sessionResponse(authResponse.Session))
+}
+
+// revokeSessionRefreshTokens stops the API from exchanging any refresh token
+// that belongs to the session.
+func revokeSessionRefreshTokens(sessionID string) error {
+	_, _, err := config.GetDBClient().From("refresh_tokens").
+		Update(map[string]interface{}{"revoked_at": time.Now()}, "representation", "exact").
+		Eq("session_id", sessionID).
+		Is("revoked_at", "null").
+		Execute()
+	return err
+}
+
+func revokeUserRefreshTokens(userID uuid.UUID) error {
+	_, _, err := config.GetDBClient().From("refresh_tokens").
+		Update(map[string]interface{}{"revoked_at": time.Now()}, "representation", "exact").
+		Eq("user_id", userID.String()).
+		Is("revoked_at", "null").
+		Execute()
+	return err
+}
@@ -0,0 +1,170 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"sort"
+	"time"
+)
+
+// ListRoles describes every role and the permissions it grants.
+func (h *UserHandler) ListRoles(c *fiber.Ctx) error {
+	names := make([]string, 0, len(models.RolePermissions))
+	for name := range models.RolePermissions {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	roles := make([]fiber.Map, len(names))
+	for i, name := range names {
+		roles[i] = fiber.Map{
+			"name":        name,
+			"permissions": models.RolePermissions[name],
+		}
+	}
+
+	return c.JSON(fiber.Map{"roles": roles})
+}
+
+// GetUserRoles lists the roles assigned to a user.
+func (h *UserHandler) GetUserRoles(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
+		})
+	}
+
+	res, _, err := config.GetDBClient().From("user_roles").
+		Select("*", "exact", false).
+		Eq("user_id", id.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch roles",
+		})
+	}
+
+	var roles []models.UserRole
+	if err := json.Unmarshal(res, &roles); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{"roles": roles})
+}
+
+// AssignRole grants a role to a user. Admins can't change their own roles,
+// so nobody can lock themselves out or escalate without a second admin.
+func (h *UserHandler) AssignRole(c *fiber.Ctx) error {
+	actor := c.Locals("user").(*models.User)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
+		})
+	}
+
+	var input struct {
+		Role string `json:"role"`
+	}
+	if err := c.BodyParser(&input); err != nil || !models.IsValidRole(input.Role) {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "unknown role",
+		})
+	}
+
+	if id == actor.ID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "you cannot change your own roles",
+		})
+	}
+
+	_, count, err := config.GetDBClient().From("users").
+		Select("id", "exact", false).
+		Eq("id", id.String()).
+		Execute()
+	if err != nil || count == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrUserNotFound.Error(),
+		})
+	}
+
+	role := models.UserRole{
+		UserID:    id,
+		Role:      input.Role,
+		GrantedBy: &actor.ID,
+		GrantedAt: time.Now(),
+	}
+
+	_, _, err = config.GetDBClient().From("user_roles").
+		Insert(role, true, "user_id,role", "minimal", "").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to assign role",
+		})
+	}
+
+	middleware.InvalidateUser(id)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditRoleAssign,
+		TargetType: "user",
+		TargetID:   id.String(),
+		After:      map[string]interface{}{"role": role.Role},
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(role)
+}
+
+// RemoveRole takes a role away from a user.
+func (h *UserHandler) RemoveRole(c *fiber.Ctx) error {
+	actor := c.Locals("user").(*models.User)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
+		})
+	}
+
+	if id == actor.ID {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": "you cannot change your own roles",
+		})
+	}
+
+	res, _, err := config.GetDBClient().From("user_roles").
+		Delete("representation", "").
+		Eq("user_id", id.String()).
+		Eq("role", c.Params("role")).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to remove role",
+		})
+	}
+
+	var removed []models.UserRole
+	if err := json.Unmarshal(res, &removed); err != nil || len(removed) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "user does not have this role",
+		})
+	}
+
+	middleware.InvalidateUser(id)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditRoleRemove,
+		TargetType: "user",
+		TargetID:   id.String(),
+		Before:     map[string]interface{}{"role": removed[0].Role},
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
@@ -0,0 +1,721 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"errors"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultServiceKeyRateLimit = 60
+	// maxRotationGrace bounds how long a rotated-out key keeps working.
+	maxRotationGrace = 7 * 24 * time.Hour
+)
+
+type ServiceAccountHandler struct {
+	dbClient *postgrest.Client
+}
+
+func NewServiceAccountHandler() *ServiceAccountHandler {
+	return &ServiceAccountHandler{
+		dbClient: config.GetDBClient(),
+	}
+}
+
+// CreateGroup adds a group for a team's service accounts. The owner defaults
+// to the calling admin and must be able to manage keys themselves.
+func (h *ServiceAccountHandler) CreateGroup(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*models.User)
+
+	var input struct {
+		Name    string     `json:"name"`
+		OwnerID *uuid.UUID `json:"owner_id"`
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	name := strings.TrimSpace(input.Name)
+	if name == "" {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "name is required",
+		})
+	}
+
+	ownerID := admin.ID
+	if input.OwnerID != nil && *input.OwnerID != admin.ID {
+		owner, err := fetchUser(*input.OwnerID)
+		if err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": models.ErrInternalServer.Error(),
+			})
+		}
+		if owner == nil || !owner.IsActive {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "owner must be an active user",
+			})
+		}
+		if owner.Roles, err = fetchUserRoleNames(owner.ID); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error": models.ErrInternalServer.Error(),
+			})
+		}
+		if !owner.HasPermission(models.PermKeysManage) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error":      "owner must be an admin who can manage keys",
+				"permission": models.PermKeysManage,
+			})
+		}
+		ownerID = owner.ID
+	}
+
+	res, _, err := h.dbClient.From("service_account_groups").
+		Insert(map[string]interface{}{
+			"name":     name,
+			"owner_id": ownerID,
+		}, false, "", "representation", "").
+		Execute()
+	if err != nil {
+		if isUniqueViolation(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "a group with this name already exists",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to create group",
+		})
+	}
+
+	var groups []models.ServiceAccountGroup
+	if err := json.Unmarshal(res, &groups); err != nil || len(groups) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+	group := groups[0]
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditGroupCreate,
+		TargetType: "service_account_group",
+		TargetID:   group.ID.String(),
+		After:      group,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(group)
+}
+
+func (h *ServiceAccountHandler) ListGroups(c *fiber.Ctx) error {
+	res, count, err := h.dbClient.From("service_account_groups").
+		Select("*", "exact", false).
+		Order("name", &postgrest.OrderOpts{Ascending: true}).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch groups",
+		})
+	}
+
+	var groups []models.ServiceAccountGroup
+	if err := json.Unmarshal(res, &groups); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"groups": groups,
+		"total":  count,
+	})
+}
+
+// serviceKeyInput is what a service account's key is issued with. Scopes are
+// required; the restrictions work as they do on user keys. A key with an
+// organization acts in that organization.
+type serviceKeyInput struct {
+	Scopes           []string   `json:"scopes"`
+	RateLimit        int        `json:"rate_limit"`
+	AllowedCIDRs     []string   `json:"allowed_cidrs"`
+	AllowedReferrers []string   `json:"allowed_referrers"`
+	OrganizationID   *uuid.UUID `json:"organization_id"`
+}
+
+func (in *serviceKeyInput) normalize() error {
+	var err error
+	if in.Scopes, err = utils.NormalizeScopes(in.Scopes); err != nil {
+		return err
+	}
+	if len(in.Scopes) == 0 {
+		return errScopesRequired
+	}
+	if in.AllowedCIDRs, err = utils.NormalizeCIDRs(in.AllowedCIDRs); err != nil {
+		return err
+	}
+	if in.AllowedReferrers, err = utils.NormalizeOriginPatterns(in.AllowedReferrers); err != nil {
+		return err
+	}
+	if in.OrganizationID != nil {
+		org, err := fetchOrganization(*in.OrganizationID)
+		if err != nil {
+			return err
+		}
+		if org == nil {
+			return errUnknownOrganization
+		}
+	}
+	return nil
+}
+
+var (
+	errScopesRequired      = errors.New("service account keys need at least one scope")
+	errUnknownOrganization = errors.New("organization not found")
+)
+
+// CreateServiceAccount adds a service account to a group and issues its
+// first key, which is only ever returned here.
+func (h *ServiceAccountHandler) CreateServiceAccount(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*models.User)
+
+	var input struct {
+		GroupID     uuid.UUID `json:"group_id"`
+		Name        string    `json:"name"`
+		Description string    `json:"description"`
+		serviceKeyInput
+	}
+	if err := c.BodyParser(&input); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid request body",
+		})
+	}
+
+	input.Name = strings.TrimSpace(input.Name)
+	if input.Name == "" || input.GroupID == uuid.Nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "group_id and name are required",
+		})
+	}
+	if err := input.serviceKeyInput.normalize(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	_, count, err := h.dbClient.From("service_account_groups").
+		Select("id", "exact", false).
+		Eq("id", input.GroupID.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if count == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "group not found",
+		})
+	}
+
+	account := models.ServiceAccount{
+		ID:          uuid.New(),
+		GroupID:     input.GroupID,
+		Name:        input.Name,
+		Description: input.Description,
+		CreatedBy:   &admin.ID,
+		CreatedAt:   time.Now(),
+	}
+
+	if _, _, err := h.dbClient.From("service_accounts").
+		Insert(account, false, "", "", "").
+		Execute(); err != nil {
+		if isUniqueViolation(err) {
+			return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+				"error": "the group already has a service account with this name",
+			})
+		}
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to create service account",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditServiceCreate,
+		TargetType: "service_account",
+		TargetID:   account.ID.String(),
+		After:      account,
+	})
+
+	apiKey, key, err := h.issueKey(account, input.serviceKeyInput)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error":           "service account created but its key could not be issued; rotate it to get one",
+			"service_account": account,
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditKeyCreate,
+		TargetType: "api_key",
+		TargetID:   key.ID.String(),
+		After:      key,
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"service_account": account,
+		"key":             apiKey,
+		"key_id":          key.ID,
+		"key_prefix":      key.KeyPrefix,
+	})
+}
+
+// issueKey creates a new active key owned by account.
+func (h *ServiceAccountHandler) issueKey(account models.ServiceAccount, input serviceKeyInput) (string, models.APIKey, error) {
+	apiKey, err := utils.GenerateAPIKey(config.APIKeyEnvironment())
+	if err != nil {
+		return "", models.APIKey{}, err
+	}
+
+	keyHash, hashVersion := utils.HashAPIKey(apiKey)
+	rateLimit := input.RateLimit
+	if rateLimit <= 0 {
+		rateLimit = defaultServiceKeyRateLimit
+	}
+
+	key := models.APIKey{
+		ID:               uuid.New(),
+		ServiceAccountID: &account.ID,
+		OrganizationID:   input.OrganizationID,
+		KeyHash:          keyHash,
+		HashVersion:      hashVersion,
+		KeyPrefix:        utils.KeyDisplayPrefix(apiKey),
+		Environment:      config.APIKeyEnvironment(),
+		Name:             account.Name,
+		CreatedAt:        time.Now(),
+		IsActive:         true,
+		RateLimit:        rateLimit,
+
+		AllowedCIDRs:     input.AllowedCIDRs,
+		AllowedReferrers: input.AllowedReferrers,
+		Scopes:           input.Scopes,
+	}
+
+	if _, _, err := h.dbClient.From("api_keys").
+		Insert(key, false, "", "", "").
+		Execute(); err != nil {
+		return "", models.APIKey{}, err
+	}
+	return apiKey, key, nil
+}
+
+// ListServiceAccounts lists service accounts by name. Filters: group_id and
+// disabled.
+func (h *ServiceAccountHandler) ListServiceAccounts(c *fiber.Ctx) error {
+	page := c.QueryInt("page", 1)
+	limit := c.QueryInt("limit", 20)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	query := h.dbClient.From("service_accounts").Select("*", "exact", false)
+
+	if groupID := c.Query("group_id"); groupID != "" {
+		id, err := uuid.Parse(groupID)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid group ID",
+			})
+		}
+		query = query.Eq("group_id", id.String())
+	}
+
+	if disabled := c.Query("disabled"); disabled != "" {
+		isDisabled, err := strconv.ParseBool(disabled)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "disabled must be true or false",
+			})
+		}
+		if isDisabled {
+			query = query.Not("disabled_at", "is", "null")
+		} else {
+			query = query.Is("disabled_at", "null")
+		}
+	}
+
+	res, count, err := query.
+		Order("name", &postgrest.OrderOpts{Ascending: true}).
+		Range(offset, offset+limit-1, "").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch service accounts",
+		})
+	}
+
+	var accounts []models.ServiceAccount
+	if err := json.Unmarshal(res, &accounts); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	return c.JSON(fiber.Map{
+		"service_accounts": accounts,
+		"total":            count,
+		"page":             page,
+		"limit":            limit,
+	})
+}
+
+// GetServiceAccount returns an account with its keys and how many requests
+// it has made.
+func (h *ServiceAccountHandler) GetServiceAccount(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid service account ID",
+		})
+	}
+
+	account, err := fetchServiceAccount(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if account == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrServiceAccountNotFound.Error(),
+		})
+	}
+
+	res, _, err := h.dbClient.From("api_keys").
+		Select(adminKeyColumns, "", false).
+		Eq("service_account_id", id.String()).
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch API keys",
+		})
+	}
+
+	var keys []models.APIKey
+	if err := json.Unmarshal(res, &keys); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	_, requests, err := h.dbClient.From("model_requests").
+		Select("id", "exact", true).
+		Eq("service_account_id", id.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to count requests",
+		})
+	}
+
+	var lastUsed *time.Time
+	for _, key := range keys {
+		if key.LastUsed != nil && (lastUsed == nil || key.LastUsed.After(*lastUsed)) {
+			lastUsed = key.LastUsed
+		}
+	}
+
+	return c.JSON(fiber.Map{
+		"service_account": account,
+		"keys":            keys,
+		"usage": fiber.Map{
+			"requests":  requests,
+			"last_used": lastUsed,
+		},
+	})
+}
+
+// DisableServiceAccount stops all of an account's keys from working. The keys
+// themselves are left alone so EnableServiceAccount can bring them back.
+func (h *ServiceAccountHandler) DisableServiceAccount(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*models.User)
+	return h.setDisabled(c, map[string]interface{}{
+		"disabled_at": time.Now(),
+		"disabled_by": admin.ID,
+	}, models.AuditServiceDisable)
+}
+
+func (h *ServiceAccountHandler) EnableServiceAccount(c *fiber.Ctx) error {
+	return h.setDisabled(c, map[string]interface{}{
+		"disabled_at": nil,
+		"disabled_by": nil,
+	}, models.AuditServiceEnable)
+}
+
+func (h *ServiceAccountHandler) setDisabled(c *fiber.Ctx, update map[string]interface{}, action string) error {
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid service account ID",
+		})
+	}
+
+	before, err := fetchServiceAccount(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if before == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrServiceAccountNotFound.Error(),
+		})
+	}
+
+	res, _, err := h.dbClient.From("service_accounts").
+		Update(update, "representation", "").
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to update service account",
+		})
+	}
+
+	var after []models.ServiceAccount
+	if err := json.Unmarshal(res, &after); err != nil || len(after) == 0 {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	if before.IsDisabled() != after[0].IsDisabled() {
+		middleware.Audit(c, middleware.AuditEntry{
+			Action:     action,
+			TargetType: "service_account",
+			TargetID:   id.String(),
+			Before:     before,
+			After:      after[0],
+		})
+	}
+
+	return c.JSON(after[0])
+}
+
+// RotateServiceAccount issues a new key and retires the account's current
+// ones. With a grace duration the old keys keep working until it passes, so
+// the service can be redeployed with the new key first; without one they are
+// revoked at once. Scopes and restrictions carry over from the newest key
+// unless given.
+func (h *ServiceAccountHandler) RotateServiceAccount(c *fiber.Ctx) error {
+	admin := c.Locals("user").(*models.User)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid service account ID",
+		})
+	}
+
+	var input struct {
+		Grace  string    `json:"grace"`
+		Scopes *[]string `json:"scopes"`
+	}
+	if len(c.Body()) > 0 {
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+	}
+
+	var grace time.Duration
+	if input.Grace != "" {
+		grace, err = time.ParseDuration(input.Grace)
+		if err != nil || grace < 0 || grace > maxRotationGrace {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "grace must be a duration of at most 168h",
+			})
+		}
+	}
+
+	account, err := fetchServiceAccount(id)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if account == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrServiceAccountNotFound.Error(),
+		})
+	}
+	if account.IsDisabled() {
+		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
+			"error": "service account is disabled",
+		})
+	}
+
+	res, _, err := h.dbClient.From("api_keys").
+		Select("id, organization_id, scopes, rate_limit, allowed_cidrs, allowed_referrers", "", false).
+		Eq("service_account_id", id.String()).
+		Eq("is_active", "true").
+		Order("created_at", &postgrest.OrderOpts{Ascending: false}).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch API keys",
+		})
+	}
+
+	var current []models.APIKey
+	if err := json.Unmarshal(res, &current); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	var next serviceKeyInput
+	if len(current) > 0 {
+		next = serviceKeyInput{
+			Scopes:           current[0].Scopes,
+			RateLimit:        current[0].RateLimit,
+			AllowedCIDRs:     current[0].AllowedCIDRs,
+			AllowedReferrers: current[0].AllowedReferrers,
+			OrganizationID:   current[0].OrganizationID,
+		}
+	}
+	if input.Scopes != nil {
+		next.Scopes = *input.Scopes
+	}
+	if err := next.normalize(); err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": err.Error(),
+		})
+	}
+
+	apiKey, key, err := h.issueKey(*account, next)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to issue API key",
+		})
+	}
+
+	retired := make([]uuid.UUID, len(current))
+	retiredIDs := make([]string, len(current))
+	for i, old := range current {
+		retired[i] = old.ID
+		retiredIDs[i] = old.ID.String()
+	}
+
+	var expiresAt *time.Time
+	if len(retired) > 0 {
+		update := revocation(&admin.ID, "rotated")
+		if grace > 0 {
+			t := time.Now().Add(grace)
+			expiresAt = &t
+			update = map[string]interface{}{"expires_at": t}
+		}
+
+		// Keys already rotated out with an earlier grace keep their expiry
+		query := h.dbClient.From("api_keys").
+			Update(update, "", "").
+			In("id", retiredIDs)
+		if grace > 0 {
+			query = query.Is("expires_at", "null")
+		}
+		if _, _, err := query.Execute(); err != nil {
+			return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+				"error":      "new key issued but the old keys could not be retired",
+				"key":        apiKey,
+				"key_id":     key.ID,
+				"key_prefix": key.KeyPrefix,
+			})
+		}
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditServiceRotate,
+		TargetType: "service_account",
+		TargetID:   id.String(),
+		After: map[string]interface{}{
+			"key_id":          key.ID,
+			"scopes":          key.Scopes,
+			"retired_key_ids": retired,
+			"expires_at":      expiresAt,
+		},
+	})
+
+	return c.Status(fiber.StatusCreated).JSON(fiber.Map{
+		"key":             apiKey,
+		"key_id":          key.ID,
+		"key_prefix":      key.KeyPrefix,
+		"retired_key_ids": retired,
+		"retired_at":      expiresAt,
+	})
+}
+
+func fetchServiceAccount(id uuid.UUID) (*models.ServiceAccount, error) {
+	res, _, err := config.GetDBClient().From("service_accounts").
+		Select("*", "", false).
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []models.ServiceAccount
+	if err := json.Unmarshal(res, &accounts); err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+	return &accounts[0], nil
+}
+
+// keyContact returns who to tell about a key: its owner, or for a service
+// account's key the admin who owns the account's group.
+func keyContact(key models.APIKey) (*uuid.UUID, error) {
+	if key.UserID != nil || key.ServiceAccountID == nil {
+		return key.UserID, nil
+	}
+
+	res, _, err := config.GetDBClient().From("service_accounts").
+		Select("service_account_groups(owner_id)", "", false).
+		Eq("id", key.ServiceAccountID.String()).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []struct {
+		Group struct {
+			OwnerID *uuid.UUID `json:"owner_id"`
+		} `json:"service_account_groups"`
+	}
+	if err := json.Unmarshal(res, &rows); err != nil {
+		return nil, err
+	}
+	if len(rows) == 0 {
+		return nil, nil
+	}
+	return rows[0].Group.OwnerID, nil
+}
+
+// isUniqueViolation reports whether a PostgREST error is Postgres' 23505.
+func isUniqueViolation(err error) bool {
+	return strings.HasPrefix(err.Error(), "(23505)")
+}
@@ -0,0 +1,186 @@
+package handlers
+
+import (
+	"api/config"
+	"api/middleware"
+	"api/models"
+	"api/utils"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
+	"log"
+	"time"
+)
+
+// sessionIdleExpiry hides sessions that haven't been used for this long;
+// their refresh tokens have long expired.
+const sessionIdleExpiry = 30 * 24 * time.Hour
+
+type userSession struct {
+	ID         uuid.UUID  `json:"id"`
+	UserID     uuid.UUID  `json:"user_id"`
+	Device     string     `json:"device"`
+	IP         string     `json:"ip"`
+	UserAgent  string     `json:"user_agent"`
+	AAL        string     `json:"aal"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastSeenAt time.Time  `json:"last_seen_at"`
+	RevokedAt  *time.Time `json:"revoked_at,omitempty"`
+}
+
+// ListSessions lists the user's active sessions, most recently used first.
+// The one making the request is flagged as current.
+func (h *AuthHandler) ListSessions(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+	claims := c.Locals("claims").(*utils.Claims)
+
+	res, _, err := config.GetDBClient().From("user_sessions").
+		Select("*", "", false).
+		Eq("user_id", user.ID.String()).
+		Is("revoked_at", "null").
+		Gt("last_seen_at", time.Now().Add(-sessionIdleExpiry).UTC().Format(time.RFC3339)).
+		Order("last_seen_at", &postgrest.OrderOpts{Ascending: false}).
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to fetch sessions",
+		})
+	}
+
+	var rows []userSession
+	if err := json.Unmarshal(res, &rows); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to parse response",
+		})
+	}
+
+	sessions := make([]fiber.Map, len(rows))
+	for i, session := range rows {
+		sessions[i] = fiber.Map{
+			"id":           session.ID,
+			"device":       session.Device,
+			"ip":           session.IP,
+			"user_agent":   session.UserAgent,
+			"aal":          session.AAL,
+			"created_at":   session.CreatedAt,
+			"last_seen_at": session.LastSeenAt,
+			"current":      session.ID.String() == claims.SessionID,
+		}
+	}
+
+	return c.JSON(fiber.Map{"sessions": sessions})
+}
+
+// RevokeSession signs one of the user's sessions out. Its access tokens stop
+// working on the next request and gotrue deletes the session, so its refresh
+// tokens can't be exchanged here or at gotrue directly.
+func (h *AuthHandler) RevokeSession(c *fiber.Ctx) error {
+	user := c.Locals("user").(*models.User)
+
+	id, err := uuid.Parse(c.Params("id"))
+	if err != nil {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid session ID",
+		})
+	}
+
+	res, _, err := config.GetDBClient().From("user_sessions").
+		Select("*", "", false).
+		Eq("id", id.String()).
+		Eq("user_id", user.ID.String()).
+		Is("revoked_at", "null").
+		Execute()
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke session",
+		})
+	}
+
+	var found []userSession
+	if err := json.Unmarshal(res, &found); err != nil || len(found) == 0 {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": "session not found",
+		})
+	}
+
+	// The row is only marked once the session is blacklisted, so a failed
+	// attempt can be retried.
+	if err := middleware.RevokeSession(id); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke session",
+		})
+	}
+
+	if err := endAuthSession(id); err != nil {
+		log.Printf("failed to end gotrue session %s: %v", id, err)
+	}
+
+	if err := revokeSessionRefreshTokens(id.String()); err != nil {
+		log.Printf("failed to revoke refresh tokens for session %s: %v", id, err)
+	}
+
+	if err := markSessionsRevoked(user.ID, id.String()); err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": "failed to revoke session",
+		})
+	}
+
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditSessionRevoke,
+		TargetType: "session",
+		TargetID:   id.String(),
+		Before:     map[string]interface{}{"device": found[0].Device, "ip": found[0].IP},
+	})
+
+	return c.SendStatus(fiber.StatusNoContent)
+}
+
+// markSessionsRevoked flags sessions as revoked so they drop out of the list.
+// With no sessionID every session of the user is marked.
+func markSessionsRevoked(userID uuid.UUID, sessionID string) error {
+	query := config.GetDBClient().From("user_sessions").
+		Update(map[string]interface{}{"revoked_at": time.Now()}, "minimal", "").
+		Eq("user_id", userID.String()).
+		Is("revoked_at", "null")
+	if sessionID != "" {
+		query = query.Eq("id", sessionID)
+	}
+
+	_, _, err := query.Execute()
+	return err
+}
+
+// revokeOtherSessions blacklists every tracked session of the user except
+// the current one and marks them revoked.
+func revokeOtherSessions(userID uuid.UUID, currentSessionID string) error {
+	res, _, err := config.GetDBClient().From("user_sessions").
+		Select("id", "", false).
+		Eq("user_id", userID.String()).
+		Is("revoked_at", "null").
+		Execute()
+	if err != nil {
+		return err
+	}
+
+	var rows []userSession
+	if err := json.Unmarshal(res, &rows); err != nil {
+		return err
+	}
+
+	for _, session := range rows {
+		if session.ID.String() == currentSessionID {
+			continue
+		}
+		if err := middleware.RevokeSession(session.ID); err != nil {
+			return err
+		}
+		if err := revokeSessionRefreshTokens(session.ID.String()); err != nil {
+			return err
+		}
+		if err := markSessionsRevoked(userID, session.ID.String()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,184 @@
+package handlers
+
+import (
+	"api/config"
+	"api/utils"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"log"
+	"strings"
+	"time"
+)
+
+// SignupAttempt is what pre-signup hooks get to look at.
+type SignupAttempt struct {
+	Email     string
+	IP        string
+	UserAgent string
+	// Provider is "email" for password signups and the OAuth provider's
+	// name otherwise.
+	Provider     string
+	CaptchaToken string
+}
+
+// PreSignupHook vets an attempt before an account is created, e.g. by
+// verifying a CAPTCHA or rejecting disposable email addresses. Return a
+// *SignupRejectedError to turn the user away; any other error fails the
+// signup as unavailable, so a broken check never lets everyone in.
+type PreSignupHook interface {
+	Name() string
+	CheckSignup(ctx context.Context, attempt SignupAttempt) error
+}
+
+// SignupRejectedError is a hook's verdict against an attempt. Reason is shown
+// to the user.
+type SignupRejectedError struct {
+	Reason string
+}
+
+func (e *SignupRejectedError) Error() string {
+	return e.Reason
+}
+
+var preSignupHooks = []PreSignupHook{domainPolicyHook{}}
+
+// RegisterPreSignupHook adds a hook. Hooks run in registration order, after
+// the built-in email domain policy. Register them before the server starts.
+func RegisterPreSignupHook(hook PreSignupHook) {
+	preSignupHooks = append(preSignupHooks, hook)
+}
+
+const signupHookTimeout = 5 * time.Second
+
+func runPreSignupHooks(attempt SignupAttempt) error {
+	ctx, cancel := context.WithTimeout(context.Background(), signupHookTimeout)
+	defer cancel()
+
+	for _, hook := range preSignupHooks {
+		if err := hook.CheckSignup(ctx, attempt); err != nil {
+			var rejected *SignupRejectedError
+			if !errors.As(err, &rejected) {
+				log.Printf("pre-signup hook %s failed: %v", hook.Name(), err)
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// domainPolicyHook applies SIGNUP_ALLOWED_DOMAINS and SIGNUP_BLOCKED_DOMAINS.
+type domainPolicyHook struct{}
+
+func (domainPolicyHook) Name() string {
+	return "domain-policy"
+}
+
+func (domainPolicyHook) CheckSignup(_ context.Context, attempt SignupAttempt) error {
+	cfg := config.GetSignupConfig()
+
+	at := strings.LastIndex(attempt.Email, "@")
+	if at < 0 {
+		return &SignupRejectedError{Reason: "invalid email address"}
+	}
+	domain := strings.ToLower(attempt.Email[at+1:])
+
+	if domainListed(domain, cfg.BlockedDomains) {
+		return &SignupRejectedError{Reason: "signups from this email domain are not allowed"}
+	}
+	if len(cfg.AllowedDomains) > 0 && !domainListed(domain, cfg.AllowedDomains) {
+		return &SignupRejectedError{Reason: "signups from this email domain are not allowed"}
+	}
+	return nil
+}
+
+func domainListed(domain string, list []string) bool {
+	for _, entry := range list {
+		if domain == entry || strings.HasSuffix(domain, "."+entry) {
+			return true
+		}
+	}
+	return false
+}
+
+type signupInvite struct {
+	ID        uuid.UUID  `json:"id"`
+	Email     *string    `json:"email"`
+	CreatedBy *uuid.UUID `json:"created_by"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	UsedAt    *time.Time `json:"used_at"`
+	UsedBy    *uuid.UUID `json:"used_by"`
+	RevokedAt *time.Time `json:"revoked_at"`
+}
+
+var errInvalidInvite = &SignupRejectedError{Reason: "invalid or expired invite"}
+
+// claimInvite marks an invite as used by email. Only one concurrent claim can
+// win. The caller releases the invite if the signup then fails.
+func claimInvite(token, email string) (*signupInvite, error) {
+	if token == "" {
+		return nil, &SignupRejectedError{Reason: "an invite is required to sign up"}
+	}
+
+	res, _, err := config.GetDBClient().From("signup_invites").
+		Update(map[string]interface{}{"used_at": time.Now()}, "representation", "").
+		Eq("token_hash", utils.HashInviteToken(token)).
+		Is("used_at", "null").
+		Is("revoked_at", "null").
+		Gt("expires_at", time.Now().UTC().Format(time.RFC3339)).
+		Or(fmt.Sprintf(`email.is.null,email.eq."%s"`, email), "").
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var invites []signupInvite
+	if err := json.Unmarshal(res, &invites); err != nil {
+		return nil, err
+	}
+	if len(invites) == 0 {
+		return nil, errInvalidInvite
+	}
+	return &invites[0], nil
+}
+
+func releaseInvite(id uuid.UUID) {
+	_, _, err := config.GetDBClient().From("signup_invites").
+		Update(map[string]interface{}{"used_at": nil}, "minimal", "").
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		log.Printf("failed to release invite %s: %v", id, err)
+	}
+}
+
+func recordInviteUse(id, userID uuid.UUID) {
+	_, _, err := config.GetDBClient().From("signup_invites").
+		Update(map[string]interface{}{"used_by": userID}, "minimal", "").
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		log.Printf("failed to record use of invite %s: %v", id, err)
+	}
+}
+
+// admitSignup applies the signup mode, the hooks and, in invite mode, claims
+// the invite. A non-nil invite must be released if account creation fails.
+func admitSignup(attempt SignupAttempt, inviteToken string) (*signupInvite, error) {
+	mode := config.GetSignupConfig().Mode
+	if mode == config.SignupModeClosed {
+		return nil, &SignupRejectedError{Reason: "signups are closed"}
+	}
+
+	if err := runPreSignupHooks(attempt); err != nil {
+		return nil, err
+	}
+
+	if mode != config.SignupModeInvite {
+		return nil, nil
+	}
+	return claimInvite(inviteToken, attempt.Email)
+}
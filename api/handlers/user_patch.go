@@ -0,0 +1,114 @@
+package handlers
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"strings"
+)
+
+const mergePatchContentType = "application/merge-patch+json"
+
+// userField validates one field of a merge patch and returns the value to
+// store. A JSON null arrives as the literal "null".
+type userField func(raw json.RawMessage) (interface{}, error)
+
+// selfEditableFields are what users may change on their own account. Email
+// changes go through PATCH /api/me so gotrue can confirm the new address.
+var selfEditableFields = map[string]userField{
+	"display_name": displayNameField,
+}
+
+// adminEditableFields are what users:manage may change on any account. Admin
+// rights come from roles, so is_admin is not writable here either.
+var adminEditableFields = map[string]userField{
+	"display_name": displayNameField,
+	"is_active":    boolField,
+}
+
+// userFieldNames are the users columns a patch may name, editable or not.
+var userFieldNames = map[string]struct{}{
+	"id": {}, "email": {}, "created_at": {}, "last_login": {}, "is_admin": {}, "is_active": {},
+	"failed_login_attempts": {}, "locked_until": {}, "display_name": {},
+	"deletion_requested_at": {}, "deletion_scheduled_for": {}, "signup_pending": {},
+}
+
+// patchError is a rejected merge patch and the status to answer with.
+type patchError struct {
+	status  int
+	message string
+}
+
+func (e *patchError) Error() string {
+	return e.message
+}
+
+// parseUserPatch reads an RFC 7396 JSON Merge Patch and checks every member
+// against allowed. Fields users know about but may not change get a 403, so
+// the answer doesn't depend on which endpoint was guessed.
+func parseUserPatch(c *fiber.Ctx, allowed map[string]userField) (map[string]interface{}, *patchError) {
+	contentType := strings.TrimSpace(strings.SplitN(c.Get(fiber.HeaderContentType), ";", 2)[0])
+	if contentType != mergePatchContentType && contentType != fiber.MIMEApplicationJSON {
+		return nil, &patchError{fiber.StatusUnsupportedMediaType, "content type must be " + mergePatchContentType}
+	}
+
+	body := bytes.TrimSpace(c.Body())
+	if len(body) == 0 || body[0] != '{' {
+		return nil, &patchError{fiber.StatusBadRequest, "patch must be a JSON object"}
+	}
+
+	var members map[string]json.RawMessage
+	if err := json.Unmarshal(body, &members); err != nil {
+		return nil, &patchError{fiber.StatusBadRequest, "invalid request body"}
+	}
+	if len(members) == 0 {
+		return nil, &patchError{fiber.StatusBadRequest, "patch is empty"}
+	}
+
+	changes := make(map[string]interface{}, len(members))
+	for name, raw := range members {
+		field, ok := allowed[name]
+		if !ok {
+			if _, known := userFieldNames[name]; known {
+				return nil, &patchError{fiber.StatusForbidden, fmt.Sprintf("%s cannot be changed", name)}
+			}
+			return nil, &patchError{fiber.StatusBadRequest, fmt.Sprintf("unknown field %s", name)}
+		}
+
+		value, err := field(raw)
+		if err != nil {
+			return nil, &patchError{fiber.StatusBadRequest, fmt.Sprintf("%s: %v", name, err)}
+		}
+		changes[name] = value
+	}
+	return changes, nil
+}
+
+func displayNameField(raw json.RawMessage) (interface{}, error) {
+	if string(raw) == "null" {
+		return nil, nil
+	}
+
+	var value string
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return nil, fmt.Errorf("must be a string")
+	}
+	return normalizeDisplayName(value)
+}
+
+func normalizeDisplayName(value string) (string, error) {
+	value = strings.TrimSpace(value)
+	if len(value) > maxDisplayNameLength {
+		return "", fmt.Errorf("must be at most %d characters", maxDisplayNameLength)
+	}
+	return value, nil
+}
+
+func boolField(raw json.RawMessage) (interface{}, error) {
+	var value bool
+	if err := json.Unmarshal(raw, &value); err != nil || string(raw) == "null" {
+		return nil, fmt.Errorf("must be true or false")
+	}
+	return value, nil
+}
@@ -2,11 +2,18 @@ package handlers
 
 import (
 	"api/config"
+	"api/middleware"
 	"api/models"
 	"encoding/json"
+	"fmt"
 	"github.com/gofiber/fiber/v2"
 	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
 	"github.com/supabase-community/supabase-go"
+	"log"
+	"strconv"
+	"strings"
+	"time"
 )
 
 type UserHandler struct {
@@ -38,7 +45,7 @@ func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 
 	if err == nil && count > 0 {
 		return c.Status(fiber.StatusConflict).JSON(fiber.Map{
-			"error": models.ErrUserAlreadyExists.Error,
+			"error": models.ErrUserAlreadyExists.Error(),
 		})
 	}
 
@@ -61,32 +68,33 @@ func (h *UserHandler) CreateUser(c *fiber.Ctx) error {
 	})
 }
 
+// GetUser returns a user. Users may read their own account; anyone else's
+// needs users:read.
 func (h *UserHandler) GetUser(c *fiber.Ctx) error {
-	userID := c.Params("id")
-	id, err := uuid.Parse(userID)
+	id, err := uuid.Parse(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": models.ErrUserNotFound.Error,
+			"error": "invalid user ID",
 		})
 	}
-	dbClient := config.GetDBClient()
-	result, count, err := dbClient.From("users").
-		Select("*", "exact", false).
-		Eq("id", id.String()).
-		Execute()
 
-	if err != nil || count == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": models.ErrUserNotFound.Error,
+	if !canActOn(c, id, models.PermUsersRead) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": models.ErrNotAccountOwner.Error(),
 		})
 	}
 
-	var user models.User
-	if err := json.Unmarshal(result, &user); err != nil {
+	user, err := fetchUser(id)
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
 			"error": "Failed to parse response",
 		})
 	}
+	if user == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrUserNotFound.Error(),
+		})
+	}
 
 	return c.Status(fiber.StatusOK).JSON(models.UserResponse{
 		ID:       user.ID,
@@ -96,15 +104,143 @@ func (h *UserHandler) GetUser(c *fiber.Ctx) error {
 	})
 }
 
+// canActOn reports whether the caller may act on the account id: their own,
+// or anyone's when they hold perm.
+func canActOn(c *fiber.Ctx, id uuid.UUID, perm string) bool {
+	user := c.Locals("user").(*models.User)
+	return user.ID == id || user.HasPermission(perm)
+}
+
+func fetchUser(id uuid.UUID) (*models.User, error) {
+	result, _, err := config.GetDBClient().From("users").
+		Select("*", "", false).
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var users []models.User
+	if err := json.Unmarshal(result, &users); err != nil {
+		return nil, err
+	}
+	if len(users) == 0 {
+		return nil, nil
+	}
+	return &users[0], nil
+}
+
+// userSortColumns are the columns ListUsers can sort by.
+var userSortColumns = map[string]bool{
+	"email":      true,
+	"created_at": true,
+	"last_login": true,
+}
+
+// userListItem adds the fields admins filter on to UserResponse.
+type userListItem struct {
+	models.UserResponse
+	CreatedAt   time.Time  `json:"created_at"`
+	LastLogin   *time.Time `json:"last_login"`
+	LockedUntil *time.Time `json:"locked_until"`
+}
+
+// ListUsers searches users. Filters: q (email substring), is_active,
+// is_admin, locked, role, created_after/created_before and
+// last_login_after/last_login_before. sort takes a column from
+// userSortColumns, prefixed with "-" for descending.
 func (h *UserHandler) ListUsers(c *fiber.Ctx) error {
 	// pagination
 	page := c.QueryInt("page", 1)
 	limit := c.QueryInt("limit", 10)
+	if page < 1 {
+		page = 1
+	}
+	if limit < 1 || limit > 100 {
+		limit = 10
+	}
 	offset := (page - 1) * limit
 
-	dbClient := config.GetDBClient()
-	res, count, err := dbClient.From("users").
-		Select("*", "exact", false).
+	columns := "*"
+	if role := c.Query("role"); role != "" {
+		if !models.IsValidRole(role) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "unknown role",
+			})
+		}
+		columns = "*, user_roles!inner(role)"
+	}
+
+	query := config.GetDBClient().From("users").Select(columns, "exact", false)
+
+	if role := c.Query("role"); role != "" {
+		query = query.Eq("user_roles.role", role)
+	}
+
+	if q := c.Query("q"); q != "" {
+		query = query.Ilike("email", "*"+escapeLike(q)+"*")
+	}
+
+	for _, param := range []string{"is_active", "is_admin"} {
+		if value := c.Query(param); value != "" {
+			b, err := strconv.ParseBool(value)
+			if err != nil {
+				return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+					"error": param + " must be true or false",
+				})
+			}
+			query = query.Eq(param, strconv.FormatBool(b))
+		}
+	}
+
+	if value := c.Query("locked"); value != "" {
+		locked, err := strconv.ParseBool(value)
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "locked must be true or false",
+			})
+		}
+		now := time.Now().UTC().Format(time.RFC3339)
+		if locked {
+			query = query.Gt("locked_until", now)
+		} else {
+			query = query.Or(fmt.Sprintf(`locked_until.is.null,locked_until.lte."%s"`, now), "")
+		}
+	}
+
+	for _, column := range []string{"created", "last_login"} {
+		after, err := timeQuery(c, column+"_after")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		before, err := timeQuery(c, column+"_before")
+		if err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": err.Error(),
+			})
+		}
+		if column == "created" {
+			column = "created_at"
+		}
+		query = timeRange(query, column, "gte", after, before)
+	}
+
+	sortColumn, ascending := "created_at", false
+	if sort := c.Query("sort"); sort != "" {
+		ascending = !strings.HasPrefix(sort, "-")
+		sortColumn = strings.TrimPrefix(sort, "-")
+		if !userSortColumns[sortColumn] {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "sort must be one of email, created_at, last_login",
+			})
+		}
+	}
+
+	res, count, err := query.
+		Order(sortColumn, &postgrest.OrderOpts{Ascending: ascending}).
+		Order("id", &postgrest.OrderOpts{Ascending: true}).
 		Range(offset, offset+limit-1, "").
 		Execute()
 
@@ -121,13 +257,18 @@ func (h *UserHandler) ListUsers(c *fiber.Ctx) error {
 		})
 	}
 
-	response := make([]models.UserResponse, len(users))
+	response := make([]userListItem, len(users))
 	for i, user := range users {
-		response[i] = models.UserResponse{
-			ID:       user.ID,
-			Email:    user.Email,
-			IsAdmin:  user.IsAdmin,
-			IsActive: user.IsActive,
+		response[i] = userListItem{
+			UserResponse: models.UserResponse{
+				ID:       user.ID,
+				Email:    user.Email,
+				IsAdmin:  user.IsAdmin,
+				IsActive: user.IsActive,
+			},
+			CreatedAt:   user.CreatedAt,
+			LastLogin:   user.LastLogin,
+			LockedUntil: user.LockedUntil,
 		}
 	}
 
@@ -139,161 +280,137 @@ func (h *UserHandler) ListUsers(c *fiber.Ctx) error {
 	})
 }
 
+// escapeLike makes a search term match literally in an ilike filter.
+func escapeLike(term string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`, "*", "").Replace(term)
+}
+
+// UpdateUser applies a JSON Merge Patch to the caller's own account, limited
+// to selfEditableFields.
 func (h *UserHandler) UpdateUser(c *fiber.Ctx) error {
-	userId := c.Params("id")
-	id, err := uuid.Parse(userId)
+	id, err := uuid.Parse(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": models.ErrInvalidCredentials.Error,
-		})
-	}
-
-	var updateData models.User
-	if err := c.BodyParser(&updateData); err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": "Invalid Body request",
+			"error": "invalid user ID",
 		})
 	}
 
-	dbClient := config.GetDBClient()
-	_, count, err := dbClient.From("users").
-		Select("*", "exact", false).
-		Eq("id", id.String()).
-		Execute()
-
-	if err != nil || count == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": models.ErrUserNotFound.Error,
+	user := c.Locals("user").(*models.User)
+	if user.ID != id {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": models.ErrNotAccountOwner.Error(),
 		})
 	}
 
-	_, _, err = dbClient.From("users").
-		Update(updateData, "representation", "exact").
-		Eq("id", id.String()).
-		Execute()
+	return patchUser(c, id, selfEditableFields)
+}
 
+// AdminUpdateUser applies a JSON Merge Patch to any account, limited to
+// adminEditableFields. The route requires users:manage.
+func (h *UserHandler) AdminUpdateUser(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
 	if err != nil {
-		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to update user",
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error": "invalid user ID",
 		})
 	}
 
-	return c.SendStatus(fiber.StatusOK)
+	return patchUser(c, id, adminEditableFields)
 }
 
-func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
-	userId := c.Params("id")
-	id, err := uuid.Parse(userId)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": models.ErrInvalidCredentials.Error,
+func patchUser(c *fiber.Ctx, id uuid.UUID, allowed map[string]userField) error {
+	changes, perr := parseUserPatch(c, allowed)
+	if perr != nil {
+		return c.Status(perr.status).JSON(fiber.Map{
+			"error": perr.message,
 		})
 	}
 
-	// using Soft delete by turning Is_Active to False instead of Hard deleting
-	dbClient := config.GetDBClient()
-	updateData := map[string]interface{}{"is_active": false}
-	_, _, err = dbClient.From("users").
-		Update(updateData, "representation", "exact").
-		Eq("id", id.String()).
-		Execute()
-
+	before, err := fetchUser(id)
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to delete user",
+			"error": "Failed to parse response",
 		})
 	}
-
-	return c.SendStatus(fiber.StatusOK)
-}
-
-func (h *UserHandler) UpdateLoginAttempts(c *fiber.Ctx) error {
-	userId := c.Params("id")
-	id, err := uuid.Parse(userId)
-	if err != nil {
-		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": models.ErrInvalidCredentials.Error,
+	if before == nil {
+		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
+			"error": models.ErrUserNotFound.Error(),
 		})
 	}
 
-	dbClient := config.GetDBClient()
-	res, count, err := dbClient.From("users").
-		Select("failed_login_attempts", "exact", false).
+	res, _, err := config.GetDBClient().From("users").
+		Update(changes, "representation", "").
 		Eq("id", id.String()).
 		Execute()
-
-	if err != nil || count == 0 {
-		return c.Status(fiber.StatusNotFound).JSON(fiber.Map{
-			"error": models.ErrUserNotFound.Error,
-		})
-	}
-
-	var user models.User
-	if err := json.Unmarshal(res, &user); err != nil {
+	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to parse response",
+			"error": "failed to update user",
 		})
 	}
 
-	updateData := map[string]interface{}{
-		"failed_login_attempts": user.FailedLoginAttempts + 1,
-		"is_active":             user.FailedLoginAttempts < 4,
-	}
-
-	_, _, err = dbClient.From("users").
-		Update(updateData, "representation", "exact").
-		Eq("id", id.String()).
-		Execute()
-
-	if err != nil {
+	var after []models.User
+	if err := json.Unmarshal(res, &after); err != nil || len(after) == 0 {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to update login attempts",
+			"error": "Failed to parse response",
 		})
 	}
 
-	return c.SendStatus(fiber.StatusOK)
+	middleware.InvalidateUser(id)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserUpdate,
+		TargetType: "user",
+		TargetID:   id.String(),
+		Before:     before,
+		After:      after[0],
+	})
+
+	return c.JSON(models.UserResponse{
+		ID:       after[0].ID,
+		Email:    after[0].Email,
+		IsAdmin:  after[0].IsAdmin,
+		IsActive: after[0].IsActive,
+	})
 }
 
-func (h *UserHandler) ResetLoginAttempts(c *fiber.Ctx) error {
-	userId := c.Params("id")
-	id, err := uuid.Parse(userId)
+// DeleteUser deactivates an account. Users may deactivate their own; anyone
+// else's needs users:manage.
+func (h *UserHandler) DeleteUser(c *fiber.Ctx) error {
+	id, err := uuid.Parse(c.Params("id"))
 	if err != nil {
 		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-			"error": models.ErrInvalidCredentials.Error,
+			"error": "invalid user ID",
 		})
 	}
 
-	updateDate := map[string]interface{}{
-		"failed_login_attempts": 0,
-		"last_login":            "NOW()",
+	if !canActOn(c, id, models.PermUsersManage) {
+		return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+			"error": models.ErrNotAccountOwner.Error(),
+		})
 	}
 
+	// using Soft delete by turning Is_Active to False instead of Hard deleting
 	dbClient := config.GetDBClient()
+	updateData := map[string]interface{}{"is_active": false}
 	_, _, err = dbClient.From("users").
-		Update(updateDate, "representation", "exact").
+		Update(updateData, "representation", "exact").
 		Eq("id", id.String()).
 		Execute()
 
 	if err != nil {
 		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
-			"error": "failed to reset login attempts",
+			"error": "failed to delete user",
 		})
 	}
 
-	return c.SendStatus(fiber.StatusOK)
-}
-
-// i think that i need to change the c.Locals('user') to 'token'
-func (h *UserHandler) AdminUpdateUser(c *fiber.Ctx) error {
-	reqUserData := c.Locals("user")
-	reqUser, ok := reqUserData.(models.User)
-	if !ok || !reqUser.IsAdmin {
-		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error": models.ErrUnauthorized.Error,
-		})
-	}
+	middleware.InvalidateUser(id)
+	middleware.Audit(c, middleware.AuditEntry{
+		Action:     models.AuditUserDeactivate,
+		TargetType: "user",
+		TargetID:   id.String(),
+		After:      updateData,
+	})
 
-	return h.UpdateUser(c)
+	return c.SendStatus(fiber.StatusOK)
 }
 
 func (h *UserHandler) SignIn(c *fiber.Ctx) error {
@@ -307,18 +424,56 @@ func (h *UserHandler) SignIn(c *fiber.Ctx) error {
 			"error": "Invalid request body",
 		})
 	}
+	// gotrue matches emails case-insensitively, so the lockout must too
+	credentials.Email = strings.ToLower(strings.TrimSpace(credentials.Email))
+
+	ip := middleware.ClientIP(c)
+
+	lockedUntil, err := ipLockedUntil(ip)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if lockedUntil != nil {
+		return lockedResponse(c, *lockedUntil, "too many failed sign-in attempts from this address")
+	}
+
+	user, err := findUserByEmail(credentials.Email)
+	if err != nil {
+		return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+			"error": models.ErrInternalServer.Error(),
+		})
+	}
+	if user != nil && user.IsLocked() {
+		return lockedResponse(c, *user.LockedUntil, models.ErrMaxLoginAttempts.Error())
+	}
 
 	authResponse, err := h.supabaseClient.Auth.SignInWithEmailPassword(credentials.Email, credentials.Password)
 
 	if err != nil {
+		if err := recordLoginFailure(user, ip); err != nil {
+			log.Printf("failed to record failed sign-in: %v", err)
+		}
+		if user != nil {
+			middleware.Audit(c, middleware.AuditEntry{
+				Action:     models.AuditSignInFailed,
+				TargetType: "user",
+				TargetID:   user.ID.String(),
+			})
+		}
 		return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-			"error":   "Invalid credentials",
-			"details": err.Error,
+			"error": models.ErrInvalidCredentials.Error(),
 		})
 	}
 
-	return c.JSON(fiber.Map{
-		"access_token": authResponse.AccessToken,
-		"token_type":   "Bearer",
-	})
+	if err := recordLoginSuccess(authResponse.User.ID); err != nil {
+		log.Printf("failed to record sign-in for user %s: %v", authResponse.User.ID, err)
+	}
+
+	if err := trackRefreshToken(authResponse.Session, nil); err != nil {
+		log.Printf("failed to track refresh token for user %s: %v", authResponse.User.ID, err)
+	}
+
+	return c.JSON(sessionResponse(authResponse.Session))
 }
@@ -4,10 +4,12 @@ import (
 	"api/config"
 	"api/handlers"
 	"api/middleware"
+	"api/models"
 	"context"
 	"github.com/gofiber/fiber/v2"
 	"github.com/gofiber/fiber/v2/middleware/cors"
 	"github.com/gofiber/fiber/v2/middleware/logger"
+	"github.com/gofiber/fiber/v2/middleware/requestid"
 	"github.com/jackc/pgx/v5"
 	"log"
 	"os"
@@ -29,11 +31,80 @@ func main() {
 	}
 	defer conn.Close(context.Background())
 
+	//init API key hashing peppers
+	if err := config.InitKeyPeppers(); err != nil {
+		log.Fatalf("Failed to load API key peppers: %v", err)
+	}
+
+	//init local verification of Supabase access tokens
+	if err := config.InitJWT(); err != nil {
+		log.Fatalf("Failed to configure JWT verification: %v", err)
+	}
+
+	//init trusted proxies for client IP extraction
+	if err := config.InitTrustedProxies(); err != nil {
+		log.Fatalf("Failed to load trusted proxies: %v", err)
+	}
+
+	//init sign-in lockout policy
+	if err := config.InitLoginLockout(); err != nil {
+		log.Fatalf("Failed to load login lockout policy: %v", err)
+	}
+
+	//init OAuth providers
+	if err := config.InitOAuth(); err != nil {
+		log.Fatalf("Failed to load OAuth config: %v", err)
+	}
+
+	//init password policy
+	if err := config.InitPasswordPolicy(); err != nil {
+		log.Fatalf("Failed to load password policy: %v", err)
+	}
+
+	//init signup policy
+	if err := config.InitSignup(); err != nil {
+		log.Fatalf("Failed to load signup config: %v", err)
+	}
+
+	//init admin impersonation tokens
+	if err := config.InitImpersonation(); err != nil {
+		log.Fatalf("Failed to load impersonation config: %v", err)
+	}
+
+	//init account deletion grace period
+	if err := config.InitAccountDeletion(); err != nil {
+		log.Fatalf("Failed to load account deletion config: %v", err)
+	}
+
 	//init postgres client
 	if err := config.InitPostgres(); err != nil {
 		log.Fatalf("Failed to initialized Postgres Client: %v", err)
 	}
 
+	if err := middleware.InitBlacklist(); err != nil {
+		log.Fatalf("Failed to initialize token blacklist: %v", err)
+	}
+
+	if err := middleware.InitRateLimitStore(); err != nil {
+		log.Fatalf("Failed to initialize rate limit store: %v", err)
+	}
+
+	app := newApp()
+
+	go handlers.RunAccountErasure(time.Hour)
+
+	port := os.Getenv("PORT")
+	if port == "" {
+		port = ":3000"
+	}
+
+	log.Printf("Server running on port %s", port)
+	log.Fatal(app.Listen(":" + port))
+}
+
+// newApp builds the server and registers every route. The clients and
+// config initialised in main must be ready.
+func newApp() *fiber.App {
 	// init server engine
 	app := fiber.New(fiber.Config{
 		ErrorHandler: func(c *fiber.Ctx, err error) error {
@@ -43,13 +114,15 @@ func main() {
 		},
 	})
 
-	middleware.InitBlacklist()
-
-	app.Use(logger.New())
+	app.Use(requestid.New())
+	app.Use(logger.New(logger.Config{
+		Format: "[${time}] ${locals:requestid} ${status} - ${latency} ${method} ${path}\n",
+	}))
 	app.Use(cors.New(cors.Config{
-		AllowOrigins: os.Getenv("ALLOWED_ORIGINS"),
-		AllowHeaders: "Origin, Content-Type, Accept, Authorization",
-		AllowMethods: "GET, POST, PUT, DELETE, OPTIONS",
+		AllowOrigins:  os.Getenv("ALLOWED_ORIGINS"),
+		AllowHeaders:  "Origin, Content-Type, Accept, Authorization, X-Organization-ID",
+		AllowMethods:  "GET, POST, PUT, PATCH, DELETE, OPTIONS",
+		ExposeHeaders: "X-RateLimit-Limit, X-RateLimit-Remaining, X-RateLimit-Reset, Retry-After, X-Request-ID, X-Impersonated-By",
 	}))
 
 	userHandler := handlers.NewUserHandler(config.GetSupabaseClient())
@@ -57,60 +130,200 @@ func main() {
 	apiKeyHandler := handlers.NewAPIKeyHandler()
 	modelHandler := handlers.NewModelHandler()
 	requestHandler := handlers.NewRequestHandler()
+	leakReportHandler := handlers.NewLeakReportHandler()
+	auditHandler := handlers.NewAuditHandler()
+	serviceAccountHandler := handlers.NewServiceAccountHandler()
+	orgHandler := handlers.NewOrganizationHandler()
 
 	//SignUp route
 	app.Post("api/auth/signup",
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "signup", Rate: 10, Period: time.Hour, KeyFunc: middleware.KeyByIP,
+		}),
 		middleware.ValidateSignUp(),
 		authHandler.SignUp,
 	)
 
+	app.Get("/api/auth/password-policy", authHandler.PasswordPolicy)
+
 	//Public routes
-	app.Post("/api/users", userHandler.CreateUser)
-	app.Post("/api/auth/signin", middleware.RateLimiter(5, time.Minute),
+	app.Post("/api/auth/signin", middleware.RateLimit(middleware.RateLimitConfig{
+		Name: "signin", Rate: 5, KeyFunc: middleware.KeyByIP,
+	}),
 		userHandler.SignIn,
 	)
+	app.Post("/api/auth/refresh", middleware.RateLimit(middleware.RateLimitConfig{
+		Name: "refresh", Rate: 30, KeyFunc: middleware.KeyByIP,
+	}),
+		userHandler.RefreshToken,
+	)
+
+	//Password reset, magic-link and email OTP
+	emailLimits := []fiber.Handler{
+		middleware.ValidateEmail(),
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "email-ip", Rate: 10, Period: time.Hour, KeyFunc: middleware.KeyByRoute(middleware.KeyByIP),
+		}),
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "email", Rate: 3, Period: time.Hour, KeyFunc: middleware.KeyByRoute(middleware.KeyByEmail),
+		}),
+	}
+	app.Post("/api/auth/recover", append(emailLimits, authHandler.Recover)...)
+	app.Post("/api/auth/magic-link", append(emailLimits, authHandler.MagicLink)...)
+	app.Post("/api/auth/otp", append(emailLimits, authHandler.OTP)...)
+	app.Post("/api/auth/verify",
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "verify-ip", Rate: 10, KeyFunc: middleware.KeyByIP,
+		}),
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "verify-email", Rate: 5, Period: 15 * time.Minute, KeyFunc: middleware.KeyByEmail,
+		}),
+		authHandler.Verify,
+	)
+
+	//OAuth / OIDC sign-in
+	oauthLimit := middleware.RateLimit(middleware.RateLimitConfig{
+		Name: "oauth", Rate: 20, KeyFunc: middleware.KeyByRoute(middleware.KeyByIP),
+	})
+	app.Get("/api/auth/oauth/callback", oauthLimit, authHandler.OAuthCallback)
+	app.Get("/api/auth/oauth/:provider", oauthLimit, authHandler.OAuthStart)
+
+	//Leaked key reports from secret-scanning partners
+	app.Post("/api/security/leaked-keys",
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "leaked-keys", Rate: 60, KeyFunc: middleware.KeyByIP,
+		}),
+		middleware.RequireSignature(os.Getenv("LEAK_REPORT_SECRET"), "X-Signature"),
+		leakReportHandler.ReportLeakedKeys,
+	)
+
+	//auth.users changes from the notify_auth_user_change trigger, to keep public.users in sync
+	app.Post("/api/auth/webhook",
+		middleware.RequireSignature(os.Getenv("AUTH_WEBHOOK_SECRET"), "X-Signature"),
+		authHandler.AuthWebhook,
+	)
+
+	//API key routes. They must be registered before the /api group: its
+	//middleware is mounted on the /api prefix and would demand a JWT here too
+	keyProtected := app.Group("/api/v1", middleware.ValidateAPIKey(), middleware.ActiveOrganization())
+	keyProtected.Get("/status", func(c *fiber.Ctx) error {
+		return c.JSON(fiber.Map{"status": "ok"})
+	})
+	keyProtected.Post("/requests", middleware.RequireScope(models.ScopeRequestsCreate), requestHandler.CreateRequest)
+	keyProtected.Get("/requests", middleware.RequireScope(models.ScopeRequestsRead), requestHandler.ListRequests)
+	keyProtected.Get("/requests/:id", middleware.RequireScope(models.ScopeRequestsRead), requestHandler.GetRequest)
 
 	//Protected routes
 	api := app.Group("/api", middleware.Protected(),
-		middleware.RateLimiter(100, time.Minute),
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "api", Rate: 100, Burst: 20, KeyFunc: middleware.KeyByUser,
+		}),
 	)
-	api.Get("/users", userHandler.ListUsers)
+	api.Post("/auth/logout", authHandler.Logout)
+	api.Post("/auth/logout-all", authHandler.LogoutAll)
+	api.Put("/auth/password", middleware.DenyImpersonation(), middleware.ValidateNewPassword(), authHandler.UpdatePassword)
+
+	mfa := api.Group("/auth/mfa")
+	mfaCodes := middleware.RateLimit(middleware.RateLimitConfig{
+		Name: "mfa", Rate: 5, Period: 5 * time.Minute, KeyFunc: middleware.KeyByRoute(middleware.KeyByUser),
+	})
+	mfa.Get("/factors", authHandler.MFAFactors)
+	mfa.Post("/enroll", authHandler.MFAEnroll)
+	mfa.Post("/verify", mfaCodes, authHandler.MFAVerify)
+	mfa.Delete("/factors/:id", middleware.RequireAAL2(), authHandler.MFAUnenroll)
+	mfa.Post("/recovery-codes", middleware.RequireAAL2(), authHandler.MFARegenerateRecoveryCodes)
+	mfa.Post("/recover", mfaCodes, authHandler.MFARecover)
+
+	api.Get("/me", userHandler.GetMe)
+	api.Patch("/me", userHandler.UpdateMe)
+	api.Get("/me/export", middleware.DenyImpersonation(), middleware.RateLimit(middleware.RateLimitConfig{
+		Name: "export", Rate: 3, Period: time.Hour, KeyFunc: middleware.KeyByRoute(middleware.KeyByUser),
+	}), userHandler.ExportMe)
+	api.Delete("/me", userHandler.DeleteMe)
+	api.Delete("/me/deletion", userHandler.CancelDeletion)
+	api.Get("/me/invitations", orgHandler.ListInvitations)
+	api.Post("/me/invitations/:id/accept", middleware.DenyImpersonation(), orgHandler.AcceptInvitation)
+	api.Delete("/me/invitations/:id", orgHandler.DeclineInvitation)
+	api.Get("/me/sessions", authHandler.ListSessions)
+	api.Delete("/me/sessions/:id", authHandler.RevokeSession)
+
+	api.Get("/users", middleware.RequirePermission(models.PermUsersRead), userHandler.ListUsers)
 	api.Get("/users/:id", userHandler.GetUser)
-	api.Put("/users/:id", userHandler.UpdateUser)
+	api.Patch("/users/:id", userHandler.UpdateUser)
 	api.Delete("/users/:id", userHandler.DeleteUser)
-	api.Put("/users/:id/login-attempts", userHandler.UpdateLoginAttempts)
-	api.Put("/users/:id/reset-attempts", userHandler.ResetLoginAttempts)
-	api.Post("/requests", middleware.RateLimiter(50, time.Minute), requestHandler.CreateRequest)
-	api.Get("/requests", middleware.RateLimiter(100, time.Minute), requestHandler.ListRequests)
-	api.Get("/requests/:id", middleware.RateLimiter(100, time.Minute), requestHandler.GetRequest)
-
-	//Admin routes
-	admin := api.Group("/admin", middleware.AdminOnly(),
-		middleware.RateLimiter(50, time.Minute),
+
+	//Organizations; keys and requests act in the one named by :org_id or the
+	//X-Organization-ID header
+	inOrg := middleware.ActiveOrganization()
+	api.Post("/orgs", orgHandler.CreateOrganization)
+	api.Get("/orgs", orgHandler.ListOrganizations)
+	api.Get("/orgs/:org_id", inOrg, orgHandler.GetOrganization)
+	api.Patch("/orgs/:org_id", inOrg, orgHandler.UpdateOrganization)
+	api.Get("/orgs/:org_id/members", inOrg, orgHandler.ListMembers)
+	api.Post("/orgs/:org_id/members", inOrg, orgHandler.AddMember)
+	api.Patch("/orgs/:org_id/members/:user_id", inOrg, orgHandler.UpdateMember)
+	api.Delete("/orgs/:org_id/members/:user_id", inOrg, orgHandler.RemoveMember)
+	api.Get("/orgs/:org_id/requests", inOrg, requestHandler.ListRequests)
+	api.Get("/orgs/:org_id/keys", inOrg, apiKeyHandler.ListKeys)
+
+	api.Post("/requests", middleware.RateLimit(middleware.RateLimitConfig{
+		Name: "requests", Rate: 50, Burst: 10, KeyFunc: middleware.KeyByRoute(middleware.KeyByUser),
+	}), inOrg, requestHandler.CreateRequest)
+	api.Get("/requests", inOrg, requestHandler.ListRequests)
+	api.Get("/requests/:id", inOrg, requestHandler.GetRequest)
+
+	//Admin routes, each gated by the permission it needs
+	admin := api.Group("/admin", middleware.DenyImpersonation(), middleware.RequireAAL2(),
+		middleware.RateLimit(middleware.RateLimitConfig{
+			Name: "admin", Rate: 50, KeyFunc: middleware.KeyByUser,
+		}),
 	)
-	admin.Put("/users/:id", userHandler.AdminUpdateUser)
-	admin.Post("/models", middleware.RateLimiter(20, time.Minute), modelHandler.CreateModel)
-	admin.Get("/models", middleware.RateLimiter(100, time.Minute), modelHandler.ListModels)
-	admin.Get("/models/:id", middleware.RateLimiter(100, time.Minute), modelHandler.GetModel)
-	admin.Put("/models/:id", middleware.RateLimiter(20, time.Minute), modelHandler.UpdateModel)
-	admin.Delete("/models/:id", middleware.RateLimiter(20, time.Minute), modelHandler.DeleteModel)
-
-	keys := api.Group("/keys")
-	keys.Post("/", apiKeyHandler.CreateKey)
+	modelWrites := middleware.RateLimit(middleware.RateLimitConfig{
+		Name: "models", Rate: 20, Burst: 5, KeyFunc: middleware.KeyByRoute(middleware.KeyByUser),
+	})
+	manageUsers := middleware.RequirePermission(models.PermUsersManage)
+	manageRoles := middleware.RequirePermission(models.PermRolesManage)
+	manageKeys := middleware.RequirePermission(models.PermKeysManage)
+	readModels := middleware.RequirePermission(models.PermModelsRead)
+	writeModels := middleware.RequirePermission(models.PermModelsWrite)
+	admin.Patch("/users/:id", manageUsers, userHandler.AdminUpdateUser)
+	admin.Post("/users/:id/unlock", manageUsers, userHandler.AdminUnlockUser)
+	admin.Post("/users", manageUsers, userHandler.CreateUser)
+	admin.Post("/users/:id/impersonate", manageUsers, userHandler.Impersonate)
+	admin.Post("/invites", manageUsers, userHandler.CreateInvite)
+	admin.Get("/invites", manageUsers, userHandler.ListInvites)
+	admin.Delete("/invites/:id", manageUsers, userHandler.RevokeInvite)
+	admin.Get("/roles", manageRoles, userHandler.ListRoles)
+	admin.Get("/users/:id/roles", manageRoles, userHandler.GetUserRoles)
+	admin.Post("/users/:id/roles", manageRoles, userHandler.AssignRole)
+	admin.Delete("/users/:id/roles/:role", manageRoles, userHandler.RemoveRole)
+	readAudit := middleware.RequirePermission(models.PermAuditRead)
+	admin.Get("/audit", readAudit, auditHandler.ListEvents)
+	admin.Get("/audit/export", readAudit, auditHandler.ExportEvents)
+	admin.Get("/audit/verify", readAudit, auditHandler.VerifyChain)
+	admin.Get("/keys", manageKeys, apiKeyHandler.AdminListKeys)
+	admin.Delete("/keys/:id", manageKeys, apiKeyHandler.AdminRevokeKey)
+	admin.Post("/users/:id/keys/revoke-all", manageKeys, apiKeyHandler.AdminRevokeUserKeys)
+	admin.Post("/service-account-groups", manageKeys, serviceAccountHandler.CreateGroup)
+	admin.Get("/service-account-groups", manageKeys, serviceAccountHandler.ListGroups)
+	admin.Post("/service-accounts", manageKeys, serviceAccountHandler.CreateServiceAccount)
+	admin.Get("/service-accounts", manageKeys, serviceAccountHandler.ListServiceAccounts)
+	admin.Get("/service-accounts/:id", manageKeys, serviceAccountHandler.GetServiceAccount)
+	admin.Post("/service-accounts/:id/disable", manageKeys, serviceAccountHandler.DisableServiceAccount)
+	admin.Post("/service-accounts/:id/enable", manageKeys, serviceAccountHandler.EnableServiceAccount)
+	admin.Post("/service-accounts/:id/rotate", manageKeys, serviceAccountHandler.RotateServiceAccount)
+	admin.Put("/organizations/:id/quota", manageUsers, orgHandler.SetQuota)
+	admin.Post("/models", writeModels, modelWrites, modelHandler.CreateModel)
+	admin.Get("/models", readModels, modelHandler.ListModels)
+	admin.Get("/models/:id", readModels, modelHandler.GetModel)
+	admin.Put("/models/:id", writeModels, modelWrites, modelHandler.UpdateModel)
+	admin.Delete("/models/:id", writeModels, modelWrites, modelHandler.DeleteModel)
+
+	keys := api.Group("/keys", inOrg)
+	keys.Post("/", middleware.RequireAAL2(), apiKeyHandler.CreateKey)
 	keys.Get("/", apiKeyHandler.ListKeys)
 	keys.Delete("/:id", apiKeyHandler.DeactivateKey)
 	keys.Put("/:id", apiKeyHandler.UpdateKey)
 
-	keyProtected := app.Group("/api/v1", middleware.ValidateAPIKey())
-	keyProtected.Get("/status", func(c *fiber.Ctx) error {
-		return c.JSON(fiber.Map{"status": "ok"})
-	})
-
-	port := os.Getenv("PORT")
-	if port == "" {
-		port = ":3000"
-	}
-
-	log.Printf("Server running on port %s", port)
-	log.Fatal(app.Listen(":" + port))
+	return app
 }
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestDeleteMeRefusesSoleOwners(t *testing.T) {
+	app, standIn := newTestApp(t)
+	userID := standIn.addAccount("owner@example.com")
+	orgID := uuid.New()
+
+	var soleOwned []uuid.UUID
+	var scheduled bool
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		switch {
+		case r.URL.Path == "/rest/v1/rpc/sole_owned_organizations":
+			json.NewEncoder(w).Encode(soleOwned)
+		case r.URL.Path == "/rest/v1/users" && r.Method == http.MethodPatch:
+			scheduled = strings.Contains(string(body), "deletion_scheduled_for")
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			return false
+		}
+		return true
+	}
+	auth := map[string]string{"Authorization": "Bearer " + signTestToken(t, userID, uuid.NewString())}
+
+	soleOwned = []uuid.UUID{orgID}
+	resp := doJSON(t, app, "DELETE", "/api/me", "", auth)
+	if resp.status != fiber.StatusConflict || !strings.Contains(resp.body, orgID.String()) {
+		t.Fatalf("sole owner: status %d, body %s", resp.status, resp.body)
+	}
+	if scheduled {
+		t.Fatal("deletion was scheduled for a sole owner")
+	}
+
+	soleOwned = []uuid.UUID{}
+	resp = doJSON(t, app, "DELETE", "/api/me", "", auth)
+	if resp.status != fiber.StatusAccepted {
+		t.Fatalf("after handing over: status %d, body %s", resp.status, resp.body)
+	}
+	if !scheduled {
+		t.Error("deletion was not scheduled")
+	}
+}
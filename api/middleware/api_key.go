@@ -6,41 +6,12 @@ import (
 	"api/utils"
 	"encoding/json"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"strings"
-	"sync"
 	"time"
 )
 
-type keyUsage struct {
-	count    int
-	lastSeen time.Time
-}
-
-var (
-	usageMap = make(map[string]*keyUsage)
-	usageMux sync.RWMutex
-)
-
-func init() {
-	// Clean up usage tracking periodically
-	go func() {
-		for {
-			time.Sleep(15 * time.Minute)
-			cleanupUsage()
-		}
-	}()
-}
-
-func cleanupUsage() {
-	usageMux.Lock()
-	defer usageMux.Unlock()
-
-	for key, usage := range usageMap {
-		if time.Since(usage.lastSeen) > time.Hour {
-			delete(usageMap, key)
-		}
-	}
-}
+const defaultKeyRateLimit = 60
 
 func ValidateAPIKey() fiber.Handler {
 	return func(c *fiber.Ctx) error {
@@ -61,12 +32,23 @@ func ValidateAPIKey() fiber.Handler {
 			})
 		}
 
-		keyHash := utils.HashAPIKey(apiKey)
+		// Legacy keys carry no environment and are accepted everywhere
+		if env := utils.KeyEnvironment(apiKey); env != "" && env != config.APIKeyEnvironment() {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "API key is not valid in this environment",
+			})
+		}
+
+		hashes := utils.APIKeyHashes(apiKey)
+		candidates := make([]string, 0, len(hashes))
+		for _, hash := range hashes {
+			candidates = append(candidates, hash)
+		}
 
 		dbClient := config.GetDBClient()
 		result, count, err := dbClient.From("api_keys").
 			Select("*", "exact", false).
-			Eq("key_hash", keyHash).
+			In("key_hash", candidates).
 			Eq("is_active", "true").
 			Execute()
 
@@ -84,33 +66,95 @@ func ValidateAPIKey() fiber.Handler {
 		}
 
 		key := keys[0]
+		if hashes[key.HashVersion] != key.KeyHash {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Invalid API key",
+			})
+		}
 
-		usageMux.Lock()
-		if usageMap[keyHash] == nil {
-			usageMap[keyHash] = &keyUsage{
-				count:    1,
-				lastSeen: time.Now(),
+		if key.IsExpired() {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "API key has expired",
+			})
+		}
+
+		// A disabled service account's keys stop working without being revoked,
+		// so re-enabling it doesn't mean reissuing them
+		if key.ServiceAccountID != nil {
+			account, err := loadServiceAccount(*key.ServiceAccountID)
+			if err != nil {
+				return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+					"error": "Failed to process API key",
+				})
+			}
+			if account == nil || account.IsDisabled() {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": "Service account is disabled",
+				})
 			}
-		} else {
-			if time.Since(usageMap[keyHash].lastSeen) <= time.Minute {
-				if usageMap[keyHash].count >= key.RateLimit {
-					usageMux.Unlock()
-					return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-						"error": "Rate limit exceeded",
+			c.Locals("service_account", account)
+		}
+
+		// An organization key only works while its owner is still a member, and
+		// never with more than member rights
+		if key.OrganizationID != nil {
+			member := &models.OrganizationMember{OrganizationID: *key.OrganizationID, Role: models.OrgRoleMember}
+			if key.UserID != nil {
+				current, err := OrganizationMembership(*key.OrganizationID, *key.UserID)
+				if err != nil {
+					return c.Status(fiber.StatusInternalServerError).JSON(fiber.Map{
+						"error": "Failed to process API key",
 					})
 				}
-				usageMap[keyHash].count++
-			} else {
-				usageMap[keyHash].count = 1
+				if current == nil {
+					return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+						"error": "API key owner is no longer a member of its organization",
+					})
+				}
+				member.UserID = current.UserID
+			}
+			c.Locals("organization", member)
+		}
+
+		// Keys created before rate_limit became nullable may not carry a limit
+		rate := key.RateLimit
+		if rate <= 0 {
+			rate = defaultKeyRateLimit
+		}
+
+		if len(key.AllowedCIDRs) > 0 && !utils.IPAllowed(key.AllowedCIDRs, ClientIP(c)) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": "API key is not allowed from this IP address",
+			})
+		}
+
+		if len(key.AllowedReferrers) > 0 {
+			origin := c.Get(fiber.HeaderOrigin)
+			if origin == "" {
+				origin = c.Get(fiber.HeaderReferer)
+			}
+			if !utils.OriginAllowed(key.AllowedReferrers, origin) {
+				return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+					"error": "API key is not allowed from this origin",
+				})
 			}
-			usageMap[keyHash].lastSeen = time.Now()
 		}
-		usageMux.Unlock()
 
-		// Update last_used timestamp in database
+		limit := Limit{Rate: rate, Period: time.Minute, Burst: rate}
+		if !takeRateLimit(c, "apikey:"+key.ID.String(), limit) {
+			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
+				"error": "Rate limit exceeded",
+			})
+		}
+
+		// Update last_used timestamp in database, upgrading the stored hash
+		// to the current pepper while we hold the plaintext key
 		updateData := map[string]interface{}{
 			"last_used": time.Now(),
 		}
+		if key.HashVersion != config.CurrentKeyPepperVersion() {
+			updateData["key_hash"], updateData["hash_version"] = utils.HashAPIKey(apiKey)
+		}
 
 		_, _, err = dbClient.From("api_keys").
 			Update(updateData, "representation", "exact").
@@ -139,3 +183,43 @@ func RequireAPIKey() fiber.Handler {
 		return c.Next()
 	}
 }
+
+// RequireScope only lets through API keys granted scope. It must run after
+// ValidateAPIKey().
+func RequireScope(scope string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		key, ok := c.Locals("api_key").(models.APIKey)
+		if !ok {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": "Valid API key required",
+			})
+		}
+
+		if !key.HasScope(scope) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": models.ErrAPIKeyScope.Error(),
+				"scope": scope,
+			})
+		}
+		return c.Next()
+	}
+}
+
+func loadServiceAccount(id uuid.UUID) (*models.ServiceAccount, error) {
+	result, _, err := config.GetDBClient().From("service_accounts").
+		Select("*", "", false).
+		Eq("id", id.String()).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var accounts []models.ServiceAccount
+	if err := json.Unmarshal(result, &accounts); err != nil {
+		return nil, err
+	}
+	if len(accounts) == 0 {
+		return nil, nil
+	}
+	return &accounts[0], nil
+}
@@ -3,117 +3,77 @@ package middleware
 import (
 	"api/config"
 	"api/models"
+	"api/utils"
 	"encoding/json"
 	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
 	"strings"
-	"sync"
-	"time"
 )
 
-type TokenBlacklist struct {
-	tokens map[string]time.Time
-	mutex  sync.RWMutex
-}
-
-var blacklist = &TokenBlacklist{
-	tokens: make(map[string]time.Time),
-}
-
-func (tb *TokenBlacklist) IsBlackListed(token string) bool {
-	tb.mutex.RLock()
-	defer tb.mutex.RUnlock()
-
-	expiryTime, exists := tb.tokens[token]
-	if !exists {
-		return false
+// ValidateToken verifies the access token locally and loads the matching
+// users row, from the cache when possible. No auth server call is made.
+func ValidateToken(token string) (*models.User, *utils.Claims, error) {
+	if blacklist.IsBlackListed(token) {
+		return nil, nil, models.ErrUnauthorized
 	}
 
-	if time.Now().After(expiryTime) {
-		tb.mutex.RUnlock()
-		tb.mutex.Lock()
-
-		delete(tb.tokens, token)
+	claims, err := utils.VerifyToken(token)
+	if err != nil {
+		return nil, nil, models.ErrUnauthorized
+	}
 
-		tb.mutex.Unlock()
-		tb.mutex.RLock()
-		return false
+	userID, err := uuid.Parse(claims.Subject)
+	if err != nil {
+		return nil, nil, models.ErrUnauthorized
 	}
-	return true
-}
 
-func (tb *TokenBlacklist) AddToBlacklist(token string, duration time.Duration) {
-	tb.mutex.Lock()
-	defer tb.mutex.Unlock()
-	tb.tokens[token] = time.Now().Add(duration)
-}
+	if blacklist.isUserRevoked(userID, claims.IssuedAt) || blacklist.isSessionRevoked(claims.SessionID) ||
+		sessionRevocations.isRevoked(claims.SessionID) {
+		return nil, nil, models.ErrUnauthorized
+	}
 
-func (tb *TokenBlacklist) cleanup() {
-	tb.mutex.Lock()
-	defer tb.mutex.Unlock()
+	appUser, ok := users.get(userID)
+	if !ok {
+		result, count, err := config.GetDBClient().From("users").
+			Select("*", "exact", false).
+			Eq("id", userID.String()).
+			Execute()
 
-	now := time.Now()
-	for token, expiry := range tb.tokens {
-		if now.After(expiry) {
-			delete(tb.tokens, token)
+		if err != nil || count == 0 {
+			return nil, nil, models.ErrUserNotFound
 		}
-	}
-}
 
-func InitBlacklist() {
-	go func() {
-		ticker := time.NewTicker(15 * time.Minute)
-		defer ticker.Stop()
+		var rows []models.User
+		if err := json.Unmarshal(result, &rows); err != nil {
+			return nil, nil, models.ErrInternalServer
+		}
 
-		for range ticker.C {
-			blacklist.cleanup()
+		if len(rows) == 0 {
+			return nil, nil, models.ErrUserNotFound
 		}
-	}()
-}
 
-func ValidateToken(token string) (*models.User, error) {
-	if blacklist.IsBlackListed(token) {
-		return nil, models.ErrUnauthorized
-	}
+		appUser = rows[0]
 
-	client := config.GetSupabaseClient()
-	client.Auth.WithToken(token)
+		roles, err := loadUserRoles(userID)
+		if err != nil {
+			return nil, nil, models.ErrInternalServer
+		}
+		appUser.Roles = roles
 
-	user, err := client.Auth.GetUser()
-	if err != nil {
-		return nil, models.ErrUnauthorized
+		users.set(appUser)
 	}
 
 	isAdmin := false
-	if adminValue, ok := user.AppMetadata["is_admin"]; ok {
+	if adminValue, ok := claims.AppMetadata["is_admin"]; ok {
 		isAdmin, _ = adminValue.(bool)
 	}
-
-	result, count, err := client.From("users").
-		Select("*", "exact", false).
-		Eq("id", user.ID.String()).
-		Execute()
-
-	if err != nil || count == 0 {
-		return nil, models.ErrUserNotFound
-	}
-
-	var users []models.User
-	if err := json.Unmarshal([]byte(result), &users); err != nil {
-		return nil, models.ErrInternalServer
-	}
-
-	if len(users) == 0 {
-		return nil, models.ErrUserNotFound
-	}
-
-	appUser := &users[0]
 	appUser.IsAdmin = isAdmin
 
 	if !appUser.IsActive {
-		return nil, models.ErrUserInactive
+		return nil, nil, models.ErrUserInactive
 	}
 
-	return appUser, nil
+	return &appUser, claims, nil
 }
 
 func Protected() fiber.Handler {
@@ -127,82 +87,86 @@ func Protected() fiber.Handler {
 		}
 
 		token := strings.TrimPrefix(authHeader, "Bearer ")
-		user, err := ValidateToken(token)
+		user, claims, err := ValidateToken(token)
 		if err != nil {
 			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": models.ErrUnauthorized.Error,
+				"error": models.ErrUnauthorized.Error(),
 			})
 		}
 
 		c.Locals("token", token)
+		c.Locals("claims", claims)
 		c.Locals("user", user)
 
+		if claims.Impersonator != "" {
+			impersonator, err := uuid.Parse(claims.Impersonator)
+			if err != nil {
+				return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+					"error": models.ErrUnauthorized.Error(),
+				})
+			}
+			c.Locals("impersonator", impersonator)
+			c.Set("X-Impersonated-By", impersonator.String())
+
+			// Impersonation is for looking, not acting: anything that could
+			// change or destroy the user's data is off limits.
+			if !isSafeMethod(c.Method()) {
+				return impersonationForbidden(c)
+			}
+		} else {
+			trackSession(c, user.ID, claims)
+		}
+
 		return c.Next()
 	}
 }
 
-func AdminOnly() fiber.Handler {
-
+// DenyImpersonation blocks impersonation tokens from routes that are unsafe
+// even to read, such as data exports. It must run after Protected().
+func DenyImpersonation() fiber.Handler {
 	return func(c *fiber.Ctx) error {
-		user, ok := c.Locals("user").(*models.User)
-		if !ok || user == nil {
-			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
-				"error": models.ErrUnauthenticated.Error,
-			})
-		}
-
-		if !user.IsAdmin {
-			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
-				"error": models.ErrNotAdmin.Error,
-			})
+		if _, ok := Impersonator(c); ok {
+			return impersonationForbidden(c)
 		}
 		return c.Next()
 	}
 }
 
-func RateLimiter(request int, duration time.Duration) fiber.Handler {
-	type client struct {
-		count    int
-		lastSeen time.Time
-	}
-
-	var (
-		clients = make(map[string]*client)
-		mu      sync.RWMutex
-	)
-
-	go func() {
-		for {
-			time.Sleep(duration)
-			mu.Lock()
-			for ip, client := range clients {
-				if time.Since(client.lastSeen) > duration {
-					delete(clients, ip)
-				}
-			}
-			mu.Unlock()
-		}
-	}()
+// Impersonator returns the admin behind the request when it was made with an
+// impersonation token.
+func Impersonator(c *fiber.Ctx) (uuid.UUID, bool) {
+	impersonator, ok := c.Locals("impersonator").(uuid.UUID)
+	return impersonator, ok
+}
 
-	return func(c *fiber.Ctx) error {
-		ip := c.IP()
+func impersonationForbidden(c *fiber.Ctx) error {
+	return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+		"error": models.ErrImpersonationReadOnly.Error(),
+		"code":  "impersonation_read_only",
+	})
+}
 
-		mu.Lock()
-		defer mu.Unlock()
+func isSafeMethod(method string) bool {
+	return method == fiber.MethodGet || method == fiber.MethodHead || method == fiber.MethodOptions
+}
 
-		if clients[ip] == nil {
-			clients[ip] = &client{count: 1, lastSeen: time.Now()}
-			return c.Next()
+// RequireAAL2 only lets through sessions that completed a second factor.
+// Users without MFA get the same error and have to enroll first.
+func RequireAAL2() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		claims, ok := c.Locals("claims").(*utils.Claims)
+		if !ok || claims == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": models.ErrUnauthenticated.Error(),
+			})
 		}
 
-		if time.Since(clients[ip].lastSeen) > duration {
-			return c.Status(fiber.StatusTooManyRequests).JSON(fiber.Map{
-				"error": "Rate limit exceeded",
+		if claims.AAL != "aal2" {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error": models.ErrMFARequired.Error(),
+				"code":  "mfa_required",
 			})
 		}
-
-		clients[ip].count++
-		clients[ip].lastSeen = time.Now()
 		return c.Next()
 	}
 }
@@ -0,0 +1,267 @@
+package middleware
+
+import (
+	"api/config"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/supabase-community/postgrest-go"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// BlacklistStore persists revocations so every replica and restart honors
+// them. Keys are "token:<sha256>" for a single access token and
+// "user:<id>" for every token a user was issued up to revokedAt.
+type BlacklistStore interface {
+	Add(ctx context.Context, key string, revokedAt, expiresAt time.Time) error
+	// Get returns when key was revoked, or found=false if it never was or
+	// the entry has expired.
+	Get(ctx context.Context, key string) (revokedAt time.Time, found bool, err error)
+}
+
+type blacklistEntry struct {
+	revokedAt time.Time
+	found     bool
+	expiresAt time.Time
+}
+
+// TokenBlacklist is a read-through cache in front of a BlacklistStore.
+// Revocations are cached until they expire. Misses are cached briefly, so
+// a revocation made on another replica takes effect within negativeTTL.
+type TokenBlacklist struct {
+	store       BlacklistStore
+	tokens      map[string]blacklistEntry
+	negativeTTL time.Duration
+	mutex       sync.RWMutex
+}
+
+var blacklist = &TokenBlacklist{
+	tokens:      make(map[string]blacklistEntry),
+	negativeTTL: 5 * time.Second,
+}
+
+// maxTokenLifetime bounds how long a user-wide revocation must be kept: no
+// token issued before it can still be valid afterwards.
+var maxTokenLifetime = 24 * time.Hour
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return "token:" + hex.EncodeToString(sum[:])
+}
+
+func userKey(userID uuid.UUID) string {
+	return "user:" + userID.String()
+}
+
+func (tb *TokenBlacklist) lookup(key string) blacklistEntry {
+	now := time.Now()
+
+	tb.mutex.RLock()
+	entry, ok := tb.tokens[key]
+	tb.mutex.RUnlock()
+	if ok && now.Before(entry.expiresAt) {
+		return entry
+	}
+
+	entry = blacklistEntry{expiresAt: now.Add(tb.negativeTTL)}
+	if tb.store != nil {
+		revokedAt, found, err := tb.store.Get(context.Background(), key)
+		if err != nil {
+			// Fail closed on a store error for keys we know nothing about
+			log.Printf("token blacklist store error: %v", err)
+			return blacklistEntry{found: true, revokedAt: now}
+		}
+		if found {
+			entry = blacklistEntry{revokedAt: revokedAt, found: true, expiresAt: now.Add(maxTokenLifetime)}
+		}
+	}
+
+	if entry.found || tb.store != nil {
+		tb.mutex.Lock()
+		tb.tokens[key] = entry
+		tb.mutex.Unlock()
+	}
+	return entry
+}
+
+func (tb *TokenBlacklist) add(key string, revokedAt, expiresAt time.Time) error {
+	tb.mutex.Lock()
+	tb.tokens[key] = blacklistEntry{revokedAt: revokedAt, found: true, expiresAt: expiresAt}
+	tb.mutex.Unlock()
+
+	if tb.store == nil {
+		return nil
+	}
+	return tb.store.Add(context.Background(), key, revokedAt, expiresAt)
+}
+
+func (tb *TokenBlacklist) IsBlackListed(token string) bool {
+	return tb.lookup(tokenKey(token)).found
+}
+
+func (tb *TokenBlacklist) AddToBlacklist(token string, duration time.Duration) error {
+	now := time.Now()
+	return tb.add(tokenKey(token), now, now.Add(duration))
+}
+
+// isUserRevoked reports whether every token the user held at issuedAt has
+// since been revoked by a sign-out everywhere. iat only has whole seconds,
+// so a token from the same second as the sign-out is accepted; otherwise a
+// sign-in right after it would be rejected until the token expires.
+func (tb *TokenBlacklist) isUserRevoked(userID uuid.UUID, issuedAt int64) bool {
+	entry := tb.lookup(userKey(userID))
+	return entry.found && issuedAt < entry.revokedAt.Unix()
+}
+
+func (tb *TokenBlacklist) cleanup() {
+	tb.mutex.Lock()
+	defer tb.mutex.Unlock()
+
+	now := time.Now()
+	for key, entry := range tb.tokens {
+		if now.After(entry.expiresAt) {
+			delete(tb.tokens, key)
+		}
+	}
+}
+
+// InitBlacklist selects the store from TOKEN_BLACKLIST_STORE ("memory",
+// "postgres" or "redis"). Memory only protects a single instance.
+func InitBlacklist() error {
+	switch backend := os.Getenv("TOKEN_BLACKLIST_STORE"); backend {
+	case "", "memory":
+		blacklist.store = nil
+	case "postgres":
+		blacklist.store = NewPostgresBlacklistStore(config.GetDBClient())
+	case "redis":
+		if config.GetRedisClient() == nil {
+			if err := config.InitRedis(); err != nil {
+				return err
+			}
+		}
+		blacklist.store = NewRedisBlacklistStore(config.GetRedisClient())
+	default:
+		return fmt.Errorf("unknown token blacklist store %q", backend)
+	}
+
+	if value, err := time.ParseDuration(os.Getenv("ACCESS_TOKEN_MAX_LIFETIME")); err == nil {
+		maxTokenLifetime = value
+	}
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			blacklist.cleanup()
+		}
+	}()
+
+	return nil
+}
+
+// RevokeToken blacklists a single access token until it expires.
+func RevokeToken(token string, expiresAt time.Time) error {
+	return blacklist.add(tokenKey(token), time.Now(), expiresAt)
+}
+
+// RevokeUserTokens invalidates every access token issued to a user so far.
+func RevokeUserTokens(userID uuid.UUID) error {
+	now := time.Now()
+	return blacklist.add(userKey(userID), now, now.Add(maxTokenLifetime))
+}
+
+// PostgresBlacklistStore keeps revocations in the token_blacklist table.
+type PostgresBlacklistStore struct {
+	dbClient *postgrest.Client
+}
+
+func NewPostgresBlacklistStore(dbClient *postgrest.Client) *PostgresBlacklistStore {
+	store := &PostgresBlacklistStore{dbClient: dbClient}
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			store.dbClient.From("token_blacklist").
+				Delete("minimal", "").
+				Lt("expires_at", time.Now().UTC().Format(time.RFC3339)).
+				Execute()
+		}
+	}()
+
+	return store
+}
+
+func (s *PostgresBlacklistStore) Add(_ context.Context, key string, revokedAt, expiresAt time.Time) error {
+	entry := map[string]interface{}{
+		"key":        key,
+		"revoked_at": revokedAt,
+		"expires_at": expiresAt,
+	}
+
+	_, _, err := s.dbClient.From("token_blacklist").
+		Upsert(entry, "key", "representation", "exact").
+		Execute()
+	return err
+}
+
+func (s *PostgresBlacklistStore) Get(_ context.Context, key string) (time.Time, bool, error) {
+	res, _, err := s.dbClient.From("token_blacklist").
+		Select("revoked_at", "exact", false).
+		Eq("key", key).
+		Gt("expires_at", time.Now().UTC().Format(time.RFC3339)).
+		Execute()
+	if err != nil {
+		return time.Time{}, false, err
+	}
+
+	var rows []struct {
+		RevokedAt time.Time `json:"revoked_at"`
+	}
+	if err := json.Unmarshal(res, &rows); err != nil {
+		return time.Time{}, false, err
+	}
+	if len(rows) == 0 {
+		return time.Time{}, false, nil
+	}
+	return rows[0].RevokedAt, true, nil
+}
+
+// RedisBlacklistStore keeps revocations as keys that expire with them.
+type RedisBlacklistStore struct {
+	client *config.RedisClient
+	prefix string
+}
+
+func NewRedisBlacklistStore(client *config.RedisClient) *RedisBlacklistStore {
+	return &RedisBlacklistStore{client: client, prefix: "blacklist:"}
+}
+
+func (s *RedisBlacklistStore) Add(ctx context.Context, key string, revokedAt, expiresAt time.Time) error {
+	_, err := s.client.Do(ctx, "SET", s.prefix+key, strconv.FormatInt(revokedAt.UnixMilli(), 10),
+		"PXAT", strconv.FormatInt(expiresAt.UnixMilli(), 10))
+	return err
+}
+
+func (s *RedisBlacklistStore) Get(ctx context.Context, key string) (time.Time, bool, error) {
+	reply, err := s.client.Do(ctx, "GET", s.prefix+key)
+	if err != nil || reply == nil {
+		return time.Time{}, false, err
+	}
+
+	value, _ := reply.(string)
+	ms, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return time.Time{}, false, fmt.Errorf("invalid blacklist entry %q", value)
+	}
+	return time.UnixMilli(ms), true, nil
+}
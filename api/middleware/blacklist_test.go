@@ -0,0 +1,29 @@
+package middleware
+
+import (
+	"github.com/google/uuid"
+	"testing"
+	"time"
+)
+
+func TestIsUserRevokedAroundSignOut(t *testing.T) {
+	tb := &TokenBlacklist{tokens: make(map[string]blacklistEntry), negativeTTL: time.Second}
+	userID := uuid.New()
+	revokedAt := time.Unix(1_800_000_000, 500_000_000)
+	if err := tb.add(userKey(userID), revokedAt, time.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+
+	if !tb.isUserRevoked(userID, revokedAt.Unix()-1) {
+		t.Error("token issued before the sign-out still works")
+	}
+	if tb.isUserRevoked(userID, revokedAt.Unix()) {
+		t.Error("token issued in the same second as the sign-out was rejected")
+	}
+	if tb.isUserRevoked(userID, revokedAt.Unix()+1) {
+		t.Error("token issued after the sign-out was rejected")
+	}
+	if tb.isUserRevoked(uuid.New(), revokedAt.Unix()-1) {
+		t.Error("another user's token was rejected")
+	}
+}
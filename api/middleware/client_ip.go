@@ -0,0 +1,33 @@
+package middleware
+
+import (
+	"api/config"
+	"github.com/gofiber/fiber/v2"
+	"net"
+	"strings"
+)
+
+// ClientIP returns the address of the caller. X-Forwarded-For is walked from
+// the right and only hops appended by trusted proxies are skipped, so a
+// client can't spoof its address by sending the header itself.
+func ClientIP(c *fiber.Ctx) string {
+	remote := c.Context().RemoteIP()
+	if !config.IsTrustedProxy(remote) {
+		return remote.String()
+	}
+
+	hops := strings.Split(c.Get(fiber.HeaderXForwardedFor), ",")
+	client := remote.String()
+	for i := len(hops) - 1; i >= 0; i-- {
+		ip := net.ParseIP(strings.TrimSpace(hops[i]))
+		if ip == nil {
+			break
+		}
+		client = ip.String()
+		if !config.IsTrustedProxy(ip) {
+			break
+		}
+	}
+
+	return client
+}
@@ -0,0 +1,240 @@
+package middleware
+
+import (
+	"api/config"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/supabase-community/postgrest-go"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// RateLimitStore keeps rate-limit state where every API instance can see it,
+// so limits hold across replicas and restarts.
+type RateLimitStore interface {
+	// Take spends one token from the bucket identified by key. Buckets are
+	// token buckets implemented with GCRA: each stores a single theoretical
+	// arrival time, so the check-and-update is one atomic step per backend.
+	Take(ctx context.Context, key string, limit Limit) (RateLimitResult, error)
+}
+
+// Limit allows Rate requests per Period with up to Burst requests at once.
+type Limit struct {
+	Rate   int
+	Period time.Duration
+	Burst  int
+}
+
+// interval is the time it takes for one token to be replenished.
+func (l Limit) interval() time.Duration {
+	return l.Period / time.Duration(l.Rate)
+}
+
+type RateLimitResult struct {
+	Allowed    bool
+	Remaining  int
+	ResetAfter time.Duration // until the bucket is full again
+	RetryAfter time.Duration // until the next request would be allowed
+}
+
+var rateLimitStore RateLimitStore = NewMemoryRateLimitStore()
+
+// InitRateLimitStore selects the counter backend from RATE_LIMIT_STORE
+// ("memory", "postgres" or "redis"). Memory is only safe for a single instance.
+func InitRateLimitStore() error {
+	switch backend := os.Getenv("RATE_LIMIT_STORE"); backend {
+	case "", "memory":
+		// keep the default in-process store
+	case "postgres":
+		rateLimitStore = NewPostgresRateLimitStore(config.GetAdminDBClient())
+	case "redis":
+		if err := config.InitRedis(); err != nil {
+			return err
+		}
+		rateLimitStore = NewRedisRateLimitStore(config.GetRedisClient())
+	default:
+		return fmt.Errorf("unknown rate limit store %q", backend)
+	}
+	return nil
+}
+
+// SetRateLimitStore replaces the store used by RateLimit and ValidateAPIKey.
+func SetRateLimitStore(store RateLimitStore) {
+	rateLimitStore = store
+}
+
+// MemoryRateLimitStore keeps buckets in process memory.
+type MemoryRateLimitStore struct {
+	tats  map[string]time.Time
+	mutex sync.Mutex
+}
+
+func NewMemoryRateLimitStore() *MemoryRateLimitStore {
+	store := &MemoryRateLimitStore{
+		tats: make(map[string]time.Time),
+	}
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			store.cleanup()
+		}
+	}()
+
+	return store
+}
+
+func (s *MemoryRateLimitStore) Take(_ context.Context, key string, limit Limit) (RateLimitResult, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	interval := limit.interval()
+
+	tat := s.tats[key]
+	if tat.Before(now) {
+		tat = now
+	}
+
+	newTat := tat.Add(interval)
+	allowAt := newTat.Add(-time.Duration(limit.Burst) * interval)
+	if now.Before(allowAt) {
+		return RateLimitResult{
+			ResetAfter: tat.Sub(now),
+			RetryAfter: allowAt.Sub(now),
+		}, nil
+	}
+
+	s.tats[key] = newTat
+	return RateLimitResult{
+		Allowed:    true,
+		Remaining:  int(now.Sub(allowAt) / interval),
+		ResetAfter: newTat.Sub(now),
+	}, nil
+}
+
+func (s *MemoryRateLimitStore) cleanup() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	now := time.Now()
+	for key, tat := range s.tats {
+		if !now.Before(tat) {
+			delete(s.tats, key)
+		}
+	}
+}
+
+// PostgresRateLimitStore keeps buckets in the rate_limits table through the
+// rate_limit_take function, which locks the row for the read-modify-write.
+// Only the service role may call it, so dbClient must act as that role.
+type PostgresRateLimitStore struct {
+	dbClient *postgrest.Client
+}
+
+func NewPostgresRateLimitStore(dbClient *postgrest.Client) *PostgresRateLimitStore {
+	store := &PostgresRateLimitStore{dbClient: dbClient}
+
+	go func() {
+		ticker := time.NewTicker(15 * time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			store.dbClient.Rpc("rate_limit_prune", "", nil)
+		}
+	}()
+
+	return store
+}
+
+func (s *PostgresRateLimitStore) Take(_ context.Context, key string, limit Limit) (RateLimitResult, error) {
+	result := s.dbClient.Rpc("rate_limit_take", "", map[string]interface{}{
+		"p_key":         key,
+		"p_interval_ms": float64(limit.interval()) / float64(time.Millisecond),
+		"p_burst":       limit.Burst,
+	})
+
+	var rows []struct {
+		Allowed      bool  `json:"allowed"`
+		Remaining    int   `json:"remaining"`
+		ResetMs      int64 `json:"reset_ms"`
+		RetryAfterMs int64 `json:"retry_after_ms"`
+	}
+	if err := json.Unmarshal([]byte(result), &rows); err != nil {
+		return RateLimitResult{}, fmt.Errorf("rate_limit_take: %s", result)
+	}
+	if len(rows) == 0 {
+		return RateLimitResult{}, errors.New("rate_limit_take returned no rows")
+	}
+
+	return RateLimitResult{
+		Allowed:    rows[0].Allowed,
+		Remaining:  rows[0].Remaining,
+		ResetAfter: time.Duration(rows[0].ResetMs) * time.Millisecond,
+		RetryAfter: time.Duration(rows[0].RetryAfterMs) * time.Millisecond,
+	}, nil
+}
+
+// redisTakeScript is the GCRA step run atomically on the server. It uses the
+// server clock so instances with skewed clocks still agree.
+const redisTakeScript = `
+local now = redis.call('TIME')
+now = tonumber(now[1]) * 1000 + tonumber(now[2]) / 1000
+local interval = tonumber(ARGV[1])
+local burst = tonumber(ARGV[2])
+
+local tat = tonumber(redis.call('GET', KEYS[1])) or now
+if tat < now then
+	tat = now
+end
+
+local new_tat = tat + interval
+local allow_at = new_tat - burst * interval
+if now < allow_at then
+	return {0, 0, math.ceil(tat - now), math.ceil(allow_at - now)}
+end
+
+redis.call('SET', KEYS[1], tostring(new_tat), 'PX', math.ceil(new_tat - now))
+return {1, math.floor((now - allow_at) / interval), math.ceil(new_tat - now), 0}
+`
+
+// RedisRateLimitStore keeps counters in any server speaking the Redis protocol.
+type RedisRateLimitStore struct {
+	client *config.RedisClient
+	prefix string
+}
+
+func NewRedisRateLimitStore(client *config.RedisClient) *RedisRateLimitStore {
+	return &RedisRateLimitStore{client: client, prefix: "ratelimit:"}
+}
+
+func (s *RedisRateLimitStore) Take(ctx context.Context, key string, limit Limit) (RateLimitResult, error) {
+	intervalMs := float64(limit.interval()) / float64(time.Millisecond)
+	reply, err := s.client.Do(ctx, "EVAL", redisTakeScript, "1", s.prefix+key,
+		strconv.FormatFloat(intervalMs, 'f', -1, 64), strconv.Itoa(limit.Burst))
+	if err != nil {
+		return RateLimitResult{}, err
+	}
+
+	values, ok := reply.([]interface{})
+	if !ok || len(values) != 4 {
+		return RateLimitResult{}, fmt.Errorf("unexpected redis reply %v", reply)
+	}
+	allowed, _ := values[0].(int64)
+	remaining, _ := values[1].(int64)
+	resetMs, _ := values[2].(int64)
+	retryAfterMs, _ := values[3].(int64)
+
+	return RateLimitResult{
+		Allowed:    allowed == 1,
+		Remaining:  int(remaining),
+		ResetAfter: time.Duration(resetMs) * time.Millisecond,
+		RetryAfter: time.Duration(retryAfterMs) * time.Millisecond,
+	}, nil
+}
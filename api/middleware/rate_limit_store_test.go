@@ -0,0 +1,49 @@
+package middleware
+
+import (
+	"api/config"
+	"context"
+	"github.com/alicebob/miniredis/v2"
+	"testing"
+	"time"
+)
+
+func TestRedisRateLimitStoreTake(t *testing.T) {
+	server := miniredis.RunT(t)
+	client, err := config.NewRedisClient("redis://" + server.Addr())
+	if err != nil {
+		t.Fatal(err)
+	}
+	store := NewRedisRateLimitStore(client)
+	limit := Limit{Rate: 2, Period: time.Second, Burst: 2}
+	ctx := context.Background()
+
+	for i, remaining := range []int{1, 0} {
+		result, err := store.Take(ctx, "user:1", limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !result.Allowed || result.Remaining != remaining {
+			t.Fatalf("request %d: got %+v, want allowed with %d remaining", i+1, result, remaining)
+		}
+	}
+
+	result, err := store.Take(ctx, "user:1", limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Allowed {
+		t.Fatal("request over the burst was allowed")
+	}
+	if result.RetryAfter <= 0 || result.RetryAfter > 500*time.Millisecond {
+		t.Fatalf("RetryAfter = %v, want up to one interval", result.RetryAfter)
+	}
+
+	// Buckets are independent and expire once full again.
+	if result, _ := store.Take(ctx, "user:2", limit); !result.Allowed {
+		t.Fatal("another key shared the bucket")
+	}
+	if ttl := server.TTL("ratelimit:user:1"); ttl <= 0 || ttl > time.Second {
+		t.Fatalf("bucket TTL = %v, want up to one period", ttl)
+	}
+}
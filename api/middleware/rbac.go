@@ -0,0 +1,52 @@
+package middleware
+
+import (
+	"api/config"
+	"api/models"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+)
+
+// loadUserRoles returns the roles assigned to a user in user_roles.
+func loadUserRoles(userID uuid.UUID) ([]string, error) {
+	result, _, err := config.GetDBClient().From("user_roles").
+		Select("role", "exact", false).
+		Eq("user_id", userID.String()).
+		Execute()
+	if err != nil {
+		return nil, err
+	}
+
+	var rows []models.UserRole
+	if err := json.Unmarshal(result, &rows); err != nil {
+		return nil, err
+	}
+
+	roles := make([]string, len(rows))
+	for i, row := range rows {
+		roles[i] = row.Role
+	}
+	return roles, nil
+}
+
+// RequirePermission only lets through users whose roles grant permission.
+// It must run after Protected().
+func RequirePermission(permission string) fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		user, ok := c.Locals("user").(*models.User)
+		if !ok || user == nil {
+			return c.Status(fiber.StatusUnauthorized).JSON(fiber.Map{
+				"error": models.ErrUnauthenticated.Error(),
+			})
+		}
+
+		if !user.HasPermission(permission) {
+			return c.Status(fiber.StatusForbidden).JSON(fiber.Map{
+				"error":      models.ErrForbidden.Error(),
+				"permission": permission,
+			})
+		}
+		return c.Next()
+	}
+}
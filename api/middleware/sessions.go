@@ -0,0 +1,166 @@
+package middleware
+
+import (
+	"api/config"
+	"api/utils"
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"log"
+	"sync"
+	"time"
+)
+
+// sessionTouchInterval bounds how often one session's last_seen_at is
+// written, so busy clients don't turn every request into a database write.
+const sessionTouchInterval = time.Minute
+
+type sessionTracker struct {
+	touched map[uuid.UUID]time.Time
+	mutex   sync.Mutex
+}
+
+var sessions = &sessionTracker{touched: make(map[uuid.UUID]time.Time)}
+
+// due reports whether the session should be written now, and if so marks it
+// as written.
+func (t *sessionTracker) due(id uuid.UUID, now time.Time) bool {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	if last, ok := t.touched[id]; ok && now.Sub(last) < sessionTouchInterval {
+		return false
+	}
+
+	if len(t.touched) > 10000 {
+		for sessionID, last := range t.touched {
+			if now.Sub(last) >= sessionTouchInterval {
+				delete(t.touched, sessionID)
+			}
+		}
+	}
+	t.touched[id] = now
+	return true
+}
+
+// trackSession records that the session behind claims was just used. The
+// write happens in the background; a missed update only makes last_seen_at
+// a little stale.
+func trackSession(c *fiber.Ctx, userID uuid.UUID, claims *utils.Claims) {
+	sessionID, err := uuid.Parse(claims.SessionID)
+	if err != nil || !sessions.due(sessionID, time.Now()) {
+		return
+	}
+
+	userAgent := c.Get(fiber.HeaderUserAgent)
+	params := map[string]interface{}{
+		"p_id":         sessionID,
+		"p_user_id":    userID,
+		"p_device":     utils.DeviceLabel(userAgent),
+		"p_ip":         ClientIP(c),
+		"p_user_agent": nullIfEmpty(userAgent),
+		"p_aal":        nullIfEmpty(claims.AAL),
+	}
+
+	go func() {
+		// Only the service role may touch sessions, so they can't be forged
+		// or kept alive with the anon key
+		result := config.GetAdminDBClient().Rpc("touch_user_session", "", params)
+		var written bool
+		if err := json.Unmarshal([]byte(result), &written); err != nil {
+			log.Printf("failed to track session %s: %s", sessionID, result)
+		}
+	}()
+}
+
+func sessionKey(sessionID string) string {
+	return "session:" + sessionID
+}
+
+// isSessionRevoked reports whether the session was revoked. Tokens without
+// a session ID can only be revoked one by one or per user.
+func (tb *TokenBlacklist) isSessionRevoked(sessionID string) bool {
+	if sessionID == "" {
+		return false
+	}
+	return tb.lookup(sessionKey(sessionID)).found
+}
+
+// sessionCheckInterval is how long a session found unrevoked in
+// user_sessions is trusted before it is read again. Revocations made through
+// the API take effect at once through the blacklist; this check keeps them
+// in force after the blacklist entry expires.
+const sessionCheckInterval = time.Minute
+
+type sessionCheck struct {
+	revoked   bool
+	checkedAt time.Time
+}
+
+type revokedSessions struct {
+	checks map[string]sessionCheck
+	mutex  sync.Mutex
+}
+
+var sessionRevocations = &revokedSessions{checks: make(map[string]sessionCheck)}
+
+// isRevoked reports whether user_sessions marks the session revoked.
+// Revocations are permanent, so they are cached for good; sessions that
+// aren't revoked are checked again after sessionCheckInterval. A failed
+// lookup is logged and lets the token through, since the blacklist has
+// already been consulted.
+func (r *revokedSessions) isRevoked(sessionID string) bool {
+	if sessionID == "" {
+		return false
+	}
+
+	now := time.Now()
+	r.mutex.Lock()
+	check, ok := r.checks[sessionID]
+	r.mutex.Unlock()
+	if ok && (check.revoked || now.Sub(check.checkedAt) < sessionCheckInterval) {
+		return check.revoked
+	}
+
+	res, _, err := config.GetDBClient().From("user_sessions").
+		Select("revoked_at", "", false).
+		Eq("id", sessionID).
+		Execute()
+	if err != nil {
+		log.Printf("failed to check session %s: %v", sessionID, err)
+		return false
+	}
+
+	var rows []struct {
+		RevokedAt *time.Time `json:"revoked_at"`
+	}
+	if err := json.Unmarshal(res, &rows); err != nil {
+		log.Printf("failed to check session %s: %v", sessionID, err)
+		return false
+	}
+	check = sessionCheck{revoked: len(rows) > 0 && rows[0].RevokedAt != nil, checkedAt: now}
+
+	r.mutex.Lock()
+	if len(r.checks) > 10000 {
+		for id, old := range r.checks {
+			if !old.revoked && now.Sub(old.checkedAt) >= sessionCheckInterval {
+				delete(r.checks, id)
+			}
+		}
+	}
+	r.checks[sessionID] = check
+	r.mutex.Unlock()
+
+	return check.revoked
+}
+
+// RevokeSession invalidates every access token of a session, including ones
+// gotrue issues for it later.
+func RevokeSession(sessionID uuid.UUID) error {
+	sessionRevocations.mutex.Lock()
+	sessionRevocations.checks[sessionID.String()] = sessionCheck{revoked: true, checkedAt: time.Now()}
+	sessionRevocations.mutex.Unlock()
+
+	now := time.Now()
+	return blacklist.add(sessionKey(sessionID.String()), now, now.Add(maxTokenLifetime))
+}
@@ -0,0 +1,85 @@
+package middleware
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"github.com/gofiber/fiber/v2"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRequireSignature(t *testing.T) {
+	const secret = "partner-secret"
+	app := fiber.New()
+	app.Post("/", RequireSignature(secret, "X-Signature"), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+
+	body := `{"keys":["sk_live_x"]}`
+	sign := func(id, timestamp, body string) string {
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(id + "." + timestamp + "." + body))
+		return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+
+	tests := []struct {
+		name      string
+		id        string
+		timestamp string
+		signature string
+		body      string
+		want      int
+	}{
+		{"valid", "evt_1", now, sign("evt_1", now, body), body, fiber.StatusNoContent},
+		{"replayed", "evt_1", now, sign("evt_1", now, body), body, fiber.StatusConflict},
+		{"next delivery", "evt_3", now, sign("evt_3", now, body), body, fiber.StatusNoContent},
+		{"tampered body", "evt_1", now, sign("evt_1", now, body), body + " ", fiber.StatusUnauthorized},
+		{"other id", "evt_2", now, sign("evt_1", now, body), body, fiber.StatusUnauthorized},
+		{"replayed later", "evt_1", stale, sign("evt_1", stale, body), body, fiber.StatusUnauthorized},
+		{"missing id", "", now, sign("", now, body), body, fiber.StatusUnauthorized},
+		{"body-only signature", "evt_1", now, "sha256=" + hmacHex(secret, body), body, fiber.StatusUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("POST", "/", strings.NewReader(tt.body))
+			req.Header.Set("X-Signature", tt.signature)
+			req.Header.Set(SignatureIDHeader, tt.id)
+			req.Header.Set(SignatureTimestampHeader, tt.timestamp)
+			resp, err := app.Test(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if resp.StatusCode != tt.want {
+				t.Fatalf("status = %d, want %d", resp.StatusCode, tt.want)
+			}
+		})
+	}
+}
+
+func hmacHex(secret, body string) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(body))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+func TestRequireSignatureWithoutSecret(t *testing.T) {
+	app := fiber.New()
+	app.Post("/", RequireSignature("", "X-Signature"), func(c *fiber.Ctx) error {
+		return c.SendStatus(fiber.StatusNoContent)
+	})
+	req := httptest.NewRequest("POST", "/", strings.NewReader("{}"))
+	req.Header.Set("X-Signature", "sha256=00")
+	resp, err := app.Test(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != fiber.StatusUnauthorized {
+		t.Fatalf("status = %d, want 401", resp.StatusCode)
+	}
+}
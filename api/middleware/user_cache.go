@@ -0,0 +1,93 @@
+package middleware
+
+import (
+	"api/models"
+	"github.com/google/uuid"
+	"os"
+	"sync"
+	"time"
+)
+
+// userCache keeps recently loaded users rows so ValidateToken only reaches
+// the database on a miss. Entries live for a short TTL; handlers that change
+// a user call InvalidateUser, and other replicas catch up once the TTL ends.
+type userCache struct {
+	entries map[uuid.UUID]userCacheEntry
+	ttl     time.Duration
+	mutex   sync.RWMutex
+}
+
+type userCacheEntry struct {
+	user      models.User
+	expiresAt time.Time
+}
+
+var users = newUserCache()
+
+func newUserCache() *userCache {
+	ttl := 30 * time.Second
+	if value, err := time.ParseDuration(os.Getenv("USER_CACHE_TTL")); err == nil {
+		ttl = value
+	}
+
+	cache := &userCache{
+		entries: make(map[uuid.UUID]userCacheEntry),
+		ttl:     ttl,
+	}
+
+	go func() {
+		ticker := time.NewTicker(time.Minute)
+		defer ticker.Stop()
+
+		for range ticker.C {
+			cache.cleanup()
+		}
+	}()
+
+	return cache
+}
+
+// get returns a copy so callers can't modify the cached row.
+func (uc *userCache) get(id uuid.UUID) (models.User, bool) {
+	uc.mutex.RLock()
+	defer uc.mutex.RUnlock()
+
+	entry, ok := uc.entries[id]
+	if !ok || time.Now().After(entry.expiresAt) {
+		return models.User{}, false
+	}
+	return entry.user, true
+}
+
+func (uc *userCache) set(user models.User) {
+	if uc.ttl <= 0 {
+		return
+	}
+
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	uc.entries[user.ID] = userCacheEntry{user: user, expiresAt: time.Now().Add(uc.ttl)}
+}
+
+func (uc *userCache) delete(id uuid.UUID) {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+	delete(uc.entries, id)
+}
+
+func (uc *userCache) cleanup() {
+	uc.mutex.Lock()
+	defer uc.mutex.Unlock()
+
+	now := time.Now()
+	for id, entry := range uc.entries {
+		if now.After(entry.expiresAt) {
+			delete(uc.entries, id)
+		}
+	}
+}
+
+// InvalidateUser drops a user from this instance's cache after it changed.
+func InvalidateUser(id uuid.UUID) {
+	users.delete(id)
+}
@@ -1,13 +1,19 @@
 package middleware
 
 import (
+	"api/config"
+	"api/models"
+	"api/utils"
 	"github.com/gofiber/fiber/v2"
 	"github.com/supabase-community/gotrue-go/types"
 	"regexp"
+	"strings"
 )
 
 var emailRegex = regexp.MustCompile(`^[a-z0-9._%+\-]+@[a-z0-9.\-]+\.[a-z]{2,}$`)
 
+// ValidateSignUp checks the email and holds the password to the configured
+// policy, listing every rule it breaks.
 func ValidateSignUp() fiber.Handler {
 	return func(c *fiber.Ctx) error {
 		var input types.SignupRequest
@@ -18,15 +24,64 @@ func ValidateSignUp() fiber.Handler {
 			})
 		}
 
-		if !emailRegex.MatchString(input.Email) {
+		email := strings.ToLower(strings.TrimSpace(input.Email))
+		if !emailRegex.MatchString(email) {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
 				"error": "invalid email format",
 			})
 		}
 
-		if len(input.Password) < 8 {
+		return checkNewPassword(c, input.Password, email)
+	}
+}
+
+// ValidateNewPassword holds the password in the body to the configured
+// policy for the signed-in user. It runs after Protected().
+func ValidateNewPassword() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			Password string `json:"password"`
+		}
+
+		if err := c.BodyParser(&input); err != nil {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid request body",
+			})
+		}
+
+		user := c.Locals("user").(*models.User)
+		return checkNewPassword(c, input.Password, user.Email)
+	}
+}
+
+func checkNewPassword(c *fiber.Ctx, password, email string) error {
+	violations := utils.CheckPassword(password, email, config.GetPasswordPolicy())
+	if len(violations) > 0 {
+		return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+			"error":      "password does not meet the password policy",
+			"code":       "weak_password",
+			"violations": violations,
+		})
+	}
+	return c.Next()
+}
+
+// ValidateEmail rejects requests whose body has no well-formed email.
+func ValidateEmail() fiber.Handler {
+	return func(c *fiber.Ctx) error {
+		var input struct {
+			Email string `json:"email"`
+		}
+
+		if err := c.BodyParser(&input); err != nil {
 			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
-				"error": "invalid password format",
+				"error": "invalid request body",
+			})
+		}
+
+		if !emailRegex.MatchString(strings.ToLower(strings.TrimSpace(input.Email))) {
+			return c.Status(fiber.StatusBadRequest).JSON(fiber.Map{
+				"error": "invalid email format",
 			})
 		}
 
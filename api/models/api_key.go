@@ -0,0 +1,60 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type APIKey struct {
+	ID uuid.UUID `json:"id"`
+	// A key is owned by either a user or a service account, never both
+	UserID           *uuid.UUID `json:"user_id,omitempty"`
+	ServiceAccountID *uuid.UUID `json:"service_account_id,omitempty"`
+	OrganizationID   *uuid.UUID `json:"organization_id,omitempty"`
+	KeyHash          string     `json:"key_hash,omitempty"`
+	HashVersion      int        `json:"hash_version,omitempty"`
+	KeyPrefix        string     `json:"key_prefix,omitempty"`
+	Environment      string     `json:"environment,omitempty"`
+	Name             string     `json:"name"`
+	CreatedAt        time.Time  `json:"created_at"`
+	LastUsed         *time.Time `json:"last_used,omitempty"`
+	IsActive         bool       `json:"is_active"`
+	RateLimit        int        `json:"rate_limit"`
+	// Empty lists leave the key unrestricted
+	AllowedCIDRs     []string `json:"allowed_cidrs"`
+	AllowedReferrers []string `json:"allowed_referrers"`
+	Scopes           []string `json:"scopes"`
+	// Set on keys being rotated out; they stop working once it passes
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+
+	RevokedAt        *time.Time `json:"revoked_at,omitempty"`
+	RevokedBy        *uuid.UUID `json:"revoked_by,omitempty"`
+	RevocationReason string     `json:"revocation_reason,omitempty"`
+}
+
+// API key scopes. A user's key with no scopes may call anything a key can;
+// service account keys always name theirs.
+const (
+	ScopeRequestsCreate = "requests:create"
+	ScopeRequestsRead   = "requests:read"
+)
+
+var APIKeyScopes = []string{ScopeRequestsCreate, ScopeRequestsRead}
+
+// HasScope reports whether the key may be used for scope.
+func (k *APIKey) HasScope(scope string) bool {
+	if len(k.Scopes) == 0 {
+		return k.ServiceAccountID == nil
+	}
+	for _, s := range k.Scopes {
+		if s == scope {
+			return true
+		}
+	}
+	return false
+}
+
+// IsExpired reports whether a rotated-out key has passed its expiry.
+func (k *APIKey) IsExpired() bool {
+	return k.ExpiresAt != nil && !time.Now().Before(*k.ExpiresAt)
+}
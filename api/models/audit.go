@@ -0,0 +1,81 @@
+package models
+
+import (
+	"encoding/json"
+	"github.com/google/uuid"
+	"time"
+)
+
+// Audit actions. Names are <target>.<verb>.
+const (
+	AuditUserUpdate       = "user.update"
+	AuditUserDeactivate   = "user.deactivate"
+	AuditUserUnlock       = "user.unlock"
+	AuditRoleAssign       = "role.assign"
+	AuditRoleRemove       = "role.remove"
+	AuditModelCreate      = "model.create"
+	AuditModelUpdate      = "model.update"
+	AuditModelDelete      = "model.delete"
+	AuditKeyCreate        = "api_key.create"
+	AuditKeyUpdate        = "api_key.update"
+	AuditKeyRevoke        = "api_key.revoke"
+	AuditKeyRevokeAll     = "api_key.revoke_all"
+	AuditKeyLeakRevoke    = "api_key.leak_revoke"
+	AuditRequestReadOther = "request.read_other"
+	AuditSignInFailed     = "auth.signin_failed"
+	AuditLogoutAll        = "auth.logout_all"
+	AuditPasswordChange   = "auth.password_change"
+	AuditMFAVerify        = "mfa.verify"
+	AuditMFAUnenroll      = "mfa.unenroll"
+	AuditMFARecover       = "mfa.recover"
+	AuditAuditExport      = "audit.export"
+	AuditUserProfile      = "user.profile_update"
+	AuditUserExport       = "user.export"
+	AuditUserDeletion     = "user.deletion_scheduled"
+	AuditUserDeletionStop = "user.deletion_cancelled"
+	AuditUserErase        = "user.erase"
+	AuditUserImpersonate  = "user.impersonate"
+	AuditSessionRevoke    = "session.revoke"
+	AuditInviteCreate     = "invite.create"
+	AuditInviteRevoke     = "invite.revoke"
+	AuditGroupCreate      = "service_account_group.create"
+	AuditServiceCreate    = "service_account.create"
+	AuditServiceDisable   = "service_account.disable"
+	AuditServiceEnable    = "service_account.enable"
+	AuditServiceRotate    = "service_account.rotate"
+	AuditOrgCreate        = "organization.create"
+	AuditOrgUpdate        = "organization.update"
+	AuditOrgMemberInvite  = "organization.member_invite"
+	AuditOrgMemberAdd     = "organization.member_add"
+	AuditOrgMemberUpdate  = "organization.member_update"
+	AuditOrgMemberRemove  = "organization.member_remove"
+	AuditUserSync         = "user.sync"
+)
+
+const (
+	ActorUser    = "user"
+	ActorAPIKey  = "api_key"
+	ActorPartner = "partner"
+	ActorSystem  = "system"
+	// ActorImpersonator is an admin acting through an impersonation token.
+	ActorImpersonator = "impersonator"
+	// ActorServiceAccount is a service account calling with one of its keys.
+	ActorServiceAccount = "service_account"
+)
+
+type AuditEvent struct {
+	ID         int64           `json:"id"`
+	CreatedAt  time.Time       `json:"created_at"`
+	ActorID    *uuid.UUID      `json:"actor_id"`
+	ActorType  string          `json:"actor_type"`
+	Action     string          `json:"action"`
+	TargetType string          `json:"target_type,omitempty"`
+	TargetID   string          `json:"target_id,omitempty"`
+	Before     json.RawMessage `json:"before,omitempty"`
+	After      json.RawMessage `json:"after,omitempty"`
+	IP         string          `json:"ip,omitempty"`
+	UserAgent  string          `json:"user_agent,omitempty"`
+	RequestID  string          `json:"request_id,omitempty"`
+	PrevHash   string          `json:"prev_hash"`
+	Hash       string          `json:"hash"`
+}
@@ -3,20 +3,28 @@ package models
 import "errors"
 
 var (
-	ErrInternalServer       = errors.New("internal server error")
-	ErrNotAdmin             = errors.New("admin access required")
-	ErrUnauthenticated      = errors.New("user not authenticated")
-	ErrUnauthorized         = errors.New("user not authorized")
-	ErrUserNotFound         = errors.New("user not found")
-	ErrUserAlreadyExists    = errors.New("user already exists")
-	ErrInvalidEmail         = errors.New("invalid email format")
-	ErrUserInactive         = errors.New("user is inactive")
-	ErrInvalidCredentials   = errors.New("invalid credentials")
-	ErrMaxLoginAttempts     = errors.New("maximum login attempts exceeded")
-	ErrAPIKeyNotFound       = errors.New("api key not found")
-	ErrAPIKeyInactive       = errors.New("api key is inactive")
-	ErrRateLimitExceeded    = errors.New("rate limit exceeded")
-	ErrModelNotFound        = errors.New("ai model not found")
-	ErrModelInactive        = errors.New("ai model is inactive")
-	ErrInvalidRequestStatus = errors.New("invalid request status")
+	ErrInternalServer         = errors.New("internal server error")
+	ErrNotAdmin               = errors.New("admin access required")
+	ErrForbidden              = errors.New("missing required permission")
+	ErrUnauthenticated        = errors.New("user not authenticated")
+	ErrUnauthorized           = errors.New("user not authorized")
+	ErrNotAccountOwner        = errors.New("cannot act on another user's account")
+	ErrUserNotFound           = errors.New("user not found")
+	ErrUserAlreadyExists      = errors.New("user already exists")
+	ErrInvalidEmail           = errors.New("invalid email format")
+	ErrUserInactive           = errors.New("user is inactive")
+	ErrInvalidCredentials     = errors.New("invalid credentials")
+	ErrMaxLoginAttempts       = errors.New("maximum login attempts exceeded")
+	ErrAPIKeyNotFound         = errors.New("api key not found")
+	ErrAPIKeyInactive         = errors.New("api key is inactive")
+	ErrRateLimitExceeded      = errors.New("rate limit exceeded")
+	ErrModelNotFound          = errors.New("ai model not found")
+	ErrModelInactive          = errors.New("ai model is inactive")
+	ErrInvalidRequestStatus   = errors.New("invalid request status")
+	ErrMFARequired            = errors.New("multi-factor authentication required")
+	ErrImpersonationReadOnly  = errors.New("not allowed while impersonating a user")
+	ErrServiceAccountNotFound = errors.New("service account not found")
+	ErrAPIKeyScope            = errors.New("api key lacks the required scope")
+	ErrNotOrgMember           = errors.New("not a member of this organization")
+	ErrOrgAdminRequired       = errors.New("organization admin access required")
 )
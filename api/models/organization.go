@@ -0,0 +1,53 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Roles within an organization. They are separate from the platform roles
+// in RolePermissions and only reach the organization's own data.
+const (
+	OrgRoleOwner  = "owner"
+	OrgRoleAdmin  = "admin"
+	OrgRoleMember = "member"
+)
+
+func IsValidOrgRole(role string) bool {
+	return role == OrgRoleOwner || role == OrgRoleAdmin || role == OrgRoleMember
+}
+
+type Organization struct {
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	Slug      string     `json:"slug"`
+	CreatedBy *uuid.UUID `json:"created_by,omitempty"`
+	CreatedAt time.Time  `json:"created_at"`
+	// RequestQuota is model requests per calendar month; nil is unlimited.
+	RequestQuota *int `json:"request_quota"`
+}
+
+type OrganizationMember struct {
+	OrganizationID uuid.UUID  `json:"organization_id"`
+	UserID         uuid.UUID  `json:"user_id"`
+	Role           string     `json:"role"`
+	AddedBy        *uuid.UUID `json:"added_by,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+}
+
+// OrganizationInvitation offers a user membership with Role. They only
+// become a member by accepting it.
+type OrganizationInvitation struct {
+	ID             uuid.UUID  `json:"id"`
+	OrganizationID uuid.UUID  `json:"organization_id"`
+	UserID         uuid.UUID  `json:"user_id"`
+	Role           string     `json:"role"`
+	InvitedBy      *uuid.UUID `json:"invited_by,omitempty"`
+	CreatedAt      time.Time  `json:"created_at"`
+	ExpiresAt      time.Time  `json:"expires_at"`
+}
+
+// CanManage reports whether the member administers the organization.
+func (m *OrganizationMember) CanManage() bool {
+	return m.Role == OrgRoleOwner || m.Role == OrgRoleAdmin
+}
@@ -0,0 +1,73 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// Permissions guard operations beyond a user's own data.
+const (
+	PermModelsRead      = "models:read"
+	PermModelsWrite     = "models:write"
+	PermUsersRead       = "users:read"
+	PermUsersManage     = "users:manage"
+	PermRolesManage     = "roles:manage"
+	PermRequestsReadAll = "requests:read:all"
+	PermKeysManage      = "keys:manage"
+	PermBillingRead     = "billing:read"
+	PermAuditRead       = "audit:read"
+)
+
+const (
+	RoleViewer       = "viewer"
+	RoleDeveloper    = "developer"
+	RoleModelManager = "model-manager"
+	RoleBilling      = "billing"
+	RoleSuperAdmin   = "super-admin"
+)
+
+// RolePermissions maps each role to what it grants. Roles are assigned in the
+// user_roles table; what they grant is defined here so it is reviewed with
+// the code that checks it.
+var RolePermissions = map[string][]string{
+	RoleViewer:       {PermModelsRead, PermUsersRead},
+	RoleDeveloper:    {PermModelsRead, PermRequestsReadAll},
+	RoleModelManager: {PermModelsRead, PermModelsWrite},
+	RoleBilling:      {PermBillingRead, PermUsersRead, PermRequestsReadAll},
+	RoleSuperAdmin: {
+		PermModelsRead, PermModelsWrite, PermUsersRead, PermUsersManage,
+		PermRolesManage, PermRequestsReadAll, PermKeysManage, PermBillingRead,
+		PermAuditRead,
+	},
+}
+
+type UserRole struct {
+	UserID    uuid.UUID  `json:"user_id"`
+	Role      string     `json:"role"`
+	GrantedBy *uuid.UUID `json:"granted_by,omitempty"`
+	GrantedAt time.Time  `json:"granted_at"`
+}
+
+func IsValidRole(role string) bool {
+	_, ok := RolePermissions[role]
+	return ok
+}
+
+// HasPermission reports whether any of the user's roles grants permission.
+// Accounts flagged is_admin in their gotrue app_metadata predate roles and
+// count as super-admins.
+func (u *User) HasPermission(permission string) bool {
+	roles := u.Roles
+	if u.IsAdmin {
+		roles = append([]string{RoleSuperAdmin}, roles...)
+	}
+
+	for _, role := range roles {
+		for _, granted := range RolePermissions[role] {
+			if granted == permission {
+				return true
+			}
+		}
+	}
+	return false
+}
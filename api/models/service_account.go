@@ -0,0 +1,32 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+// ServiceAccountGroup collects the service accounts of one team under the
+// admin responsible for them.
+type ServiceAccountGroup struct {
+	ID        uuid.UUID  `json:"id"`
+	Name      string     `json:"name"`
+	OwnerID   *uuid.UUID `json:"owner_id"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ServiceAccount is a non-human principal. It can't sign in and only acts
+// through its API keys.
+type ServiceAccount struct {
+	ID          uuid.UUID  `json:"id"`
+	GroupID     uuid.UUID  `json:"group_id"`
+	Name        string     `json:"name"`
+	Description string     `json:"description,omitempty"`
+	CreatedBy   *uuid.UUID `json:"created_by,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	DisabledAt  *time.Time `json:"disabled_at,omitempty"`
+	DisabledBy  *uuid.UUID `json:"disabled_by,omitempty"`
+}
+
+func (s *ServiceAccount) IsDisabled() bool {
+	return s.DisabledAt != nil
+}
@@ -0,0 +1,40 @@
+package models
+
+import (
+	"github.com/google/uuid"
+	"time"
+)
+
+type User struct {
+	ID        uuid.UUID  `json:"id"`
+	Email     string     `json:"email"`
+	CreatedAt time.Time  `json:"created_at"`
+	LastLogin *time.Time `json:"last_login,omitempty"`
+	IsAdmin   bool       `json:"is_admin"`
+	IsActive  bool       `json:"is_active"`
+	// Set on rows for accounts gotrue created without the signup policy's
+	// say; they stay inactive until it admits them or an admin decides.
+	SignupPending       bool       `json:"signup_pending"`
+	FailedLoginAttempts int        `json:"failed_login_attempts"`
+	LockedUntil         *time.Time `json:"locked_until,omitempty"`
+	DisplayName         string     `json:"display_name,omitempty"`
+	// Set while a self-service deletion is pending; the account is erased
+	// once DeletionScheduledFor passes unless the user cancels.
+	DeletionRequestedAt  *time.Time `json:"deletion_requested_at,omitempty"`
+	DeletionScheduledFor *time.Time `json:"deletion_scheduled_for,omitempty"`
+	// Roles come from user_roles and are loaded alongside the row.
+	Roles []string `json:"-"`
+}
+
+// IsLocked reports whether sign-in is currently blocked after too many
+// failed attempts.
+func (u *User) IsLocked() bool {
+	return u.LockedUntil != nil && time.Now().Before(*u.LockedUntil)
+}
+
+type UserResponse struct {
+	ID       uuid.UUID `json:"id"`
+	Email    string    `json:"email"`
+	IsAdmin  bool      `json:"is_admin"`
+	IsActive bool      `json:"is_active"`
+}
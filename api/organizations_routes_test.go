@@ -0,0 +1,152 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// orgRows plays organization_members and organization_invitations.
+type orgRows struct {
+	mutex       sync.Mutex
+	members     map[uuid.UUID]string
+	invitations []map[string]interface{}
+	added       []map[string]interface{}
+}
+
+func (o *orgRows) serve(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	o.mutex.Lock()
+	defer o.mutex.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case r.URL.Path == "/rest/v1/organization_members" && r.Method == http.MethodGet:
+		rows := []map[string]interface{}{}
+		userID, _ := uuid.Parse(strings.TrimPrefix(query.Get("user_id"), "eq."))
+		if role, ok := o.members[userID]; ok {
+			rows = append(rows, map[string]interface{}{
+				"organization_id": strings.TrimPrefix(query.Get("organization_id"), "eq."),
+				"user_id":         userID, "role": role,
+			})
+		}
+		writeRows(w, rows)
+	case r.URL.Path == "/rest/v1/organization_members" && r.Method == http.MethodPost:
+		var row map[string]interface{}
+		json.Unmarshal(body, &row)
+		o.added = append(o.added, row)
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/rest/v1/organization_invitations" && r.Method == http.MethodPost:
+		var row map[string]interface{}
+		json.Unmarshal(body, &row)
+		o.invitations = append(o.invitations, row)
+		w.WriteHeader(http.StatusCreated)
+	case r.URL.Path == "/rest/v1/organization_invitations" && r.Method == http.MethodGet:
+		rows := []map[string]interface{}{}
+		for _, row := range o.invitations {
+			if "eq."+row["id"].(string) == query.Get("id") && "eq."+row["user_id"].(string) == query.Get("user_id") {
+				rows = append(rows, row)
+			}
+		}
+		writeRows(w, rows)
+	case r.URL.Path == "/rest/v1/organization_invitations" && r.Method == http.MethodDelete:
+		kept := o.invitations[:0]
+		for _, row := range o.invitations {
+			if "eq."+row["id"].(string) != query.Get("id") {
+				kept = append(kept, row)
+			}
+		}
+		o.invitations = kept
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		return false
+	}
+	return true
+}
+
+func TestAddMemberOnlyInvites(t *testing.T) {
+	app, standIn := newTestApp(t)
+	ownerID := standIn.addAccount("owner@example.com")
+	inviteeID := standIn.addAccount("invitee@example.com")
+	orgID := uuid.New()
+
+	rows := &orgRows{members: map[uuid.UUID]string{ownerID: "owner"}}
+	standIn.rest = rows.serve
+
+	ownerAuth := map[string]string{"Authorization": "Bearer " + signTestToken(t, ownerID, uuid.NewString())}
+	inviteeAuth := map[string]string{"Authorization": "Bearer " + signTestToken(t, inviteeID, uuid.NewString())}
+	membersPath := "/api/orgs/" + orgID.String() + "/members"
+
+	existing := doJSON(t, app, "POST", membersPath, `{"email":"Invitee@example.com","role":"owner"}`, ownerAuth)
+	missing := doJSON(t, app, "POST", membersPath, `{"email":"nobody@example.com","role":"owner"}`, ownerAuth)
+	if existing.status != fiber.StatusAccepted || existing.status != missing.status || existing.body != missing.body {
+		t.Fatalf("existing account: %d %s; missing account: %d %s",
+			existing.status, existing.body, missing.status, missing.body)
+	}
+	if len(rows.added) != 0 {
+		t.Fatalf("members added without consent: %v", rows.added)
+	}
+	if len(rows.invitations) != 1 || rows.invitations[0]["user_id"] != inviteeID.String() {
+		t.Fatalf("invitations: %v", rows.invitations)
+	}
+	if expiresAt, _ := time.Parse(time.RFC3339Nano, rows.invitations[0]["expires_at"].(string)); !expiresAt.After(time.Now()) {
+		t.Errorf("invitation expires at %v", rows.invitations[0]["expires_at"])
+	}
+	invitationID := rows.invitations[0]["id"].(string)
+
+	// Nobody else can accept it.
+	resp := doJSON(t, app, "POST", "/api/me/invitations/"+invitationID+"/accept", "", ownerAuth)
+	if resp.status != fiber.StatusNotFound {
+		t.Fatalf("accepted by someone else: status %d, body %s", resp.status, resp.body)
+	}
+
+	resp = doJSON(t, app, "POST", "/api/me/invitations/"+invitationID+"/accept", "", inviteeAuth)
+	if resp.status != fiber.StatusCreated {
+		t.Fatalf("accept: status %d, body %s", resp.status, resp.body)
+	}
+	if len(rows.added) != 1 || rows.added[0]["user_id"] != inviteeID.String() || rows.added[0]["role"] != "owner" {
+		t.Fatalf("members added: %v", rows.added)
+	}
+	if len(rows.invitations) != 0 {
+		t.Errorf("invitation left behind: %v", rows.invitations)
+	}
+
+	resp = doJSON(t, app, "POST", "/api/me/invitations/"+invitationID+"/accept", "", inviteeAuth)
+	if resp.status != fiber.StatusNotFound {
+		t.Errorf("accepting twice: status %d, body %s", resp.status, resp.body)
+	}
+}
+
+func TestInvitationLapsesWithInvitersRights(t *testing.T) {
+	app, standIn := newTestApp(t)
+	adminID := standIn.addAccount("admin@example.com")
+	inviteeID := standIn.addAccount("invitee@example.com")
+	orgID := uuid.New()
+
+	rows := &orgRows{members: map[uuid.UUID]string{adminID: "admin"}}
+	standIn.rest = rows.serve
+
+	adminAuth := map[string]string{"Authorization": "Bearer " + signTestToken(t, adminID, uuid.NewString())}
+	inviteeAuth := map[string]string{"Authorization": "Bearer " + signTestToken(t, inviteeID, uuid.NewString())}
+
+	resp := doJSON(t, app, "POST", "/api/orgs/"+orgID.String()+"/members", `{"user_id":"`+inviteeID.String()+`"}`, adminAuth)
+	if resp.status != fiber.StatusAccepted || len(rows.invitations) != 1 {
+		t.Fatalf("invite: status %d, body %s, invitations %v", resp.status, resp.body, rows.invitations)
+	}
+
+	rows.mutex.Lock()
+	rows.members[adminID] = "member"
+	rows.mutex.Unlock()
+
+	resp = doJSON(t, app, "POST", "/api/me/invitations/"+rows.invitations[0]["id"].(string)+"/accept", "", inviteeAuth)
+	if resp.status != fiber.StatusGone {
+		t.Fatalf("accept after demotion: status %d, body %s", resp.status, resp.body)
+	}
+	if len(rows.added) != 0 {
+		t.Errorf("members added: %v", rows.added)
+	}
+}
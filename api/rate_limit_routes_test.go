@@ -0,0 +1,35 @@
+package main
+
+import (
+	"api/middleware"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"testing"
+)
+
+func TestPostgresRateLimitStoreActsAsServiceRole(t *testing.T) {
+	app, standIn := newTestApp(t)
+	t.Setenv("RATE_LIMIT_STORE", "postgres")
+	if err := middleware.InitRateLimitStore(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { middleware.SetRateLimitStore(middleware.NewMemoryRateLimitStore()) })
+
+	var takes int
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		if r.URL.Path != "/rest/v1/rpc/rate_limit_take" {
+			return false
+		}
+		takes++
+		w.Write([]byte(`[{"allowed":false,"remaining":0,"reset_ms":1000,"retry_after_ms":1000}]`))
+		return true
+	}
+
+	resp := postJSON(t, app, "/api/auth/recover", `{"email":"someone@example.com"}`)
+	if resp.status != fiber.StatusTooManyRequests {
+		t.Fatalf("status %d, body %s", resp.status, resp.body)
+	}
+	if takes == 0 {
+		t.Error("rate_limit_take was never called")
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// sessionRows plays user_sessions and records calls to end_auth_session.
+type sessionRows struct {
+	mutex   sync.Mutex
+	revoked map[string]*time.Time
+	userOf  map[string]uuid.UUID
+	ended   []string
+}
+
+func (s *sessionRows) serve(w http.ResponseWriter, r *http.Request, body []byte) bool {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	switch {
+	case r.URL.Path == "/rest/v1/rpc/end_auth_session":
+		var params struct {
+			SessionID string `json:"p_session_id"`
+		}
+		json.Unmarshal(body, &params)
+		s.ended = append(s.ended, params.SessionID)
+		w.Write([]byte(`true`))
+		return true
+	case r.URL.Path == "/rest/v1/user_sessions":
+		id := strings.TrimPrefix(r.URL.Query().Get("id"), "eq.")
+		revokedAt, ok := s.revoked[id]
+		onlyLive := r.URL.Query().Get("revoked_at") == "is.null"
+
+		rows := []map[string]interface{}{}
+		if ok && (!onlyLive || revokedAt == nil) {
+			if r.Method == http.MethodPatch {
+				now := time.Now()
+				s.revoked[id] = &now
+				revokedAt = &now
+			}
+			rows = append(rows, map[string]interface{}{
+				"id": id, "user_id": s.userOf[id], "device": "Firefox on Linux", "revoked_at": revokedAt,
+			})
+		}
+		writeRows(w, rows)
+		return true
+	}
+	return false
+}
+
+func TestRevokeSessionEndsItForGood(t *testing.T) {
+	app, standIn := newTestApp(t)
+	userID := standIn.addAccount("sessions@example.com")
+
+	current, other := uuid.NewString(), uuid.NewString()
+	rows := &sessionRows{
+		revoked: map[string]*time.Time{current: nil, other: nil},
+		userOf:  map[string]uuid.UUID{current: userID, other: userID},
+	}
+	standIn.rest = rows.serve
+
+	auth := map[string]string{"Authorization": "Bearer " + signTestToken(t, userID, current)}
+	otherAuth := map[string]string{"Authorization": "Bearer " + signTestToken(t, userID, other)}
+
+	if resp := doJSON(t, app, "GET", "/api/me", "", otherAuth); resp.status != fiber.StatusOK {
+		t.Fatalf("before revoking: status %d, body %s", resp.status, resp.body)
+	}
+
+	if resp := doJSON(t, app, "DELETE", "/api/me/sessions/"+other, "", auth); resp.status != fiber.StatusNoContent {
+		t.Fatalf("revoke: status %d, body %s", resp.status, resp.body)
+	}
+	if len(rows.ended) != 1 || rows.ended[0] != other {
+		t.Fatalf("gotrue sessions ended: %v, want [%s]", rows.ended, other)
+	}
+	if rows.revoked[other] == nil {
+		t.Fatal("session row not marked revoked")
+	}
+
+	if resp := doJSON(t, app, "GET", "/api/me", "", otherAuth); resp.status != fiber.StatusUnauthorized {
+		t.Fatalf("revoked session: status %d, want 401", resp.status)
+	}
+	if resp := doJSON(t, app, "DELETE", "/api/me/sessions/"+other, "", auth); resp.status != fiber.StatusNotFound {
+		t.Fatalf("revoking twice: status %d, want 404", resp.status)
+	}
+}
+
+func TestSessionRevokedInDatabaseIsRejected(t *testing.T) {
+	app, standIn := newTestApp(t)
+	userID := standIn.addAccount("revoked@example.com")
+
+	// Revoked elsewhere, e.g. on another instance whose blacklist entry has
+	// since expired.
+	revokedAt := time.Now().Add(-48 * time.Hour)
+	session := uuid.NewString()
+	standIn.rest = (&sessionRows{
+		revoked: map[string]*time.Time{session: &revokedAt},
+		userOf:  map[string]uuid.UUID{session: userID},
+	}).serve
+
+	auth := map[string]string{"Authorization": "Bearer " + signTestToken(t, userID, session)}
+	if resp := doJSON(t, app, "GET", "/api/me", "", auth); resp.status != fiber.StatusUnauthorized {
+		t.Fatalf("status %d, want 401", resp.status)
+	}
+}
+
+func TestSessionUseIsTrackedAsServiceRole(t *testing.T) {
+	app, standIn := newTestApp(t)
+	userID := standIn.addAccount("tracked@example.com")
+	session := uuid.NewString()
+
+	// The stand-in turns away anyone but the service role before the hook runs.
+	touched := make(chan string, 1)
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		if r.URL.Path != "/rest/v1/rpc/touch_user_session" {
+			return false
+		}
+		var params struct {
+			ID string `json:"p_id"`
+		}
+		json.Unmarshal(body, &params)
+		touched <- params.ID
+		w.Write([]byte(`true`))
+		return true
+	}
+
+	auth := map[string]string{"Authorization": "Bearer " + signTestToken(t, userID, session)}
+	if resp := doJSON(t, app, "GET", "/api/me", "", auth); resp.status != fiber.StatusOK {
+		t.Fatalf("status %d, body %s", resp.status, resp.body)
+	}
+
+	select {
+	case id := <-touched:
+		if id != session {
+			t.Errorf("touched session %s, want %s", id, session)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("session use was never recorded")
+	}
+}
@@ -0,0 +1,66 @@
+package main
+
+import (
+	"encoding/json"
+	"github.com/gofiber/fiber/v2"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestSignInLockoutIgnoresEmailCase(t *testing.T) {
+	app, standIn := newTestApp(t)
+	victim := standIn.addAccount("victim@example.com")
+	other := standIn.addAccount("other@example.com")
+
+	lockedUntil := time.Now().Add(time.Hour)
+	var failures []string
+	standIn.rest = func(w http.ResponseWriter, r *http.Request, body []byte) bool {
+		switch r.URL.Path {
+		case "/rest/v1/users":
+			if r.Method != http.MethodGet {
+				return false
+			}
+			switch strings.TrimPrefix(r.URL.Query().Get("email"), "eq.") {
+			case "victim@example.com":
+				writeRows(w, []map[string]interface{}{{
+					"id": victim, "email": "victim@example.com", "is_active": true,
+					"failed_login_attempts": 5, "locked_until": lockedUntil,
+				}})
+			case "other@example.com":
+				writeRows(w, []map[string]interface{}{{"id": other, "email": "other@example.com", "is_active": true}})
+			default:
+				writeRows(w, []map[string]interface{}{})
+			}
+		case "/rest/v1/rpc/record_login_failure":
+			var params struct {
+				UserID string `json:"p_user_id"`
+			}
+			json.Unmarshal(body, &params)
+			failures = append(failures, params.UserID)
+			writeRows(w, []map[string]interface{}{{"failed_attempts": 1, "locked_until": nil}})
+		case "/rest/v1/rpc/record_ip_login_failure":
+			writeRows(w, []map[string]interface{}{{"failed_attempts": 1, "locked_until": nil}})
+		default:
+			return false
+		}
+		return true
+	}
+
+	resp := postJSON(t, app, "/api/auth/signin", `{"email":" Victim@Example.COM ","password":"guess"}`)
+	if resp.status != fiber.StatusTooManyRequests {
+		t.Fatalf("locked account in other case: status %d, body %s", resp.status, resp.body)
+	}
+	if calls := standIn.calls("POST /token"); calls != 0 {
+		t.Errorf("gotrue was asked %d times despite the lock", calls)
+	}
+
+	resp = postJSON(t, app, "/api/auth/signin", `{"email":"OTHER@example.com","password":"wrong"}`)
+	if resp.status != fiber.StatusUnauthorized {
+		t.Fatalf("wrong password: status %d, body %s", resp.status, resp.body)
+	}
+	if len(failures) != 1 || failures[0] != other.String() {
+		t.Errorf("failures recorded for %v, want [%s]", failures, other)
+	}
+}
@@ -0,0 +1,231 @@
+package main
+
+import (
+	"api/config"
+	"api/middleware"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"github.com/gofiber/fiber/v2"
+	"github.com/google/uuid"
+	"github.com/supabase-community/supabase-go"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testJWTSecret  = "test-jwt-secret-of-at-least-32-bytes"
+	testServiceKey = "service-key"
+)
+
+// serviceRoleRPCs are the functions revoked from anon and authenticated;
+// the stand-in refuses them without the service role key, as PostgREST
+// would.
+var serviceRoleRPCs = map[string]bool{
+	"append_audit_event":       true,
+	"end_auth_session":         true,
+	"erase_user":               true,
+	"rate_limit_take":          true,
+	"rate_limit_prune":         true,
+	"record_login_failure":     true,
+	"record_ip_login_failure":  true,
+	"sole_owned_organizations": true,
+	"sync_auth_user":           true,
+	"touch_user_session":       true,
+}
+
+// signTestToken signs an access token for the user as gotrue would.
+func signTestToken(t *testing.T, userID uuid.UUID, sessionID string) string {
+	t.Helper()
+	return signTestTokenAAL(t, userID, sessionID, "aal1")
+}
+
+// signTestTokenAAL signs a token at the given assurance level, e.g. "aal2"
+// for a session that passed MFA.
+func signTestTokenAAL(t *testing.T, userID uuid.UUID, sessionID, aal string) string {
+	t.Helper()
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	payload, err := json.Marshal(map[string]interface{}{
+		"sub":        userID,
+		"role":       "authenticated",
+		"aud":        "authenticated",
+		"iss":        config.GetAuthURL(),
+		"aal":        aal,
+		"session_id": sessionID,
+		"iat":        time.Now().Unix(),
+		"exp":        time.Now().Add(time.Hour).Unix(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	signed := header + "." + base64.RawURLEncoding.EncodeToString(payload)
+	mac := hmac.New(sha256.New, []byte(testJWTSecret))
+	mac.Write([]byte(signed))
+	return signed + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// supabaseStandIn plays gotrue and PostgREST for route tests. Accounts are
+// shared between the two, as auth.users and public.users would be.
+type supabaseStandIn struct {
+	mutex sync.Mutex
+	// accounts maps an email to its user ID.
+	accounts map[string]uuid.UUID
+	// codes maps an email to the one-time code gotrue would accept for it.
+	codes map[string]string
+	// gotrueCalls counts requests per gotrue path, e.g. "POST /otp".
+	gotrueCalls map[string]int
+	// rest, when set, answers PostgREST requests first; returning false
+	// falls back to the defaults below.
+	rest func(w http.ResponseWriter, r *http.Request, body []byte) bool
+}
+
+// newTestApp starts a stand-in, points the clients at it and returns the
+// app with every route registered.
+func newTestApp(t *testing.T) (*fiber.App, *supabaseStandIn) {
+	t.Helper()
+
+	standIn := &supabaseStandIn{
+		accounts:    make(map[string]uuid.UUID),
+		codes:       make(map[string]string),
+		gotrueCalls: make(map[string]int),
+	}
+	server := httptest.NewServer(standIn)
+	t.Cleanup(server.Close)
+
+	t.Setenv("SUPABASE_URL", server.URL)
+	t.Setenv("SUPABASE_ANON_KEY", "anon-key")
+	t.Setenv("SUPABASE_JWT_SECRET", testJWTSecret)
+	t.Setenv("SUPABASE_SERVICE_ROLE_KEY", testServiceKey)
+	if err := config.InitJWT(); err != nil {
+		t.Fatal(err)
+	}
+	if err := config.InitPostgres(); err != nil {
+		t.Fatal(err)
+	}
+	client, err := supabase.NewClient(server.URL, "anon-key", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config.SupabaseClient = client
+	middleware.SetRateLimitStore(middleware.NewMemoryRateLimitStore())
+
+	return newApp(), standIn
+}
+
+func (s *supabaseStandIn) addAccount(email string) uuid.UUID {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	id := uuid.New()
+	s.accounts[email] = id
+	return id
+}
+
+func (s *supabaseStandIn) calls(path string) int {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.gotrueCalls[path]
+}
+
+func (s *supabaseStandIn) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("Content-Type", "application/json")
+
+	switch {
+	case strings.HasPrefix(r.URL.Path, "/auth/v1/"):
+		s.serveGotrue(w, r, strings.TrimPrefix(r.URL.Path, "/auth/v1"), body)
+	case strings.HasPrefix(r.URL.Path, "/rest/v1/"):
+		if serviceRoleRPCs[strings.TrimPrefix(r.URL.Path, "/rest/v1/rpc/")] && r.Header.Get("apikey") != testServiceKey {
+			w.WriteHeader(http.StatusUnauthorized)
+			w.Write([]byte(`{"code":"42501","message":"permission denied for function"}`))
+			return
+		}
+		if s.rest != nil && s.rest(w, r, body) {
+			return
+		}
+		s.serveRest(w, r)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+func (s *supabaseStandIn) serveGotrue(w http.ResponseWriter, r *http.Request, path string, body []byte) {
+	var input struct {
+		Email      string `json:"email"`
+		Token      string `json:"token"`
+		CreateUser bool   `json:"create_user"`
+	}
+	json.Unmarshal(body, &input)
+
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.gotrueCalls[r.Method+" "+path]++
+	id, exists := s.accounts[input.Email]
+
+	switch r.Method + " " + path {
+	case "POST /recover":
+		// gotrue answers the same whether or not the account exists.
+		w.Write([]byte(`{}`))
+	case "POST /otp":
+		if !exists && !input.CreateUser {
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			w.Write([]byte(`{"code":422,"error_code":"otp_disabled","msg":"Signups not allowed for otp"}`))
+			return
+		}
+		w.Write([]byte(`{}`))
+	case "POST /verify":
+		if !exists || input.Token == "" || s.codes[input.Email] != input.Token {
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte(`{"code":403,"error_code":"otp_expired","msg":"Token has expired or is invalid"}`))
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"access_token":  "access-" + id.String(),
+			"refresh_token": "refresh-" + id.String(),
+			"token_type":    "bearer",
+			"expires_in":    3600,
+			"user":          map[string]interface{}{"id": id, "email": input.Email},
+		})
+	case "PUT /user":
+		w.Write([]byte(`{"id":"` + uuid.NewString() + `"}`))
+	case "POST /logout":
+		s.gotrueCalls["POST /logout?"+r.URL.RawQuery]++
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(`{"code":404,"msg":"not found"}`))
+	}
+}
+
+// serveRest answers lookups of users by email from the accounts and
+// accepts every write.
+func (s *supabaseStandIn) serveRest(w http.ResponseWriter, r *http.Request) {
+	if r.Method == http.MethodGet && r.URL.Path == "/rest/v1/users" {
+		email := strings.TrimPrefix(r.URL.Query().Get("email"), "eq.")
+		userID := strings.TrimPrefix(r.URL.Query().Get("id"), "eq.")
+
+		rows := []map[string]interface{}{}
+		s.mutex.Lock()
+		for accountEmail, id := range s.accounts {
+			if accountEmail == email || id.String() == userID {
+				rows = append(rows, map[string]interface{}{"id": id, "email": accountEmail, "is_active": true})
+			}
+		}
+		s.mutex.Unlock()
+		writeRows(w, rows)
+		return
+	}
+	writeRows(w, []map[string]interface{}{})
+}
+
+// writeRows answers like PostgREST, with the count in Content-Range.
+func writeRows(w http.ResponseWriter, rows []map[string]interface{}) {
+	w.Header().Set("Content-Range", fmt.Sprintf("0-%d/%d", len(rows)-1, len(rows)))
+	json.NewEncoder(w).Encode(rows)
+}
@@ -0,0 +1,99 @@
+package utils
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+var bloomMagic = [4]byte{'B', 'L', 'M', '1'}
+
+// BloomFilter answers "definitely not in the set" or "probably in the set"
+// in a fraction of the space the set itself would take.
+type BloomFilter struct {
+	bits []uint64
+	m    uint64
+	k    uint32
+}
+
+// NewBloomFilter sizes a filter for n values at the given false positive
+// rate.
+func NewBloomFilter(n int, falsePositiveRate float64) *BloomFilter {
+	m := uint64(math.Ceil(-float64(n) * math.Log(falsePositiveRate) / (math.Ln2 * math.Ln2)))
+	k := uint32(math.Round(float64(m) / float64(n) * math.Ln2))
+	if k < 1 {
+		k = 1
+	}
+	return &BloomFilter{bits: make([]uint64, (m+63)/64), m: m, k: k}
+}
+
+// positions derives the k bit positions of value by double hashing.
+func (b *BloomFilter) positions(value string) []uint64 {
+	sum := sha256.Sum256([]byte(value))
+	h1 := binary.LittleEndian.Uint64(sum[0:8])
+	h2 := binary.LittleEndian.Uint64(sum[8:16]) | 1
+
+	positions := make([]uint64, b.k)
+	for i := range positions {
+		positions[i] = (h1 + uint64(i)*h2) % b.m
+	}
+	return positions
+}
+
+func (b *BloomFilter) Add(value string) {
+	for _, p := range b.positions(value) {
+		b.bits[p/64] |= 1 << (p % 64)
+	}
+}
+
+func (b *BloomFilter) Contains(value string) bool {
+	for _, p := range b.positions(value) {
+		if b.bits[p/64]&(1<<(p%64)) == 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// WriteTo serializes the filter as a magic number, k, m and the bit array,
+// all little-endian.
+func (b *BloomFilter) WriteTo(w io.Writer) (int64, error) {
+	header := make([]byte, 16)
+	copy(header, bloomMagic[:])
+	binary.LittleEndian.PutUint32(header[4:8], b.k)
+	binary.LittleEndian.PutUint64(header[8:16], b.m)
+	if _, err := w.Write(header); err != nil {
+		return 0, err
+	}
+	if err := binary.Write(w, binary.LittleEndian, b.bits); err != nil {
+		return 0, err
+	}
+	return int64(len(header) + 8*len(b.bits)), nil
+}
+
+// ReadBloomFilter reads a filter written by WriteTo.
+func ReadBloomFilter(r io.Reader) (*BloomFilter, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(r, header); err != nil {
+		return nil, err
+	}
+	if [4]byte(header[:4]) != bloomMagic {
+		return nil, errors.New("not a bloom filter")
+	}
+
+	b := &BloomFilter{
+		k: binary.LittleEndian.Uint32(header[4:8]),
+		m: binary.LittleEndian.Uint64(header[8:16]),
+	}
+	if b.k == 0 || b.m == 0 {
+		return nil, errors.New("corrupt bloom filter header")
+	}
+
+	b.bits = make([]uint64, (b.m+63)/64)
+	if err := binary.Read(r, binary.LittleEndian, b.bits); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
@@ -0,0 +1,76 @@
+//go:build ignore
+
+// Builds breached_passwords.bloom.gz from breached_passwords.txt. Run with
+// go generate ./utils after editing the list.
+package main
+
+import (
+	"api/utils"
+	"bufio"
+	"compress/gzip"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+)
+
+var suffixes = []string{
+	"1", "2", "3", "7", "11", "12", "13", "21", "22", "23", "69", "99", "00", "01", "007",
+	"123", "1234", "12345", "!", "!!", "1!", "123!", "@", "#", "?", ".",
+}
+
+func variants(base string) []string {
+	out := []string{base}
+	for _, suffix := range suffixes {
+		out = append(out, base+suffix)
+	}
+	for year := 1970; year <= 2030; year++ {
+		y := strconv.Itoa(year)
+		out = append(out, base+y, base+y[2:])
+	}
+	if len(base) <= 6 {
+		out = append(out, base+base)
+	}
+	return out
+}
+
+func main() {
+	in, err := os.Open("breached_passwords.txt")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer in.Close()
+
+	var passwords []string
+	scanner := bufio.NewScanner(in)
+	for scanner.Scan() {
+		line := strings.ToLower(strings.TrimSpace(scanner.Text()))
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		passwords = append(passwords, variants(line)...)
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal(err)
+	}
+
+	filter := utils.NewBloomFilter(len(passwords), 0.001)
+	for _, password := range passwords {
+		filter.Add(password)
+	}
+
+	out, err := os.Create("breached_passwords.bloom.gz")
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer out.Close()
+
+	gz, _ := gzip.NewWriterLevel(out, gzip.BestCompression)
+	if _, err := filter.WriteTo(gz); err != nil {
+		log.Fatal(err)
+	}
+	if err := gz.Close(); err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("wrote %d passwords", len(passwords))
+}
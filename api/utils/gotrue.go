@@ -0,0 +1,125 @@
+package utils
+
+import (
+	"api/config"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/google/uuid"
+	"github.com/supabase-community/gotrue-go/types"
+	"io"
+	"net/http"
+	"os"
+	"time"
+)
+
+var gotrueHTTPClient = &http.Client{Timeout: 10 * time.Second}
+
+// ErrGotrueRejected is returned when gotrue answers with a 4xx status, e.g.
+// for an expired or unknown code.
+var ErrGotrueRejected = errors.New("gotrue rejected the request")
+
+// ErrGotrueNotFound is the ErrGotrueRejected returned for a 404.
+var ErrGotrueNotFound = fmt.Errorf("%w: not found", ErrGotrueRejected)
+
+// gotrueRequest calls the gotrue HTTP API directly for the endpoints the
+// gotrue client doesn't support properly. out may be nil.
+func gotrueRequest(method, path, accessToken string, body, out interface{}) error {
+	var reader io.Reader
+	if body != nil {
+		payload, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reader = bytes.NewReader(payload)
+	}
+
+	req, err := http.NewRequest(method, config.GetAuthURL()+path, reader)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("apikey", os.Getenv("SUPABASE_ANON_KEY"))
+	req.Header.Set("Content-Type", "application/json")
+	if accessToken != "" {
+		req.Header.Set("Authorization", "Bearer "+accessToken)
+	}
+
+	resp, err := gotrueHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		if resp.StatusCode == http.StatusNotFound {
+			return fmt.Errorf("%w: %s %s: %s", ErrGotrueNotFound, method, path, respBody)
+		}
+		if resp.StatusCode >= 400 && resp.StatusCode < 500 {
+			return fmt.Errorf("%w: %s %s: status %d: %s", ErrGotrueRejected, method, path, resp.StatusCode, respBody)
+		}
+		return fmt.Errorf("gotrue %s %s: status %d: %s", method, path, resp.StatusCode, respBody)
+	}
+
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// GotrueLogout ends gotrue sessions for the token's user. scope is "local"
+// for the token's own session, "others" for every other session and
+// "global" for all of them. The gotrue client only supports global logout.
+func GotrueLogout(accessToken, scope string) error {
+	return gotrueRequest(http.MethodPost, "/logout?scope="+scope, accessToken, nil, nil)
+}
+
+// GotrueVerify exchanges an emailed code for a session. The gotrue client's
+// VerifyForUser insists on a redirect and never returns the session.
+func GotrueVerify(email, token string, verificationType types.VerificationType) (*types.Session, error) {
+	body := map[string]string{
+		"email": email,
+		"token": token,
+		"type":  string(verificationType),
+	}
+
+	var session types.Session
+	if err := gotrueRequest(http.MethodPost, "/verify", "", body, &session); err != nil {
+		return nil, err
+	}
+	return &session, nil
+}
+
+// GotrueUser is the part of a gotrue admin user record the API keeps in
+// sync with public.users.
+type GotrueUser struct {
+	ID        uuid.UUID  `json:"id"`
+	Email     string     `json:"email"`
+	DeletedAt *time.Time `json:"deleted_at"`
+}
+
+// GotrueAdminListUsers returns one page of gotrue's users, starting at page
+// 1. The gotrue client's AdminListUsers can't page. It needs the service
+// role key.
+func GotrueAdminListUsers(page, perPage int) ([]GotrueUser, error) {
+	var resp struct {
+		Users []GotrueUser `json:"users"`
+	}
+	path := fmt.Sprintf("/admin/users?page=%d&per_page=%d", page, perPage)
+	if err := gotrueRequest(http.MethodGet, path, config.GetServiceRoleKey(), nil, &resp); err != nil {
+		return nil, err
+	}
+	return resp.Users, nil
+}
+
+// GotrueAdminDeleteUser deletes a gotrue user. A user that is already gone
+// counts as deleted, so the call can be retried safely. It needs the service
+// role key.
+func GotrueAdminDeleteUser(id uuid.UUID) error {
+	err := gotrueRequest(http.MethodDelete, "/admin/users/"+id.String(), config.GetServiceRoleKey(), nil, nil)
+	if errors.Is(err, ErrGotrueNotFound) {
+		return nil
+	}
+	return err
+}
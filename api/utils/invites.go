@@ -0,0 +1,25 @@
+package utils
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+)
+
+// GenerateInviteToken returns a single-use signup invite token with 256
+// random bits.
+func GenerateInviteToken() (string, error) {
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	return "inv_" + base64.RawURLEncoding.EncodeToString(raw), nil
+}
+
+// HashInviteToken hashes a token for storage. Tokens are random enough that
+// a plain hash can't be brute-forced.
+func HashInviteToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
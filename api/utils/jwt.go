@@ -0,0 +1,321 @@
+package utils
+
+import (
+	"api/config"
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	ErrInvalidToken = errors.New("invalid token")
+	ErrTokenExpired = errors.New("token expired")
+)
+
+// Claims are the parts of a Supabase access token the API relies on.
+type Claims struct {
+	Subject      string                 `json:"sub"`
+	Email        string                 `json:"email"`
+	Role         string                 `json:"role"`
+	AAL          string                 `json:"aal"`
+	SessionID    string                 `json:"session_id"`
+	Issuer       string                 `json:"iss"`
+	Audience     Audience               `json:"aud"`
+	IssuedAt     int64                  `json:"iat"`
+	NotBefore    int64                  `json:"nbf,omitempty"`
+	ExpiresAt    int64                  `json:"exp"`
+	AppMetadata  map[string]interface{} `json:"app_metadata"`
+	UserMetadata map[string]interface{} `json:"user_metadata"`
+	// Impersonator is the admin acting as Subject. Only set on tokens from
+	// SignImpersonationToken.
+	Impersonator string `json:"impersonator,omitempty"`
+}
+
+// Expiry returns the exp claim as a time.
+func (c *Claims) Expiry() time.Time {
+	return time.Unix(c.ExpiresAt, 0)
+}
+
+// Audience accepts both the string and array forms of the aud claim.
+type Audience []string
+
+func (a *Audience) UnmarshalJSON(data []byte) error {
+	var single string
+	if err := json.Unmarshal(data, &single); err == nil {
+		*a = Audience{single}
+		return nil
+	}
+
+	var many []string
+	if err := json.Unmarshal(data, &many); err != nil {
+		return err
+	}
+	*a = many
+	return nil
+}
+
+func (a Audience) contains(audience string) bool {
+	for _, value := range a {
+		if value == audience {
+			return true
+		}
+	}
+	return false
+}
+
+type jwtHeader struct {
+	Alg string `json:"alg"`
+	Kid string `json:"kid,omitempty"`
+}
+
+// VerifyToken checks an access token's signature, expiry, audience and
+// issuer without calling the auth server. HS256 tokens are verified with the
+// project secret; RS256 and ES256 tokens with the project's JWKS.
+func VerifyToken(token string) (*Claims, error) {
+	cfg := config.GetJWTConfig()
+
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, ErrInvalidToken
+	}
+
+	headerJSON, err := base64.RawURLEncoding.DecodeString(parts[0])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var header jwtHeader
+	if err := json.Unmarshal(headerJSON, &header); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	signature, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, ErrInvalidToken
+	}
+	var claims Claims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return nil, ErrInvalidToken
+	}
+
+	// The unverified issuer only picks the key. Impersonation tokens are
+	// signed with a secret of their own, so neither kind of token can pass as
+	// the other.
+	signed := []byte(parts[0] + "." + parts[1])
+	impersonation := claims.Issuer == ImpersonationIssuer
+	if impersonation {
+		err = verifyImpersonationSignature(header, signed, signature)
+		if claims.Impersonator == "" {
+			err = ErrInvalidToken
+		}
+	} else {
+		err = verifySignature(cfg, header, signed, signature)
+		claims.Impersonator = ""
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	if claims.ExpiresAt == 0 || now.After(claims.Expiry().Add(cfg.Leeway)) {
+		return nil, ErrTokenExpired
+	}
+	if claims.NotBefore != 0 && now.Add(cfg.Leeway).Before(time.Unix(claims.NotBefore, 0)) {
+		return nil, ErrInvalidToken
+	}
+	if cfg.Audience != "" && !claims.Audience.contains(cfg.Audience) {
+		return nil, ErrInvalidToken
+	}
+	if cfg.Issuer != "" && claims.Issuer != cfg.Issuer && !impersonation {
+		return nil, ErrInvalidToken
+	}
+	if claims.Subject == "" {
+		return nil, ErrInvalidToken
+	}
+
+	return &claims, nil
+}
+
+func verifySignature(cfg config.JWTConfig, header jwtHeader, signed, signature []byte) error {
+	digest := sha256.Sum256(signed)
+
+	switch header.Alg {
+	case "HS256":
+		if len(cfg.Secret) == 0 {
+			return ErrInvalidToken
+		}
+		mac := hmac.New(sha256.New, cfg.Secret)
+		mac.Write(signed)
+		if !hmac.Equal(signature, mac.Sum(nil)) {
+			return ErrInvalidToken
+		}
+		return nil
+
+	case "RS256":
+		key, err := jwks.key(cfg.JWKSURL, header.Kid)
+		if err != nil {
+			return err
+		}
+		pub, ok := key.(*rsa.PublicKey)
+		if !ok || rsa.VerifyPKCS1v15(pub, crypto.SHA256, digest[:], signature) != nil {
+			return ErrInvalidToken
+		}
+		return nil
+
+	case "ES256":
+		key, err := jwks.key(cfg.JWKSURL, header.Kid)
+		if err != nil {
+			return err
+		}
+		pub, ok := key.(*ecdsa.PublicKey)
+		if !ok || len(signature) != 64 {
+			return ErrInvalidToken
+		}
+		r := new(big.Int).SetBytes(signature[:32])
+		s := new(big.Int).SetBytes(signature[32:])
+		if !ecdsa.Verify(pub, digest[:], r, s) {
+			return ErrInvalidToken
+		}
+		return nil
+	}
+
+	return ErrInvalidToken
+}
+
+// jwksCache holds the project's signing keys. It refetches on a schedule and
+// when a token names an unknown key, but at most once a minute so bogus kids
+// can't be used to hammer the auth server.
+type jwksCache struct {
+	keys      map[string]crypto.PublicKey
+	fetchedAt time.Time
+	mutex     sync.Mutex
+}
+
+var jwks = &jwksCache{}
+
+const (
+	jwksMaxAge     = 10 * time.Minute
+	jwksMinRefetch = time.Minute
+)
+
+func (j *jwksCache) key(url, kid string) (crypto.PublicKey, error) {
+	j.mutex.Lock()
+	defer j.mutex.Unlock()
+
+	key, ok := j.keys[kid]
+	stale := time.Since(j.fetchedAt) > jwksMaxAge
+	if ok && !stale {
+		return key, nil
+	}
+
+	if stale || time.Since(j.fetchedAt) > jwksMinRefetch {
+		keys, err := fetchJWKS(url)
+		j.fetchedAt = time.Now()
+		if err != nil {
+			if ok {
+				return key, nil
+			}
+			return nil, fmt.Errorf("failed to fetch JWKS: %w", err)
+		}
+		j.keys = keys
+	}
+
+	if key, ok := j.keys[kid]; ok {
+		return key, nil
+	}
+	return nil, ErrInvalidToken
+}
+
+type jsonWebKey struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid,omitempty"`
+	Crv string `json:"crv"`
+	N   string `json:"n"`
+	E   string `json:"e"`
+	X   string `json:"x"`
+	Y   string `json:"y"`
+}
+
+func fetchJWKS(url string) (map[string]crypto.PublicKey, error) {
+	client := http.Client{Timeout: 5 * time.Second}
+	resp, err := client.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status %d", resp.StatusCode)
+	}
+
+	var set struct {
+		Keys []jsonWebKey `json:"keys"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&set); err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]crypto.PublicKey)
+	for _, jwk := range set.Keys {
+		key, err := jwk.publicKey()
+		if err != nil {
+			continue
+		}
+		keys[jwk.Kid] = key
+	}
+	return keys, nil
+}
+
+func (k jsonWebKey) publicKey() (crypto.PublicKey, error) {
+	switch k.Kty {
+	case "RSA":
+		n, err := base64.RawURLEncoding.DecodeString(k.N)
+		if err != nil {
+			return nil, err
+		}
+		e, err := base64.RawURLEncoding.DecodeString(k.E)
+		if err != nil {
+			return nil, err
+		}
+		return &rsa.PublicKey{
+			N: new(big.Int).SetBytes(n),
+			E: int(new(big.Int).SetBytes(e).Int64()),
+		}, nil
+
+	case "EC":
+		if k.Crv != "P-256" {
+			return nil, fmt.Errorf("unsupported curve %q", k.Crv)
+		}
+		x, err := base64.RawURLEncoding.DecodeString(k.X)
+		if err != nil {
+			return nil, err
+		}
+		y, err := base64.RawURLEncoding.DecodeString(k.Y)
+		if err != nil {
+			return nil, err
+		}
+		return &ecdsa.PublicKey{
+			Curve: elliptic.P256(),
+			X:     new(big.Int).SetBytes(x),
+			Y:     new(big.Int).SetBytes(y),
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported key type %q", k.Kty)
+}
@@ -0,0 +1,144 @@
+package utils
+
+import (
+	"api/config"
+	"api/models"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+)
+
+// NormalizeCIDRs validates an allowlist of IPs and CIDR ranges and returns
+// it in canonical CIDR form, so single addresses are stored as /32 or /128.
+func NormalizeCIDRs(values []string) ([]string, error) {
+	cidrs := make([]string, 0, len(values))
+	for _, value := range values {
+		network, err := config.ParseCIDROrIP(strings.TrimSpace(value))
+		if err != nil {
+			return nil, fmt.Errorf("invalid CIDR %q", value)
+		}
+		cidrs = append(cidrs, network.String())
+	}
+	return cidrs, nil
+}
+
+// NormalizeScopes validates scope names against models.APIKeyScopes and
+// drops duplicates.
+func NormalizeScopes(values []string) ([]string, error) {
+	scopes := make([]string, 0, len(values))
+	seen := map[string]bool{}
+	for _, value := range values {
+		scope := strings.ToLower(strings.TrimSpace(value))
+		if !knownScope(scope) {
+			return nil, fmt.Errorf("unknown scope %q", value)
+		}
+		if !seen[scope] {
+			seen[scope] = true
+			scopes = append(scopes, scope)
+		}
+	}
+	return scopes, nil
+}
+
+func knownScope(scope string) bool {
+	for _, known := range models.APIKeyScopes {
+		if scope == known {
+			return true
+		}
+	}
+	return false
+}
+
+// IPAllowed reports whether ip falls inside one of the stored CIDRs.
+func IPAllowed(cidrs []string, ip string) bool {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return false
+	}
+
+	for _, cidr := range cidrs {
+		_, network, err := net.ParseCIDR(cidr)
+		if err == nil && network.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// NormalizeOriginPatterns validates referrer patterns. A pattern is a host
+// with an optional scheme and port, and may start with "*." to match any
+// subdomain: "https://app.example.com", "*.example.com", "localhost:3000".
+func NormalizeOriginPatterns(values []string) ([]string, error) {
+	patterns := make([]string, 0, len(values))
+	for _, value := range values {
+		pattern := strings.ToLower(strings.TrimSuffix(strings.TrimSpace(value), "/"))
+		if _, _, _, err := splitOriginPattern(pattern); err != nil {
+			return nil, fmt.Errorf("invalid referrer pattern %q: %w", value, err)
+		}
+		patterns = append(patterns, pattern)
+	}
+	return patterns, nil
+}
+
+// OriginAllowed reports whether the Origin or Referer value matches one of
+// the patterns. Only the scheme, host and port of the value are compared.
+func OriginAllowed(patterns []string, origin string) bool {
+	u, err := url.Parse(origin)
+	if err != nil || u.Host == "" {
+		return false
+	}
+	scheme, host, port := strings.ToLower(u.Scheme), strings.ToLower(u.Hostname()), u.Port()
+
+	for _, pattern := range patterns {
+		pScheme, pHost, pPort, err := splitOriginPattern(pattern)
+		if err != nil {
+			continue
+		}
+		if pScheme != "" && pScheme != scheme {
+			continue
+		}
+		if pPort != "" && pPort != port {
+			continue
+		}
+		if strings.HasPrefix(pHost, "*.") {
+			if strings.HasSuffix(host, pHost[1:]) {
+				return true
+			}
+			continue
+		}
+		if pHost == host {
+			return true
+		}
+	}
+	return false
+}
+
+func splitOriginPattern(pattern string) (scheme, host, port string, err error) {
+	rest := pattern
+	if before, after, ok := strings.Cut(pattern, "://"); ok {
+		scheme, rest = before, after
+		if scheme != "http" && scheme != "https" {
+			return "", "", "", errors.New("scheme must be http or https")
+		}
+	}
+	if strings.ContainsAny(rest, "/?#@") {
+		return "", "", "", errors.New("only scheme, host and port are allowed")
+	}
+
+	host = rest
+	if h, p, splitErr := net.SplitHostPort(rest); splitErr == nil {
+		host, port = h, p
+	}
+
+	wildcard := strings.HasPrefix(host, "*.")
+	if strings.Contains(strings.TrimPrefix(host, "*."), "*") {
+		return "", "", "", errors.New("wildcards are only allowed as the first label")
+	}
+	if host == "" || (wildcard && len(host) <= 2) {
+		return "", "", "", errors.New("host is required")
+	}
+
+	return scheme, host, port, nil
+}
@@ -1,41 +1,157 @@
 package utils
 
 import (
+	"api/config"
+	"crypto/hmac"
 	"crypto/rand"
 	"crypto/sha256"
-	"encoding/base64"
 	"encoding/hex"
 	"fmt"
 	"github.com/google/uuid"
+	"hash/crc32"
+	"regexp"
 )
 
+// Keys look like sk_live_<32 random base62 chars><6 char CRC32 checksum>.
+// The checksum lets typos and random strings be rejected without a database
+// lookup, and the fixed shape lets secret scanners match APIKeyPattern.
 const (
-	keyPrefix = "sk_"
-	keyLength = 32
+	keyPrefix      = "sk_"
+	secretLength   = 32
+	checksumLength = 6
+	displayLength  = 4
+	keyLength      = len(keyPrefix) + len("live_") + secretLength + checksumLength
+	base62Alphabet = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz"
 )
 
-func GenerateAPIKey() (string, error) {
-	randomBytes := make([]byte, keyLength)
-	if _, err := rand.Read(randomBytes); err != nil {
+const (
+	KeyEnvironmentLive = "live"
+	KeyEnvironmentTest = "test"
+)
+
+// APIKeyPattern matches keys in the current format, for secret scanners.
+var APIKeyPattern = regexp.MustCompile(`\bsk_(?:live|test)_[0-9A-Za-z]{38}\b`)
+
+func GenerateAPIKey(environment string) (string, error) {
+	if environment != KeyEnvironmentLive && environment != KeyEnvironmentTest {
+		return "", fmt.Errorf("unknown key environment %q", environment)
+	}
+
+	secret, err := randomBase62(secretLength)
+	if err != nil {
 		return "", fmt.Errorf("failed to generate random bytes: %w", err)
 	}
 
-	randomStr := base64.URLEncoding.EncodeToString(randomBytes)
+	body := keyPrefix + environment + "_" + secret
+	return body + keyChecksum(body), nil
+}
+
+// KeyEnvironment returns "live" or "test", or "" for legacy keys.
+func KeyEnvironment(apiKey string) string {
+	if !isCurrentKeyFormat(apiKey) {
+		return ""
+	}
+	return apiKey[len(keyPrefix) : len(keyPrefix)+4]
+}
 
-	keyUUID := uuid.New().String()
+// KeyDisplayPrefix is the non-secret start of a key, stored so owners can
+// tell their keys apart, e.g. "sk_live_AbCd".
+func KeyDisplayPrefix(apiKey string) string {
+	n := len(keyPrefix) + len(KeyEnvironmentLive) + 1 + displayLength
+	if len(apiKey) < n {
+		return ""
+	}
+	return apiKey[:n]
+}
 
-	apiKey := fmt.Sprintf("%s%s_%s", keyPrefix, keyUUID, randomStr)
+func keyChecksum(body string) string {
+	sum := crc32.ChecksumIEEE([]byte(body))
 
-	return apiKey, nil
+	checksum := make([]byte, checksumLength)
+	for i := checksumLength - 1; i >= 0; i-- {
+		checksum[i] = base62Alphabet[sum%62]
+		sum /= 62
+	}
+	return string(checksum)
 }
 
-func HashAPIKey(apiKey string) string {
-	hasher := sha256.New()
-	hasher.Write([]byte(apiKey))
-	return hex.EncodeToString(hasher.Sum(nil))
+// randomBase62 draws characters by rejection sampling so every character
+// is equally likely.
+func randomBase62(n int) (string, error) {
+	result := make([]byte, 0, n)
+	buf := make([]byte, n)
+	for len(result) < n {
+		if _, err := rand.Read(buf); err != nil {
+			return "", err
+		}
+		for _, b := range buf {
+			// 248 is the largest multiple of 62 below 256
+			if b < 248 && len(result) < n {
+				result = append(result, base62Alphabet[b%62])
+			}
+		}
+	}
+	return string(result), nil
 }
 
+// LegacyHashVersion marks keys stored as a bare SHA-256 of the key, from
+// before hashes were peppered. They are upgraded on their next use.
+const LegacyHashVersion = 0
+
+// HashAPIKey hashes a key with the current pepper and returns the hash
+// together with the version it was made with.
+func HashAPIKey(apiKey string) (string, int) {
+	version := config.CurrentKeyPepperVersion()
+	return HashAPIKeyVersion(apiKey, version), version
+}
+
+// HashAPIKeyVersion hashes a key as HMAC-SHA256 with the pepper of the given
+// version. It returns "" when that version is no longer configured.
+func HashAPIKeyVersion(apiKey string, version int) string {
+	if version == LegacyHashVersion {
+		hasher := sha256.New()
+		hasher.Write([]byte(apiKey))
+		return hex.EncodeToString(hasher.Sum(nil))
+	}
+
+	pepper, ok := config.GetKeyPepper(version)
+	if !ok {
+		return ""
+	}
+
+	mac := hmac.New(sha256.New, pepper)
+	mac.Write([]byte(apiKey))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// APIKeyHashes returns the key's hash under every version that may still be
+// stored: each configured pepper plus the legacy unpeppered hash.
+func APIKeyHashes(apiKey string) map[int]string {
+	hashes := map[int]string{
+		LegacyHashVersion: HashAPIKeyVersion(apiKey, LegacyHashVersion),
+	}
+	for _, version := range config.GetKeyPepperVersions() {
+		hashes[version] = HashAPIKeyVersion(apiKey, version)
+	}
+	return hashes
+}
+
+// ValidateKeyFormat checks a key's shape and checksum. Keys issued before
+// the checksummed format (sk_<uuid>_<base64>) are still accepted.
 func ValidateKeyFormat(apiKey string) bool {
+	if isCurrentKeyFormat(apiKey) {
+		body := apiKey[:len(apiKey)-checksumLength]
+		return keyChecksum(body) == apiKey[len(body):]
+	}
+
+	return validateLegacyKeyFormat(apiKey)
+}
+
+func isCurrentKeyFormat(apiKey string) bool {
+	return len(apiKey) == keyLength && APIKeyPattern.MatchString(apiKey)
+}
+
+func validateLegacyKeyFormat(apiKey string) bool {
 	if len(apiKey) < len(keyPrefix)+37 || !startWith(apiKey, keyPrefix) {
 		return false
 	}
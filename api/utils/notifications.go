@@ -0,0 +1,31 @@
+package utils
+
+import (
+	"api/config"
+	"github.com/google/uuid"
+	"time"
+)
+
+const (
+	NotificationAPIKeyLeaked        = "api_key_leaked"
+	NotificationMFARecoveryCodeUsed = "mfa_recovery_code_used"
+	NotificationAccountDeletion     = "account_deletion_scheduled"
+	NotificationOrgInvitation       = "organization_invitation"
+)
+
+// NotifyUser queues an in-app notification for a user. Delivery by email or
+// other channels is handled by whatever consumes the notifications table.
+func NotifyUser(userID uuid.UUID, kind string, data map[string]interface{}) error {
+	notification := map[string]interface{}{
+		"id":         uuid.New(),
+		"user_id":    userID,
+		"kind":       kind,
+		"data":       data,
+		"created_at": time.Now(),
+	}
+
+	_, _, err := config.GetDBClient().From("notifications").
+		Insert(notification, false, "", "representation", "exact").
+		Execute()
+	return err
+}
@@ -0,0 +1,269 @@
+package utils
+
+import (
+	"api/config"
+	"bytes"
+	"compress/gzip"
+	_ "embed"
+	"fmt"
+	"log"
+	"math"
+	"strings"
+	"sync"
+	"unicode"
+)
+
+//go:generate go run gen_breached_passwords.go
+
+//go:embed breached_passwords.bloom.gz
+var breachedPasswordsGz []byte
+
+var (
+	breachedPasswords     *BloomFilter
+	breachedPasswordsOnce sync.Once
+)
+
+func breachedFilter() *BloomFilter {
+	breachedPasswordsOnce.Do(func() {
+		gz, err := gzip.NewReader(bytes.NewReader(breachedPasswordsGz))
+		if err == nil {
+			breachedPasswords, err = ReadBloomFilter(gz)
+		}
+		if err != nil {
+			log.Printf("breached password list unavailable: %v", err)
+		}
+	})
+	return breachedPasswords
+}
+
+// PasswordViolation is one rule a password broke.
+type PasswordViolation struct {
+	Rule    string `json:"rule"`
+	Message string `json:"message"`
+}
+
+// CheckPassword returns every rule of policy the password breaks, or nil.
+// email, when set, must not appear in the password.
+func CheckPassword(password, email string, policy config.PasswordPolicy) []PasswordViolation {
+	var violations []PasswordViolation
+	add := func(rule, format string, args ...interface{}) {
+		violations = append(violations, PasswordViolation{Rule: rule, Message: fmt.Sprintf(format, args...)})
+	}
+
+	if n := len([]rune(password)); n < policy.MinLength {
+		add("min_length", "must be at least %d characters", policy.MinLength)
+	}
+	tooLong := policy.MaxLength > 0 && len(password) > policy.MaxLength
+	if tooLong {
+		add("max_length", "must be at most %d bytes", policy.MaxLength)
+	}
+
+	classes := charClasses(password)
+	var missing []string
+	for _, class := range policy.RequiredClasses {
+		if !classes[class] {
+			missing = append(missing, class)
+		}
+	}
+	if len(missing) > 0 {
+		add("character_classes", "must contain %s characters", strings.Join(missing, ", "))
+	} else if len(classes) < policy.MinClasses {
+		add("character_classes", "must mix at least %d of lowercase, uppercase, digits and symbols", policy.MinClasses)
+	}
+
+	lower := strings.ToLower(password)
+	if policy.ForbidEmail && email != "" {
+		email = strings.ToLower(email)
+		local := email
+		if at := strings.LastIndex(email, "@"); at > 0 {
+			local = email[:at]
+		}
+		if strings.Contains(lower, email) || (len(local) >= 3 && strings.Contains(lower, local)) {
+			add("contains_email", "must not contain your email address")
+		}
+	}
+
+	breached := policy.RejectBreached && IsBreachedPassword(password)
+	if breached {
+		add("breached", "appears in lists of breached or common passwords")
+	}
+
+	// Scoring an over-long password is wasted work: it's rejected anyway.
+	if !breached && !tooLong && policy.MinStrength > 0 {
+		if score := PasswordStrength(password); score < policy.MinStrength {
+			add("too_weak", "is too easy to guess (strength %d of 4, need %d)", score, policy.MinStrength)
+		}
+	}
+
+	return violations
+}
+
+// IsBreachedPassword checks the bundled list, ignoring case and common
+// letter-for-symbol substitutions.
+func IsBreachedPassword(password string) bool {
+	filter := breachedFilter()
+	if filter == nil {
+		return false
+	}
+
+	lower := strings.ToLower(password)
+	return filter.Contains(lower) || filter.Contains(unleet(lower))
+}
+
+func charClasses(password string) map[string]bool {
+	classes := map[string]bool{}
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			classes[config.CharClassLower] = true
+		case unicode.IsUpper(r):
+			classes[config.CharClassUpper] = true
+		case unicode.IsDigit(r):
+			classes[config.CharClassDigit] = true
+		default:
+			classes[config.CharClassSymbol] = true
+		}
+	}
+	return classes
+}
+
+var leetReplacer = strings.NewReplacer("4", "a", "@", "a", "3", "e", "1", "i", "!", "i", "0", "o", "$", "s", "5", "s", "7", "t")
+
+func unleet(s string) string {
+	return leetReplacer.Replace(s)
+}
+
+// keyboardRows are scanned for walks such as "qwer" or "zxcv".
+var keyboardRows = []string{"1234567890", "qwertyuiop", "asdfghjkl", "zxcvbnm"}
+
+// PasswordStrength scores a password from 0 (trivially guessed) to 4 (very
+// hard to guess), in the spirit of zxcvbn. The password is split into
+// dictionary words, repeats, sequences and keyboard walks, which cost an
+// attacker far fewer guesses than their length suggests; anything else
+// counts by the size of its character class. The sum of the pieces, in bits,
+// maps to the score.
+func PasswordStrength(password string) int {
+	runes := []rune(password)
+	lower := []rune(strings.ToLower(password))
+
+	var bits float64
+	for i := 0; i < len(runes); {
+		if n := dictionaryMatch(lower, i); n > 0 {
+			bits += dictionaryBits(runes[i : i+n])
+			i += n
+			continue
+		}
+		if n := repeatLength(lower, i); n >= 3 {
+			bits += math.Log2(classSize(runes[i])) + math.Log2(float64(n))
+			i += n
+			continue
+		}
+		if n := sequenceLength(lower, i); n >= 3 {
+			bits += math.Log2(classSize(runes[i])) + math.Log2(float64(n)) + 1
+			i += n
+			continue
+		}
+		bits += math.Log2(classSize(runes[i]))
+		i++
+	}
+
+	switch {
+	case bits < 20:
+		return 0
+	case bits < 28:
+		return 1
+	case bits < 36:
+		return 2
+	case bits < 46:
+		return 3
+	}
+	return 4
+}
+
+// maxDictionaryWord bounds the words dictionaryMatch looks for. Listed
+// passwords are rarely longer, and every extra probe is another chance of a
+// filter false positive passing a random stretch off as a cheap word.
+const maxDictionaryWord = 20
+
+// dictionaryMatch returns the length of the longest known word starting at
+// i, or 0. Words shorter than 4 characters are too likely to be false
+// positives of the filter.
+func dictionaryMatch(lower []rune, i int) int {
+	filter := breachedFilter()
+	if filter == nil {
+		return 0
+	}
+
+	for n := min(len(lower)-i, maxDictionaryWord); n >= 4; n-- {
+		word := string(lower[i : i+n])
+		if filter.Contains(word) || filter.Contains(unleet(word)) {
+			return n
+		}
+	}
+	return 0
+}
+
+// dictionaryBits is the cost of guessing a listed word: its rank in a list
+// of tens of thousands, plus a little for capitals and substitutions.
+func dictionaryBits(word []rune) float64 {
+	bits := 14.0
+	for _, r := range word {
+		if unicode.IsUpper(r) {
+			bits++
+			break
+		}
+	}
+	if s := strings.ToLower(string(word)); unleet(s) != s {
+		bits += 2
+	}
+	return bits
+}
+
+func repeatLength(lower []rune, i int) int {
+	n := 1
+	for i+n < len(lower) && lower[i+n] == lower[i] {
+		n++
+	}
+	return n
+}
+
+// sequenceLength finds runs like "abcd", "4321" or "asdf" starting at i.
+func sequenceLength(lower []rune, i int) int {
+	best := 1
+	for _, delta := range []rune{1, -1} {
+		n := 1
+		for i+n < len(lower) && lower[i+n]-lower[i+n-1] == delta {
+			n++
+		}
+		if n > best {
+			best = n
+		}
+	}
+
+	for _, row := range keyboardRows {
+		start := strings.IndexRune(row, lower[i])
+		if start < 0 {
+			continue
+		}
+		n := 1
+		for i+n < len(lower) && start+n < len(row) && rune(row[start+n]) == lower[i+n] {
+			n++
+		}
+		if n > best {
+			best = n
+		}
+	}
+	return best
+}
+
+func classSize(r rune) float64 {
+	switch {
+	case unicode.IsLower(r), unicode.IsUpper(r):
+		return 26
+	case unicode.IsDigit(r):
+		return 10
+	case r < unicode.MaxASCII:
+		return 33
+	}
+	return 100
+}
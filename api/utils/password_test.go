@@ -0,0 +1,43 @@
+package utils
+
+import (
+	"api/config"
+	"strings"
+	"testing"
+)
+
+func TestCheckPasswordOverLengthLimit(t *testing.T) {
+	policy := config.PasswordPolicy{MinLength: 8, MaxLength: 72, MinStrength: 4, RejectBreached: true}
+
+	violations := CheckPassword(strings.Repeat("aaaa", 100), "", policy)
+	if len(violations) != 1 || violations[0].Rule != "max_length" {
+		t.Fatalf("violations = %+v, want only max_length", violations)
+	}
+}
+
+func TestPasswordStrength(t *testing.T) {
+	for _, tt := range []struct {
+		password string
+		max      int
+		min      int
+	}{
+		{"password", 0, 0},
+		{"aaaaaaaaaaaa", 1, 0},
+		{"abcdefgh1234", 1, 0},
+		{"vX9#qLm2$Tz7!pWr", 4, 4},
+		{"Qm7v!xR2@kP9#wL4$zT6%nB8^cY3&hJ5", 4, 4},
+	} {
+		if score := PasswordStrength(tt.password); score < tt.min || score > tt.max {
+			t.Errorf("PasswordStrength(%q) = %d, want %d-%d", tt.password, score, tt.min, tt.max)
+		}
+	}
+}
+
+func TestDictionaryMatchIsBounded(t *testing.T) {
+	lower := []rune(strings.Repeat("k7#q", 50))
+	for i := range lower {
+		if n := dictionaryMatch(lower, i); n > maxDictionaryWord {
+			t.Fatalf("match of %d runes at %d exceeds the cap", n, i)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package utils
+
+import "strings"
+
+// uaMatch maps a User-Agent substring to a display name. Order matters:
+// Edge and Opera also claim to be Chrome, and Chrome claims to be Safari.
+type uaMatch struct {
+	token string
+	name  string
+}
+
+var uaBrowsers = []uaMatch{
+	{"Edg/", "Edge"},
+	{"OPR/", "Opera"},
+	{"Firefox/", "Firefox"},
+	{"Chrome/", "Chrome"},
+	{"Safari/", "Safari"},
+	{"curl/", "curl"},
+	{"python-requests/", "Python"},
+	{"Go-http-client/", "Go"},
+	{"PostmanRuntime/", "Postman"},
+}
+
+var uaSystems = []uaMatch{
+	{"iPhone", "iOS"},
+	{"iPad", "iPadOS"},
+	{"Android", "Android"},
+	{"Windows", "Windows"},
+	{"Mac OS X", "macOS"},
+	{"CrOS", "ChromeOS"},
+	{"Linux", "Linux"},
+}
+
+// DeviceLabel gives a short description of a User-Agent, such as
+// "Firefox on Windows", for listing sessions.
+func DeviceLabel(userAgent string) string {
+	browser := firstMatch(userAgent, uaBrowsers)
+	system := firstMatch(userAgent, uaSystems)
+
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "":
+		return browser
+	case system != "":
+		return system
+	}
+	return "Unknown device"
+}
+
+func firstMatch(userAgent string, matches []uaMatch) string {
+	for _, m := range matches {
+		if strings.Contains(userAgent, m.token) {
+			return m.name
+		}
+	}
+	return ""
+}
@@ -0,0 +1,32 @@
+-- Shared rate-limit counters so limits hold across API replicas and restarts
+CREATE TABLE IF NOT EXISTS public.rate_limits (
+    key TEXT PRIMARY KEY,
+    hits BIGINT NOT NULL DEFAULT 0,
+    reset_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_rate_limits_reset_at ON public.rate_limits(reset_at);
+
+ALTER TABLE public.rate_limits ENABLE ROW LEVEL SECURITY;
+
+-- Count one hit for p_key, starting a new window when the previous one has expired
+CREATE OR REPLACE FUNCTION rate_limit_hit(p_key TEXT, p_window_ms BIGINT)
+RETURNS TABLE (hits BIGINT, reset_at TIMESTAMP WITH TIME ZONE) AS $$
+#variable_conflict use_column
+BEGIN
+RETURN QUERY
+INSERT INTO public.rate_limits AS r (key, hits, reset_at)
+VALUES (p_key, 1, NOW() + p_window_ms * INTERVAL '1 millisecond')
+ON CONFLICT (key) DO UPDATE
+    SET hits = CASE WHEN r.reset_at <= NOW() THEN 1 ELSE r.hits + 1 END,
+        reset_at = CASE WHEN r.reset_at <= NOW() THEN EXCLUDED.reset_at ELSE r.reset_at END
+RETURNING r.hits, r.reset_at;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
+
+CREATE OR REPLACE FUNCTION rate_limit_prune()
+RETURNS void AS $$
+BEGIN
+DELETE FROM public.rate_limits WHERE reset_at <= NOW();
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
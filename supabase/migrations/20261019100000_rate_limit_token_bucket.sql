@@ -0,0 +1,60 @@
+-- Replace fixed-window counters with GCRA token buckets. Each bucket stores
+-- its theoretical arrival time (tat); counters are ephemeral so the old
+-- table is dropped rather than migrated.
+DROP FUNCTION IF EXISTS rate_limit_hit(TEXT, BIGINT);
+DROP TABLE IF EXISTS public.rate_limits;
+
+CREATE TABLE public.rate_limits (
+    key TEXT PRIMARY KEY,
+    tat TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX idx_rate_limits_tat ON public.rate_limits(tat);
+
+ALTER TABLE public.rate_limits ENABLE ROW LEVEL SECURITY;
+
+-- Spend one token from p_key's bucket. Tokens are replenished every
+-- p_interval_ms and the bucket holds at most p_burst of them.
+CREATE OR REPLACE FUNCTION rate_limit_take(p_key TEXT, p_interval_ms DOUBLE PRECISION, p_burst INTEGER)
+RETURNS TABLE (allowed BOOLEAN, remaining INTEGER, reset_ms BIGINT, retry_after_ms BIGINT) AS $$
+DECLARE
+    v_now TIMESTAMP WITH TIME ZONE := clock_timestamp();
+    v_interval INTERVAL := p_interval_ms * INTERVAL '1 millisecond';
+    v_tat TIMESTAMP WITH TIME ZONE;
+    v_new_tat TIMESTAMP WITH TIME ZONE;
+    v_allow_at TIMESTAMP WITH TIME ZONE;
+BEGIN
+INSERT INTO public.rate_limits (key, tat) VALUES (p_key, v_now)
+ON CONFLICT (key) DO NOTHING;
+
+SELECT r.tat INTO v_tat FROM public.rate_limits r WHERE r.key = p_key FOR UPDATE;
+
+v_tat := GREATEST(v_tat, v_now);
+v_new_tat := v_tat + v_interval;
+v_allow_at := v_new_tat - p_burst * v_interval;
+
+IF v_now < v_allow_at THEN
+    RETURN QUERY SELECT
+        false,
+        0,
+        CEIL(EXTRACT(EPOCH FROM v_tat - v_now) * 1000)::BIGINT,
+        CEIL(EXTRACT(EPOCH FROM v_allow_at - v_now) * 1000)::BIGINT;
+    RETURN;
+END IF;
+
+UPDATE public.rate_limits r SET tat = v_new_tat WHERE r.key = p_key;
+
+RETURN QUERY SELECT
+    true,
+    FLOOR(EXTRACT(EPOCH FROM v_now - v_allow_at) * 1000 / p_interval_ms)::INTEGER,
+    CEIL(EXTRACT(EPOCH FROM v_new_tat - v_now) * 1000)::BIGINT,
+    0::BIGINT;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
+
+CREATE OR REPLACE FUNCTION rate_limit_prune()
+RETURNS void AS $$
+BEGIN
+DELETE FROM public.rate_limits WHERE tat <= NOW();
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
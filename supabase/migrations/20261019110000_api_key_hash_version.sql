@@ -0,0 +1,7 @@
+-- API key hashes are HMAC-SHA256 with a versioned server-side pepper.
+-- Version 0 is the legacy bare SHA-256; those keys are rehashed on next use.
+ALTER TABLE public.api_keys
+    ADD COLUMN IF NOT EXISTS hash_version INTEGER NOT NULL DEFAULT 0;
+
+-- Lets operators check whether an old pepper version can be retired
+CREATE INDEX IF NOT EXISTS idx_api_keys_hash_version ON public.api_keys(hash_version);
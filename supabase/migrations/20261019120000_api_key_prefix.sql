@@ -0,0 +1,8 @@
+-- Non-secret identifiers for checksummed keys (sk_live_/sk_test_).
+-- Keys issued before the new format keep NULL in both columns.
+ALTER TABLE public.api_keys
+    ADD COLUMN IF NOT EXISTS key_prefix TEXT,
+    ADD COLUMN IF NOT EXISTS environment TEXT;
+
+ALTER TABLE public.api_keys
+    ADD CONSTRAINT valid_key_environment CHECK (environment IN ('live', 'test'));
@@ -0,0 +1,4 @@
+-- Optional per-key restrictions. Empty or NULL lists leave a key unrestricted.
+ALTER TABLE public.api_keys
+    ADD COLUMN IF NOT EXISTS allowed_cidrs TEXT[],
+    ADD COLUMN IF NOT EXISTS allowed_referrers TEXT[];
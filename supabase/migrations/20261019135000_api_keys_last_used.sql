@@ -0,0 +1,9 @@
+-- The remote schema replaced last_used with last_update, but the API has
+-- always recorded key use in last_used. Restore it, keeping any timestamps
+-- that were written to last_update in the meantime.
+ALTER TABLE public.api_keys
+    ADD COLUMN IF NOT EXISTS last_used TIMESTAMP WITH TIME ZONE;
+
+UPDATE public.api_keys
+SET last_used = last_update
+WHERE last_used IS NULL AND last_update IS NOT NULL;
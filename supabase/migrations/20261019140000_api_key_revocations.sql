@@ -0,0 +1,8 @@
+-- Who revoked a key, when and why
+ALTER TABLE public.api_keys
+    ADD COLUMN IF NOT EXISTS revoked_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS revoked_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    ADD COLUMN IF NOT EXISTS revocation_reason TEXT;
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_last_used ON public.api_keys(last_used);
+CREATE INDEX IF NOT EXISTS idx_api_keys_revoked_at ON public.api_keys(revoked_at) WHERE revoked_at IS NOT NULL;
@@ -0,0 +1,29 @@
+-- Where reported keys were found
+CREATE TABLE IF NOT EXISTS public.api_key_leaks (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    api_key_id UUID NOT NULL REFERENCES public.api_keys(id) ON DELETE CASCADE,
+    source TEXT,
+    url TEXT,
+    reported_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS idx_api_key_leaks_api_key_id ON public.api_key_leaks(api_key_id);
+
+-- In-app notifications for users
+CREATE TABLE IF NOT EXISTS public.notifications (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    kind TEXT NOT NULL,
+    data JSONB,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    read_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_notifications_user_id ON public.notifications(user_id, created_at);
+
+ALTER TABLE public.api_key_leaks ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.notifications ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Users can view own notifications"
+    ON public.notifications FOR SELECT
+    USING (auth.uid() = user_id);
@@ -0,0 +1,17 @@
+-- Refresh tokens handed out by the API, for reuse detection. Tokens are
+-- stored hashed; every token descending from one sign-in shares chain_id.
+CREATE TABLE IF NOT EXISTS public.refresh_tokens (
+    token_hash TEXT PRIMARY KEY,
+    chain_id UUID NOT NULL,
+    parent_hash TEXT,
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    session_id UUID,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMP WITH TIME ZONE,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_chain_id ON public.refresh_tokens(chain_id);
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_user_id ON public.refresh_tokens(user_id);
+
+ALTER TABLE public.refresh_tokens ENABLE ROW LEVEL SECURITY;
@@ -0,0 +1,14 @@
+-- Revoked access tokens, shared by every API replica. Keys are
+-- "token:<sha256 of token>" or "user:<id>" for a sign-out everywhere,
+-- which revokes every token issued to the user up to revoked_at.
+CREATE TABLE IF NOT EXISTS public.token_blacklist (
+    key TEXT PRIMARY KEY,
+    revoked_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_token_blacklist_expires_at ON public.token_blacklist(expires_at);
+
+ALTER TABLE public.token_blacklist ENABLE ROW LEVEL SECURITY;
+
+CREATE INDEX IF NOT EXISTS idx_refresh_tokens_session_id ON public.refresh_tokens(session_id);
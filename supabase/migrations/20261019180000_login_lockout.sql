@@ -0,0 +1,71 @@
+-- Timed account lockout after repeated failed sign-ins
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS locked_until TIMESTAMP WITH TIME ZONE;
+
+-- Failed sign-ins per client IP
+CREATE TABLE IF NOT EXISTS public.login_ip_failures (
+    ip TEXT PRIMARY KEY,
+    failed_attempts BIGINT NOT NULL DEFAULT 0,
+    locked_until TIMESTAMP WITH TIME ZONE,
+    last_failed_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE public.login_ip_failures ENABLE ROW LEVEL SECURITY;
+
+-- Every p_threshold consecutive failures lock for p_base_ms, doubling with
+-- each further lockout up to p_max_ms
+CREATE OR REPLACE FUNCTION login_lockout_until(p_attempts BIGINT, p_threshold INTEGER, p_base_ms BIGINT, p_max_ms BIGINT)
+RETURNS TIMESTAMP WITH TIME ZONE AS $$
+BEGIN
+IF p_attempts < p_threshold OR p_attempts % p_threshold <> 0 THEN
+    RETURN NULL;
+END IF;
+
+RETURN NOW() + LEAST(
+    p_base_ms * POWER(2, LEAST(p_attempts / p_threshold - 1, 30)),
+    p_max_ms
+) * INTERVAL '1 millisecond';
+END;
+$$ LANGUAGE plpgsql IMMUTABLE;
+
+-- Count a failed sign-in for an account and lock it when due
+CREATE OR REPLACE FUNCTION record_login_failure(p_user_id UUID, p_threshold INTEGER, p_base_ms BIGINT, p_max_ms BIGINT)
+RETURNS TABLE (failed_attempts BIGINT, locked_until TIMESTAMP WITH TIME ZONE) AS $$
+#variable_conflict use_column
+BEGIN
+RETURN QUERY
+UPDATE public.users u
+SET failed_login_attempts = u.failed_login_attempts + 1,
+    locked_until = COALESCE(
+        login_lockout_until(u.failed_login_attempts + 1, p_threshold, p_base_ms, p_max_ms),
+        u.locked_until
+    )
+WHERE u.id = p_user_id
+RETURNING u.failed_login_attempts, u.locked_until;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
+
+-- Count a failed sign-in from an IP. Failures older than p_window_ms are forgotten.
+CREATE OR REPLACE FUNCTION record_ip_login_failure(p_ip TEXT, p_threshold INTEGER, p_base_ms BIGINT, p_max_ms BIGINT, p_window_ms BIGINT)
+RETURNS TABLE (failed_attempts BIGINT, locked_until TIMESTAMP WITH TIME ZONE) AS $$
+#variable_conflict use_column
+BEGIN
+INSERT INTO public.login_ip_failures AS f (ip, failed_attempts, last_failed_at)
+VALUES (p_ip, 1, NOW())
+ON CONFLICT (ip) DO UPDATE
+    SET failed_attempts = CASE
+            WHEN f.last_failed_at < NOW() - p_window_ms * INTERVAL '1 millisecond' THEN 1
+            ELSE f.failed_attempts + 1
+        END,
+        last_failed_at = NOW();
+
+RETURN QUERY
+UPDATE public.login_ip_failures f
+SET locked_until = COALESCE(
+        login_lockout_until(f.failed_attempts, p_threshold, p_base_ms, p_max_ms),
+        f.locked_until
+    )
+WHERE f.ip = p_ip
+RETURNING f.failed_attempts, f.locked_until;
+END;
+$$ LANGUAGE plpgsql SECURITY DEFINER;
@@ -0,0 +1,12 @@
+-- Single-use MFA recovery codes, stored hashed. Using one removes the user's
+-- TOTP factors so they can sign in with their password and enroll again.
+CREATE TABLE IF NOT EXISTS public.mfa_recovery_codes (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    code_hash TEXT NOT NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    used_at TIMESTAMP WITH TIME ZONE,
+    UNIQUE (user_id, code_hash)
+);
+
+ALTER TABLE public.mfa_recovery_codes ENABLE ROW LEVEL SECURITY;
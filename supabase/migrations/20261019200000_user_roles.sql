@@ -0,0 +1,25 @@
+-- Role assignments. What each role grants is defined in the API
+-- (models.RolePermissions); this table only records who holds which role.
+CREATE TABLE IF NOT EXISTS public.roles (
+    name TEXT PRIMARY KEY,
+    description TEXT NOT NULL DEFAULT ''
+);
+
+INSERT INTO public.roles (name, description) VALUES
+    ('viewer', 'Read-only access to models and users'),
+    ('developer', 'Read models and every user''s requests'),
+    ('model-manager', 'Create, update and delete models'),
+    ('billing', 'Usage and billing data'),
+    ('super-admin', 'Everything, including assigning roles')
+ON CONFLICT (name) DO NOTHING;
+
+CREATE TABLE IF NOT EXISTS public.user_roles (
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL REFERENCES public.roles(name),
+    granted_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    granted_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (user_id, role)
+);
+
+ALTER TABLE public.roles ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.user_roles ENABLE ROW LEVEL SECURITY;
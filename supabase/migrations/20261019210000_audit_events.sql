@@ -0,0 +1,149 @@
+-- Append-only audit trail. Every event stores the hash of the one before it,
+-- so editing or deleting a row breaks the chain and verify_audit_chain()
+-- reports where.
+CREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA extensions;
+
+CREATE TABLE IF NOT EXISTS public.audit_events (
+    id BIGSERIAL PRIMARY KEY,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    -- No foreign key: events must outlive the users they mention.
+    actor_id UUID,
+    actor_type TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT,
+    target_id TEXT,
+    before JSONB,
+    after JSONB,
+    ip TEXT,
+    user_agent TEXT,
+    request_id TEXT,
+    prev_hash TEXT NOT NULL,
+    hash TEXT NOT NULL
+);
+
+CREATE INDEX IF NOT EXISTS idx_audit_events_actor_id ON public.audit_events(actor_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_action ON public.audit_events(action);
+CREATE INDEX IF NOT EXISTS idx_audit_events_target ON public.audit_events(target_type, target_id);
+CREATE INDEX IF NOT EXISTS idx_audit_events_created_at ON public.audit_events(created_at);
+
+ALTER TABLE public.audit_events ENABLE ROW LEVEL SECURITY;
+
+CREATE OR REPLACE FUNCTION public.audit_event_hash(e public.audit_events)
+RETURNS TEXT
+LANGUAGE sql
+IMMUTABLE
+SET search_path = public, extensions
+AS $$
+    SELECT encode(digest(jsonb_build_array(
+        e.prev_hash,
+        e.id,
+        to_char(e.created_at AT TIME ZONE 'UTC', 'YYYY-MM-DD"T"HH24:MI:SS.US"Z"'),
+        e.actor_id,
+        e.actor_type,
+        e.action,
+        e.target_type,
+        e.target_id,
+        e.before,
+        e.after,
+        e.ip,
+        e.user_agent,
+        e.request_id
+    )::text, 'sha256'), 'hex');
+$$;
+
+-- Appends are serialized so each event links to the one committed before it.
+CREATE OR REPLACE FUNCTION public.append_audit_event(
+    p_actor_id UUID,
+    p_actor_type TEXT,
+    p_action TEXT,
+    p_target_type TEXT,
+    p_target_id TEXT,
+    p_before JSONB,
+    p_after JSONB,
+    p_ip TEXT,
+    p_user_agent TEXT,
+    p_request_id TEXT
+)
+RETURNS public.audit_events
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public, extensions
+AS $$
+DECLARE
+    v_event public.audit_events;
+BEGIN
+    PERFORM pg_advisory_xact_lock(hashtext('public.audit_events'));
+
+    SELECT hash INTO v_event.prev_hash
+    FROM public.audit_events
+    ORDER BY id DESC
+    LIMIT 1;
+
+    v_event.prev_hash := COALESCE(v_event.prev_hash, repeat('0', 64));
+    v_event.id := nextval(pg_get_serial_sequence('public.audit_events', 'id'));
+    v_event.created_at := date_trunc('microseconds', clock_timestamp());
+    v_event.actor_id := p_actor_id;
+    v_event.actor_type := p_actor_type;
+    v_event.action := p_action;
+    v_event.target_type := p_target_type;
+    v_event.target_id := p_target_id;
+    v_event.before := p_before;
+    v_event.after := p_after;
+    v_event.ip := p_ip;
+    v_event.user_agent := p_user_agent;
+    v_event.request_id := p_request_id;
+    v_event.hash := public.audit_event_hash(v_event);
+
+    INSERT INTO public.audit_events SELECT v_event.*;
+    RETURN v_event;
+END;
+$$;
+
+-- Walks the chain from the start. first_invalid_id is NULL when intact.
+CREATE OR REPLACE FUNCTION public.verify_audit_chain()
+RETURNS TABLE (checked BIGINT, first_invalid_id BIGINT)
+LANGUAGE plpgsql
+STABLE
+SET search_path = public, extensions
+AS $$
+DECLARE
+    v_event public.audit_events;
+    v_prev TEXT := repeat('0', 64);
+BEGIN
+    checked := 0;
+    first_invalid_id := NULL;
+
+    FOR v_event IN SELECT * FROM public.audit_events ORDER BY id LOOP
+        IF v_event.prev_hash <> v_prev OR v_event.hash <> public.audit_event_hash(v_event) THEN
+            first_invalid_id := v_event.id;
+            RETURN NEXT;
+            RETURN;
+        END IF;
+        v_prev := v_event.hash;
+        checked := checked + 1;
+    END LOOP;
+
+    RETURN NEXT;
+END;
+$$;
+
+CREATE OR REPLACE FUNCTION public.audit_events_append_only()
+RETURNS TRIGGER
+LANGUAGE plpgsql
+AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_events is append-only';
+END;
+$$;
+
+DROP TRIGGER IF EXISTS audit_events_no_update ON public.audit_events;
+CREATE TRIGGER audit_events_no_update
+    BEFORE UPDATE OR DELETE ON public.audit_events
+    FOR EACH ROW EXECUTE FUNCTION public.audit_events_append_only();
+
+DROP TRIGGER IF EXISTS audit_events_no_truncate ON public.audit_events;
+CREATE TRIGGER audit_events_no_truncate
+    BEFORE TRUNCATE ON public.audit_events
+    FOR EACH STATEMENT EXECUTE FUNCTION public.audit_events_append_only();
+
+REVOKE UPDATE, DELETE, TRUNCATE ON public.audit_events FROM PUBLIC, anon, authenticated;
@@ -0,0 +1,30 @@
+-- Self-service profile fields and scheduled account erasure.
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS display_name TEXT,
+    ADD COLUMN IF NOT EXISTS deletion_requested_at TIMESTAMP WITH TIME ZONE,
+    ADD COLUMN IF NOT EXISTS deletion_scheduled_for TIMESTAMP WITH TIME ZONE;
+
+CREATE INDEX IF NOT EXISTS idx_users_deletion_scheduled_for
+    ON public.users(deletion_scheduled_for)
+    WHERE deletion_scheduled_for IS NOT NULL;
+
+-- Erases everything the API stores about a user. Audit events keep the bare
+-- user ID, which is no longer linked to any personal data. Returns whether
+-- a users row was removed.
+CREATE OR REPLACE FUNCTION public.erase_user(p_user_id UUID)
+RETURNS BOOLEAN
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public
+AS $$
+BEGIN
+    DELETE FROM public.model_requests WHERE user_id = p_user_id;
+    DELETE FROM public.api_keys WHERE user_id = p_user_id;
+    DELETE FROM public.refresh_tokens WHERE user_id = p_user_id;
+    DELETE FROM public.mfa_recovery_codes WHERE user_id = p_user_id;
+    DELETE FROM public.notifications WHERE user_id = p_user_id;
+    DELETE FROM public.user_roles WHERE user_id = p_user_id;
+    DELETE FROM public.users WHERE id = p_user_id;
+    RETURN FOUND;
+END;
+$$;
@@ -0,0 +1,47 @@
+-- Sessions as seen by the API, keyed by gotrue's session_id claim. Rows are
+-- upserted as access tokens are used so users can review and revoke them.
+CREATE TABLE IF NOT EXISTS public.user_sessions (
+    id UUID PRIMARY KEY,
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    device TEXT,
+    ip TEXT,
+    user_agent TEXT,
+    aal TEXT,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    last_seen_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_user_sessions_user_id ON public.user_sessions(user_id, last_seen_at DESC);
+
+ALTER TABLE public.user_sessions ENABLE ROW LEVEL SECURITY;
+
+-- Records a use of a session. Revoked sessions are left alone so a late
+-- request can't bring them back; the result says whether a row was written.
+CREATE OR REPLACE FUNCTION public.touch_user_session(
+    p_id UUID,
+    p_user_id UUID,
+    p_device TEXT,
+    p_ip TEXT,
+    p_user_agent TEXT,
+    p_aal TEXT
+)
+RETURNS BOOLEAN
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public
+AS $$
+BEGIN
+    INSERT INTO public.user_sessions (id, user_id, device, ip, user_agent, aal)
+    VALUES (p_id, p_user_id, p_device, p_ip, p_user_agent, p_aal)
+    ON CONFLICT (id) DO UPDATE
+        SET device = EXCLUDED.device,
+            ip = EXCLUDED.ip,
+            user_agent = EXCLUDED.user_agent,
+            aal = EXCLUDED.aal,
+            last_seen_at = NOW()
+        WHERE public.user_sessions.revoked_at IS NULL
+          AND public.user_sessions.user_id = EXCLUDED.user_id;
+    RETURN FOUND;
+END;
+$$;
@@ -0,0 +1,18 @@
+-- Single-use signup invites for SIGNUP_MODE=invite. Only token hashes are
+-- stored; the token itself is shown once, when the invite is created.
+CREATE TABLE IF NOT EXISTS public.signup_invites (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    token_hash TEXT NOT NULL UNIQUE,
+    -- When set, only this address may use the invite.
+    email TEXT,
+    created_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    used_at TIMESTAMP WITH TIME ZONE,
+    used_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    revoked_at TIMESTAMP WITH TIME ZONE
+);
+
+CREATE INDEX IF NOT EXISTS idx_signup_invites_created_at ON public.signup_invites(created_at DESC);
+
+ALTER TABLE public.signup_invites ENABLE ROW LEVEL SECURITY;
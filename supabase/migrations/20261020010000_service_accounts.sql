@@ -0,0 +1,52 @@
+-- Service accounts are non-human principals for backend services. They have
+-- no auth.users row, so nothing can sign in as one; they only act through
+-- their API keys. Every account belongs to a group owned by an admin, who is
+-- the contact for anything the account does.
+CREATE TABLE IF NOT EXISTS public.service_account_groups (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL UNIQUE,
+    owner_id UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
+CREATE TABLE IF NOT EXISTS public.service_accounts (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    group_id UUID NOT NULL REFERENCES public.service_account_groups(id),
+    name TEXT NOT NULL,
+    description TEXT,
+    created_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    disabled_at TIMESTAMP WITH TIME ZONE,
+    disabled_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    UNIQUE (group_id, name)
+);
+
+CREATE INDEX IF NOT EXISTS idx_service_accounts_group_id ON public.service_accounts(group_id);
+
+ALTER TABLE public.service_account_groups ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.service_accounts ENABLE ROW LEVEL SECURITY;
+
+-- A key belongs to exactly one user or service account. Scopes limit what a
+-- key may call; an empty list leaves a user's key unrestricted, while a
+-- service account's keys always carry at least one. expires_at is set on
+-- keys that are being rotated out.
+ALTER TABLE public.api_keys
+    ALTER COLUMN user_id DROP NOT NULL,
+    ADD COLUMN IF NOT EXISTS service_account_id UUID REFERENCES public.service_accounts(id),
+    ADD COLUMN IF NOT EXISTS scopes TEXT[] NOT NULL DEFAULT '{}',
+    ADD COLUMN IF NOT EXISTS expires_at TIMESTAMP WITH TIME ZONE,
+    ADD CONSTRAINT api_keys_single_owner CHECK ((user_id IS NULL) <> (service_account_id IS NULL)),
+    ADD CONSTRAINT api_keys_service_account_scopes CHECK (service_account_id IS NULL OR cardinality(scopes) > 0);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_service_account_id ON public.api_keys(service_account_id)
+    WHERE service_account_id IS NOT NULL;
+
+-- Requests made with a service account's key are recorded against it
+-- rather than a user.
+ALTER TABLE public.model_requests
+    ALTER COLUMN user_id DROP NOT NULL,
+    ADD COLUMN IF NOT EXISTS service_account_id UUID REFERENCES public.service_accounts(id),
+    ADD CONSTRAINT model_requests_single_owner CHECK ((user_id IS NULL) <> (service_account_id IS NULL));
+
+CREATE INDEX IF NOT EXISTS idx_model_requests_service_account_id ON public.model_requests(service_account_id)
+    WHERE service_account_id IS NOT NULL;
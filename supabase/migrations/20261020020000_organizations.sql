@@ -0,0 +1,111 @@
+-- Organizations let several teams share one deployment. Keys, requests and
+-- private models can belong to an organization, and members only see what
+-- belongs to the organizations they are in. Anything without an
+-- organization_id stays personal to its owner, as before.
+CREATE TABLE IF NOT EXISTS public.organizations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    name TEXT NOT NULL,
+    slug TEXT NOT NULL UNIQUE,
+    created_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    -- Model requests allowed per calendar month (UTC); NULL is unlimited.
+    request_quota INTEGER CHECK (request_quota IS NULL OR request_quota >= 0),
+    CONSTRAINT organizations_slug_format CHECK (slug ~ '^[a-z0-9][a-z0-9-]{1,62}$')
+);
+
+CREATE TABLE IF NOT EXISTS public.organization_members (
+    organization_id UUID NOT NULL REFERENCES public.organizations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'member',
+    added_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    PRIMARY KEY (organization_id, user_id),
+    CONSTRAINT organization_members_role CHECK (role IN ('owner', 'admin', 'member'))
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_members_user_id ON public.organization_members(user_id);
+
+ALTER TABLE public.api_keys
+    ADD COLUMN IF NOT EXISTS organization_id UUID REFERENCES public.organizations(id);
+ALTER TABLE public.model_requests
+    ADD COLUMN IF NOT EXISTS organization_id UUID REFERENCES public.organizations(id);
+-- A model with an organization is private to it; NULL models are public.
+ALTER TABLE public.ai_models
+    ADD COLUMN IF NOT EXISTS organization_id UUID REFERENCES public.organizations(id);
+
+CREATE INDEX IF NOT EXISTS idx_api_keys_organization_id ON public.api_keys(organization_id)
+    WHERE organization_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_model_requests_organization_id ON public.model_requests(organization_id, created_at)
+    WHERE organization_id IS NOT NULL;
+CREATE INDEX IF NOT EXISTS idx_ai_models_organization_id ON public.ai_models(organization_id)
+    WHERE organization_id IS NOT NULL;
+
+-- The caller's role in an organization, or NULL. SECURITY DEFINER so the
+-- policies below can use it without recursing into organization_members'
+-- own policy.
+CREATE OR REPLACE FUNCTION public.organization_role(p_organization_id UUID)
+RETURNS TEXT AS $$
+    SELECT role
+    FROM public.organization_members
+    WHERE organization_id = p_organization_id AND user_id = auth.uid();
+$$ LANGUAGE sql STABLE SECURITY DEFINER SET search_path = public;
+
+ALTER TABLE public.organizations ENABLE ROW LEVEL SECURITY;
+ALTER TABLE public.organization_members ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Members can view their organizations"
+    ON public.organizations FOR SELECT
+    USING (public.organization_role(id) IS NOT NULL);
+
+CREATE POLICY "Members can view fellow members"
+    ON public.organization_members FOR SELECT
+    USING (public.organization_role(organization_id) IS NOT NULL);
+
+-- Personal rows keep the old rules; organization rows are visible to their
+-- owner while they are still a member, and to the organization's admins.
+DROP POLICY IF EXISTS "Public models are viewable by everyone" ON ai_models;
+CREATE POLICY "Public models are viewable by everyone"
+    ON ai_models FOR SELECT
+    USING (is_active = true AND organization_id IS NULL);
+
+CREATE POLICY "Private models are viewable by their organization"
+    ON ai_models FOR SELECT
+    USING (is_active = true AND public.organization_role(organization_id) IS NOT NULL);
+
+DROP POLICY IF EXISTS "Users can view own requests" ON model_requests;
+CREATE POLICY "Users can view own requests"
+    ON model_requests FOR SELECT
+    USING (auth.uid() = user_id
+        AND (organization_id IS NULL OR public.organization_role(organization_id) IS NOT NULL));
+
+CREATE POLICY "Organization admins can view organization requests"
+    ON model_requests FOR SELECT
+    USING (public.organization_role(organization_id) IN ('owner', 'admin'));
+
+DROP POLICY IF EXISTS "Users can create requests" ON model_requests;
+CREATE POLICY "Users can create requests"
+    ON model_requests FOR INSERT
+    WITH CHECK (auth.uid() = user_id
+        AND (organization_id IS NULL OR public.organization_role(organization_id) IS NOT NULL));
+
+DROP POLICY IF EXISTS "Users can view own keys" ON api_keys;
+CREATE POLICY "Users can view own keys"
+    ON api_keys FOR SELECT
+    USING (auth.uid() = user_id
+        AND (organization_id IS NULL OR public.organization_role(organization_id) IS NOT NULL));
+
+CREATE POLICY "Organization admins can view organization keys"
+    ON api_keys FOR SELECT
+    USING (public.organization_role(organization_id) IN ('owner', 'admin'));
+
+DROP POLICY IF EXISTS "Users can create own keys" ON api_keys;
+CREATE POLICY "Users can create own keys"
+    ON api_keys FOR INSERT
+    WITH CHECK (auth.uid() = user_id
+        AND (organization_id IS NULL OR public.organization_role(organization_id) IS NOT NULL));
+
+DROP POLICY IF EXISTS "Users can update own keys" ON api_keys;
+CREATE POLICY "Users can update own keys"
+    ON api_keys FOR UPDATE
+    USING (auth.uid() = user_id
+        AND (organization_id IS NULL OR public.organization_role(organization_id) IS NOT NULL));
@@ -0,0 +1,42 @@
+-- Brings a user's public.users row in line with auth.users, which is the
+-- source of truth: a missing row is created, a changed email is copied
+-- over and a row whose auth user is gone or soft-deleted is deactivated.
+-- It never reactivates a row, so an admin's deactivation stands. Because it
+-- reads auth.users itself rather than trusting the caller's copy, calling it
+-- twice, or for events that arrive out of order, is harmless. Returns
+-- 'created', 'updated', 'deactivated', 'unchanged' or 'conflict' when the
+-- email already belongs to another row.
+CREATE OR REPLACE FUNCTION public.sync_auth_user(p_user_id UUID)
+RETURNS TEXT
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public
+AS $$
+DECLARE
+    v_email TEXT;
+BEGIN
+    SELECT COALESCE(email, '') INTO v_email
+    FROM auth.users
+    WHERE id = p_user_id AND deleted_at IS NULL;
+
+    IF NOT FOUND THEN
+        UPDATE public.users SET is_active = false
+        WHERE id = p_user_id AND is_active;
+        RETURN CASE WHEN FOUND THEN 'deactivated' ELSE 'unchanged' END;
+    END IF;
+
+    INSERT INTO public.users (id, email, is_active)
+    VALUES (p_user_id, v_email, true)
+    ON CONFLICT (id) DO NOTHING;
+    IF FOUND THEN
+        RETURN 'created';
+    END IF;
+
+    UPDATE public.users SET email = v_email
+    WHERE id = p_user_id AND email IS DISTINCT FROM v_email;
+    RETURN CASE WHEN FOUND THEN 'updated' ELSE 'unchanged' END;
+EXCEPTION
+    WHEN unique_violation THEN
+        RETURN 'conflict';
+END;
+$$;
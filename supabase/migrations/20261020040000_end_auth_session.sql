@@ -0,0 +1,17 @@
+-- Deletes a gotrue session, which also removes its refresh tokens, so a
+-- revoked session can't be refreshed at gotrue directly. Only the service
+-- role may call it. Returns whether a session was deleted.
+CREATE OR REPLACE FUNCTION public.end_auth_session(p_session_id UUID)
+RETURNS BOOLEAN
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public
+AS $$
+BEGIN
+    DELETE FROM auth.sessions WHERE id = p_session_id;
+    RETURN FOUND;
+END;
+$$;
+
+REVOKE EXECUTE ON FUNCTION public.end_auth_session(UUID) FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.end_auth_session(UUID) TO service_role;
@@ -0,0 +1,3 @@
+-- login_lockout_until reads NOW(), so it can't be IMMUTABLE: the planner
+-- may fold it to a constant or reuse one result for every row.
+ALTER FUNCTION public.login_lockout_until(BIGINT, INTEGER, BIGINT, BIGINT) STABLE;
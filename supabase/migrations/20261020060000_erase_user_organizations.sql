@@ -0,0 +1,67 @@
+-- Keys became many per user with service accounts and organizations; the
+-- baseline schema still allowed one.
+ALTER TABLE public.api_keys DROP CONSTRAINT IF EXISTS api_keys_user_id_key;
+DROP INDEX IF EXISTS public.api_keys_user_id_key;
+
+-- An organization key outlives its owner's erasure as a revoked record, so a
+-- key may have no owner once it is inactive.
+ALTER TABLE public.api_keys
+    DROP CONSTRAINT IF EXISTS api_keys_single_owner,
+    ADD CONSTRAINT api_keys_single_owner CHECK (
+        NOT (user_id IS NOT NULL AND service_account_id IS NOT NULL)
+        AND (user_id IS NOT NULL OR service_account_id IS NOT NULL OR NOT is_active)
+    );
+
+-- Organizations the user is the only owner of while others are still
+-- members. Their ownership has to be handed over before the user can go.
+CREATE OR REPLACE FUNCTION public.sole_owned_organizations(p_user_id UUID)
+RETURNS SETOF UUID AS $$
+    SELECT m.organization_id
+    FROM public.organization_members m
+    WHERE m.user_id = p_user_id
+      AND m.role = 'owner'
+      AND NOT EXISTS (
+          SELECT 1 FROM public.organization_members o
+          WHERE o.organization_id = m.organization_id
+            AND o.user_id <> p_user_id
+            AND o.role = 'owner')
+      AND EXISTS (
+          SELECT 1 FROM public.organization_members o
+          WHERE o.organization_id = m.organization_id
+            AND o.user_id <> p_user_id);
+$$ LANGUAGE sql STABLE SECURITY DEFINER SET search_path = public;
+
+-- Organization requests and keys belong to the organization, so erasure only
+-- unlinks them from the user: requests keep counting towards its quota and
+-- keys stay on record, revoked. The user_id foreign keys cascade, so this has
+-- to happen before the users row goes.
+CREATE OR REPLACE FUNCTION public.erase_user(p_user_id UUID)
+RETURNS BOOLEAN
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public
+AS $$
+BEGIN
+    IF EXISTS (SELECT 1 FROM public.sole_owned_organizations(p_user_id)) THEN
+        RAISE EXCEPTION 'user % is the sole owner of an organization with other members', p_user_id;
+    END IF;
+
+    UPDATE public.model_requests SET user_id = NULL
+    WHERE user_id = p_user_id AND organization_id IS NOT NULL;
+    UPDATE public.api_keys
+    SET user_id = NULL,
+        is_active = false,
+        revoked_at = COALESCE(revoked_at, NOW()),
+        revocation_reason = COALESCE(revocation_reason, 'owner account erased')
+    WHERE user_id = p_user_id AND organization_id IS NOT NULL;
+
+    DELETE FROM public.model_requests WHERE user_id = p_user_id AND organization_id IS NULL;
+    DELETE FROM public.api_keys WHERE user_id = p_user_id AND organization_id IS NULL;
+    DELETE FROM public.refresh_tokens WHERE user_id = p_user_id;
+    DELETE FROM public.mfa_recovery_codes WHERE user_id = p_user_id;
+    DELETE FROM public.notifications WHERE user_id = p_user_id;
+    DELETE FROM public.user_roles WHERE user_id = p_user_id;
+    DELETE FROM public.users WHERE id = p_user_id;
+    RETURN FOUND;
+END;
+$$;
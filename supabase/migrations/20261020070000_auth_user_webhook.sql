@@ -0,0 +1,119 @@
+-- Users gotrue creates on its own, e.g. through its /signup endpoint or the
+-- dashboard, never went through the API's signup policy. Their rows wait,
+-- inactive, until the policy admits them.
+ALTER TABLE public.users
+    ADD COLUMN IF NOT EXISTS signup_pending BOOLEAN NOT NULL DEFAULT false;
+
+-- Once anyone decides is_active, whether the policy or an admin, the row is
+-- no longer waiting for admission.
+CREATE OR REPLACE FUNCTION public.settle_signup_pending()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF NEW.is_active IS DISTINCT FROM OLD.is_active THEN
+        NEW.signup_pending := false;
+    END IF;
+    RETURN NEW;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS settle_signup_pending ON public.users;
+CREATE TRIGGER settle_signup_pending
+    BEFORE UPDATE OF is_active ON public.users
+    FOR EACH ROW EXECUTE FUNCTION public.settle_signup_pending();
+
+-- As before, except that rows it creates wait for admission.
+CREATE OR REPLACE FUNCTION public.sync_auth_user(p_user_id UUID)
+RETURNS TEXT
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public
+AS $$
+DECLARE
+    v_email TEXT;
+BEGIN
+    SELECT COALESCE(email, '') INTO v_email
+    FROM auth.users
+    WHERE id = p_user_id AND deleted_at IS NULL;
+
+    IF NOT FOUND THEN
+        UPDATE public.users SET is_active = false
+        WHERE id = p_user_id AND is_active;
+        RETURN CASE WHEN FOUND THEN 'deactivated' ELSE 'unchanged' END;
+    END IF;
+
+    INSERT INTO public.users (id, email, is_active, signup_pending)
+    VALUES (p_user_id, v_email, false, true)
+    ON CONFLICT (id) DO NOTHING;
+    IF FOUND THEN
+        RETURN 'created';
+    END IF;
+
+    UPDATE public.users SET email = v_email
+    WHERE id = p_user_id AND email IS DISTINCT FROM v_email;
+    RETURN CASE WHEN FOUND THEN 'updated' ELSE 'unchanged' END;
+EXCEPTION
+    WHEN unique_violation THEN
+        RETURN 'conflict';
+END;
+$$;
+
+-- Delivers auth.users changes to POST /api/auth/webhook, signed the way
+-- RequireSignature checks: X-Signature carries "sha256=<hex HMAC-SHA256 of
+-- id.timestamp.body>". The endpoint and secret come from Vault, the secret
+-- matching AUTH_WEBHOOK_SECRET on the API:
+--
+--   SELECT vault.create_secret('https://api.example.com/api/auth/webhook', 'auth_webhook_url');
+--   SELECT vault.create_secret('<AUTH_WEBHOOK_SECRET>', 'auth_webhook_secret');
+--
+-- Until both exist nothing is sent. pg_net doesn't retry failed deliveries;
+-- reconcile-users repairs whatever they missed. The record carries only the
+-- ID and email, never credentials.
+CREATE EXTENSION IF NOT EXISTS pg_net;
+CREATE EXTENSION IF NOT EXISTS pgcrypto WITH SCHEMA extensions;
+
+CREATE OR REPLACE FUNCTION public.notify_auth_user_change()
+RETURNS TRIGGER
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = ''
+AS $$
+DECLARE
+    v_url TEXT;
+    v_secret TEXT;
+    v_id TEXT := gen_random_uuid()::text;
+    v_timestamp TEXT := floor(extract(epoch FROM clock_timestamp()))::bigint::text;
+    v_body JSONB;
+BEGIN
+    SELECT decrypted_secret INTO v_url FROM vault.decrypted_secrets WHERE name = 'auth_webhook_url';
+    SELECT decrypted_secret INTO v_secret FROM vault.decrypted_secrets WHERE name = 'auth_webhook_secret';
+    IF v_url IS NULL OR v_secret IS NULL THEN
+        RETURN NULL;
+    END IF;
+
+    v_body := jsonb_build_object(
+        'type', TG_OP,
+        'table', TG_TABLE_NAME,
+        'schema', TG_TABLE_SCHEMA,
+        'record', CASE WHEN TG_OP = 'DELETE' THEN NULL
+                       ELSE jsonb_build_object('id', NEW.id, 'email', NEW.email) END,
+        'old_record', CASE WHEN TG_OP = 'INSERT' THEN NULL
+                           ELSE jsonb_build_object('id', OLD.id, 'email', OLD.email) END);
+
+    -- pg_net sends the body as body::text, so that is what gets signed.
+    PERFORM net.http_post(
+        url := v_url,
+        body := v_body,
+        headers := jsonb_build_object(
+            'Content-Type', 'application/json',
+            'X-Signature-ID', v_id,
+            'X-Signature-Timestamp', v_timestamp,
+            'X-Signature', 'sha256=' || encode(
+                extensions.hmac(v_id || '.' || v_timestamp || '.' || v_body::text, v_secret, 'sha256'), 'hex')));
+    RETURN NULL;
+END;
+$$;
+
+DROP TRIGGER IF EXISTS notify_auth_user_change ON auth.users;
+CREATE TRIGGER notify_auth_user_change
+    AFTER INSERT OR DELETE OR UPDATE OF email, deleted_at ON auth.users
+    FOR EACH ROW EXECUTE FUNCTION public.notify_auth_user_change();
@@ -0,0 +1,12 @@
+-- The rate-limit functions run as their owner, and PostgREST exposes every
+-- public function, so anyone holding the anon key could drain another
+-- caller's bucket or prune the table. Only the API, as the service role, may
+-- call them. rate_limit_hit from 20261019090000 was dropped with the old
+-- table.
+ALTER FUNCTION public.rate_limit_take(TEXT, DOUBLE PRECISION, INTEGER) SET search_path = public;
+ALTER FUNCTION public.rate_limit_prune() SET search_path = public;
+
+REVOKE EXECUTE ON FUNCTION public.rate_limit_take(TEXT, DOUBLE PRECISION, INTEGER) FROM PUBLIC, anon, authenticated;
+REVOKE EXECUTE ON FUNCTION public.rate_limit_prune() FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.rate_limit_take(TEXT, DOUBLE PRECISION, INTEGER) TO service_role;
+GRANT EXECUTE ON FUNCTION public.rate_limit_prune() TO service_role;
@@ -0,0 +1,11 @@
+-- The failure counters run as their owner, and PostgREST exposes every public
+-- function, so anyone holding the anon key could lock out any account or IP
+-- with a threshold of their choosing. Only the API, as the service role, may
+-- call them.
+ALTER FUNCTION public.record_login_failure(UUID, INTEGER, BIGINT, BIGINT) SET search_path = public;
+ALTER FUNCTION public.record_ip_login_failure(TEXT, INTEGER, BIGINT, BIGINT, BIGINT) SET search_path = public;
+
+REVOKE EXECUTE ON FUNCTION public.record_login_failure(UUID, INTEGER, BIGINT, BIGINT) FROM PUBLIC, anon, authenticated;
+REVOKE EXECUTE ON FUNCTION public.record_ip_login_failure(TEXT, INTEGER, BIGINT, BIGINT, BIGINT) FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.record_login_failure(UUID, INTEGER, BIGINT, BIGINT) TO service_role;
+GRANT EXECUTE ON FUNCTION public.record_ip_login_failure(TEXT, INTEGER, BIGINT, BIGINT, BIGINT) TO service_role;
@@ -0,0 +1,7 @@
+-- append_audit_event computes each event's hash itself, so anyone able to
+-- call it could add forged events that verify_audit_chain still accepts.
+-- Only the API, as the service role, may append.
+REVOKE EXECUTE ON FUNCTION public.append_audit_event(UUID, TEXT, TEXT, TEXT, TEXT, JSONB, JSONB, TEXT, TEXT, TEXT)
+    FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.append_audit_event(UUID, TEXT, TEXT, TEXT, TEXT, JSONB, JSONB, TEXT, TEXT, TEXT)
+    TO service_role;
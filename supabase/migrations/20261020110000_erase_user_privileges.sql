@@ -0,0 +1,65 @@
+-- erase_user runs as its owner, and PostgREST exposes every public function,
+-- so anyone holding the anon key could erase any account. Only the API, as the
+-- service role, may call it, and it checks the deadline itself rather than
+-- trusting the caller.
+
+-- Erased users whose gotrue user still has to be deleted. The API retries each
+-- until gotrue confirms, so an outage can't leave the login behind.
+CREATE TABLE IF NOT EXISTS public.pending_auth_deletions (
+    user_id UUID PRIMARY KEY,
+    erased_at TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+ALTER TABLE public.pending_auth_deletions ENABLE ROW LEVEL SECURITY;
+
+CREATE OR REPLACE FUNCTION public.erase_user(p_user_id UUID)
+RETURNS BOOLEAN
+LANGUAGE plpgsql
+SECURITY DEFINER
+SET search_path = public
+AS $$
+DECLARE
+    v_erased BOOLEAN;
+BEGIN
+    -- Locking the row keeps a concurrent cancellation from slipping in
+    -- between the check and the deletes.
+    PERFORM 1 FROM public.users
+    WHERE id = p_user_id AND deletion_scheduled_for <= NOW()
+    FOR UPDATE;
+    IF NOT FOUND THEN
+        RETURN false;
+    END IF;
+
+    IF EXISTS (SELECT 1 FROM public.sole_owned_organizations(p_user_id)) THEN
+        RAISE EXCEPTION 'user % is the sole owner of an organization with other members', p_user_id;
+    END IF;
+
+    UPDATE public.model_requests SET user_id = NULL
+    WHERE user_id = p_user_id AND organization_id IS NOT NULL;
+    UPDATE public.api_keys
+    SET user_id = NULL,
+        is_active = false,
+        revoked_at = COALESCE(revoked_at, NOW()),
+        revocation_reason = COALESCE(revocation_reason, 'owner account erased')
+    WHERE user_id = p_user_id AND organization_id IS NOT NULL;
+
+    DELETE FROM public.model_requests WHERE user_id = p_user_id AND organization_id IS NULL;
+    DELETE FROM public.api_keys WHERE user_id = p_user_id AND organization_id IS NULL;
+    DELETE FROM public.refresh_tokens WHERE user_id = p_user_id;
+    DELETE FROM public.mfa_recovery_codes WHERE user_id = p_user_id;
+    DELETE FROM public.notifications WHERE user_id = p_user_id;
+    DELETE FROM public.user_roles WHERE user_id = p_user_id;
+    DELETE FROM public.users WHERE id = p_user_id;
+    v_erased := FOUND;
+
+    IF v_erased THEN
+        INSERT INTO public.pending_auth_deletions (user_id) VALUES (p_user_id)
+        ON CONFLICT (user_id) DO NOTHING;
+    END IF;
+
+    RETURN v_erased;
+END;
+$$;
+
+REVOKE EXECUTE ON FUNCTION public.erase_user(UUID) FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.erase_user(UUID) TO service_role;
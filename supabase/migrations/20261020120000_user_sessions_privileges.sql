@@ -0,0 +1,6 @@
+-- touch_user_session runs as its owner, and PostgREST exposes every public
+-- function, so anyone holding the anon key could plant sessions in another
+-- user's list or keep one looking active. Only the API, as the service role,
+-- may call it.
+REVOKE EXECUTE ON FUNCTION public.touch_user_session(UUID, UUID, TEXT, TEXT, TEXT, TEXT) FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.touch_user_session(UUID, UUID, TEXT, TEXT, TEXT, TEXT) TO service_role;
@@ -0,0 +1,5 @@
+-- sole_owned_organizations runs as its owner, and PostgREST exposes every
+-- public function, so anyone holding the anon key could map out who owns
+-- which organization. Only the API, as the service role, may call it.
+REVOKE EXECUTE ON FUNCTION public.sole_owned_organizations(UUID) FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.sole_owned_organizations(UUID) TO service_role;
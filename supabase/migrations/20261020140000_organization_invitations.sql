@@ -0,0 +1,27 @@
+-- Adding someone to an organization used to make them a member on the spot,
+-- so an admin could pull any account in, even make it the sole owner and so
+-- block its erasure. Now it invites them, and they only join by accepting.
+-- One invitation per user and organization; inviting again replaces it.
+CREATE TABLE IF NOT EXISTS public.organization_invitations (
+    id UUID PRIMARY KEY DEFAULT gen_random_uuid(),
+    organization_id UUID NOT NULL REFERENCES public.organizations(id) ON DELETE CASCADE,
+    user_id UUID NOT NULL REFERENCES public.users(id) ON DELETE CASCADE,
+    role TEXT NOT NULL DEFAULT 'member',
+    invited_by UUID REFERENCES public.users(id) ON DELETE SET NULL,
+    created_at TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    expires_at TIMESTAMP WITH TIME ZONE NOT NULL,
+    CONSTRAINT organization_invitations_role CHECK (role IN ('owner', 'admin', 'member')),
+    CONSTRAINT organization_invitations_once UNIQUE (organization_id, user_id)
+);
+
+CREATE INDEX IF NOT EXISTS idx_organization_invitations_user_id ON public.organization_invitations(user_id);
+
+ALTER TABLE public.organization_invitations ENABLE ROW LEVEL SECURITY;
+
+CREATE POLICY "Users can view their invitations"
+    ON public.organization_invitations FOR SELECT
+    USING (auth.uid() = user_id);
+
+CREATE POLICY "Organization admins can view organization invitations"
+    ON public.organization_invitations FOR SELECT
+    USING (public.organization_role(organization_id) IN ('owner', 'admin'));
@@ -0,0 +1,6 @@
+-- sync_auth_user runs as its owner, and PostgREST exposes every public
+-- function, so anyone holding the anon key could probe auth.users by ID and
+-- rewrite the users row it mirrors. Only the API, as the service role, may
+-- call it.
+REVOKE EXECUTE ON FUNCTION public.sync_auth_user(UUID) FROM PUBLIC, anon, authenticated;
+GRANT EXECUTE ON FUNCTION public.sync_auth_user(UUID) TO service_role;